@@ -0,0 +1,345 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/maelvls/secret-transform/transform"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client/config"
+	"sigs.k8s.io/controller-runtime/pkg/manager/signals"
+)
+
+const agentUsage = `Usage: secret-transform agent --secret NAME --dir DIR [-n NAMESPACE]
+         [--file KEY=PATH...] [--file-mode MODE] [--uid UID] [--gid GID]
+         [--signal-pid-file FILE | --signal-process NAME] [--context CONTEXT]
+
+Watches a single Secret, applies the secret-transform annotations to it in
+memory, and writes the resulting keys as files into DIR. The Secret itself
+isn't updated. Meant to run as a sidecar container next to a workload that
+can't be restarted when its certificate changes.
+
+The files are swapped atomically the same way the kubelet updates the Secret
+volumes: they are written into a new timestamped directory, and the symlink
+DIR/..data is then renamed to point to it. Each file is a symlink going
+through DIR/..data, so the readers always see a consistent set of files.
+
+By default, every key of the Secret is written into a file of the same name.
+With --file, only the given keys are written, to the given paths relative to
+DIR; --file can be repeated.
+
+When the files change, SIGHUP is sent to the process whose PID is in the
+file given with --signal-pid-file, or to the oldest process named as given
+with --signal-process. Signaling a process of another container requires
+shareProcessNamespace: true in the Pod spec.
+
+The namespace defaults to the POD_NAMESPACE environment variable, then to the
+namespace of the Pod's service account.
+`
+
+const serviceAccountNamespaceFile = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+
+// agentCmd implements "secret-transform agent". Returns the exit code.
+func agentCmd(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("agent", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() { fmt.Fprint(stderr, agentUsage) }
+	namespace := fs.String("n", "", "the namespace of the Secret")
+	secretName := fs.String("secret", "", "the name of the Secret to watch")
+	dir := fs.String("dir", "", "the directory in which the files are written")
+	files := fileMapping{}
+	fs.Var(files, "file", "write the key KEY into the file PATH, relative to --dir; can be repeated")
+	mode := fileMode(0o600)
+	fs.Var(&mode, "file-mode", "the permissions of the files, in octal")
+	uid := fs.Int("uid", -1, "the owner of the files; -1 keeps the current user")
+	gid := fs.Int("gid", -1, "the group of the files; -1 keeps the current group")
+	pidFile := fs.String("signal-pid-file", "", "send SIGHUP to the process whose PID is in this file when the files change")
+	processName := fs.String("signal-process", "", "send SIGHUP to the oldest process of this name when the files change")
+	kubeContext := fs.String("context", "", "the kubeconfig context to use")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() > 0 || *secretName == "" || *dir == "" {
+		fs.Usage()
+		return 2
+	}
+	if *pidFile != "" && *processName != "" {
+		fmt.Fprintf(stderr, "error: --signal-pid-file and --signal-process are mutually exclusive\n")
+		return 2
+	}
+	if *namespace == "" {
+		*namespace = defaultNamespace()
+	}
+	if *namespace == "" {
+		fmt.Fprintf(stderr, "error: the namespace could not be guessed, use -n\n")
+		return 2
+	}
+
+	cfg, err := config.GetConfigWithContext(*kubeContext)
+	if err != nil {
+		fmt.Fprintf(stderr, "error: %v\n", err)
+		return 2
+	}
+	clientset, err := kubernetes.NewForConfig(cfg)
+	if err != nil {
+		fmt.Fprintf(stderr, "error: %v\n", err)
+		return 2
+	}
+
+	a := &agent{
+		writer: atomicWriter{dir: *dir, mode: os.FileMode(mode), uid: *uid, gid: *gid},
+		files:  files,
+		getSecret: func(name string) (map[string][]byte, error) {
+			referenced, err := clientset.CoreV1().Secrets(*namespace).Get(context.Background(), name, metav1.GetOptions{})
+			if err != nil {
+				return nil, err
+			}
+			return referenced.Data, nil
+		},
+		log: stdout,
+	}
+	switch {
+	case *pidFile != "":
+		a.findProcess = func() (int, error) { return readPIDFile(*pidFile) }
+	case *processName != "":
+		a.findProcess = func() (int, error) { return findProcessByName("/proc", *processName) }
+	}
+
+	ctx := signals.SetupSignalHandler()
+	a.run(ctx, clientset, *namespace, *secretName)
+	return 0
+}
+
+type agent struct {
+	writer atomicWriter
+
+	// Maps the keys of the Secret to the paths of the files. When empty,
+	// every key is written into a file of the same name.
+	files fileMapping
+
+	// Returns the PID of the process to send SIGHUP to when the files change.
+	// Nil when no process is to be signaled.
+	findProcess func() (int, error)
+
+	// Reads the Secrets referenced by the watched Secret, such as the ones
+	// holding a passphrase. They are read again at each sync, so a rotated
+	// passphrase is picked up within a minute.
+	getSecret transform.SecretGetter
+
+	log io.Writer
+}
+
+// run watches the Secret and writes its files until the context is done. The
+// Secret is also synced every minute so that a failed write is retried.
+func (a *agent) run(ctx context.Context, clientset kubernetes.Interface, namespace, name string) {
+	lw := cache.NewListWatchFromClient(clientset.CoreV1().RESTClient(), "secrets", namespace, fields.OneTermEqualSelector("metadata.name", name))
+	handle := func(obj interface{}) {
+		secret, ok := obj.(*corev1.Secret)
+		if !ok {
+			return
+		}
+		if err := a.sync(secret); err != nil {
+			fmt.Fprintf(a.log, "%s/%s: error: %v\n", secret.Namespace, secret.Name, err)
+		}
+	}
+	_, informer := cache.NewInformer(lw, &corev1.Secret{}, time.Minute, cache.ResourceEventHandlerFuncs{
+		AddFunc:    handle,
+		UpdateFunc: func(_, obj interface{}) { handle(obj) },
+		DeleteFunc: func(interface{}) {
+			fmt.Fprintf(a.log, "%s/%s: the Secret was deleted, the files are kept\n", namespace, name)
+		},
+	})
+
+	fmt.Fprintf(a.log, "%s/%s: watching the Secret, writing the files into %s\n", namespace, name, a.writer.dir)
+	informer.Run(ctx.Done())
+}
+
+// sync applies the transforms to a copy of the Secret and writes the
+// resulting files. The process is signaled when files that were already
+// written are replaced.
+func (a *agent) sync(secret *corev1.Secret) error {
+	secret = secret.DeepCopy()
+	if secret.Data == nil {
+		secret.Data = make(map[string][]byte)
+	}
+	name := secret.Namespace + "/" + secret.Name
+
+	events, err := transform.ApplyWithSecrets(secret, a.getSecret)
+	for _, e := range events {
+		if e.Type == corev1.EventTypeWarning {
+			fmt.Fprintf(a.log, "%s: %s %s: %s\n", name, e.Type, e.Reason, e.Message)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("the files are left untouched: %w", err)
+	}
+
+	payload, err := a.payload(secret)
+	if err != nil {
+		return err
+	}
+
+	hadData := a.writer.hasData()
+	changed, err := a.writer.write(payload)
+	if err != nil {
+		return fmt.Errorf("while writing the files: %w", err)
+	}
+	if !changed {
+		return nil
+	}
+	fmt.Fprintf(a.log, "%s: wrote %d files into %s\n", name, len(payload), a.writer.dir)
+
+	if !hadData || a.findProcess == nil {
+		return nil
+	}
+	pid, err := a.findProcess()
+	if err != nil {
+		return fmt.Errorf("while looking for the process to signal: %w", err)
+	}
+	if err := signalProcess(pid, syscall.SIGHUP); err != nil {
+		return fmt.Errorf("while sending SIGHUP to the process %d: %w", pid, err)
+	}
+	fmt.Fprintf(a.log, "%s: sent SIGHUP to the process %d\n", name, pid)
+	return nil
+}
+
+// Returns the files to write, keyed by their path relative to the directory.
+func (a *agent) payload(secret *corev1.Secret) (map[string][]byte, error) {
+	payload := make(map[string][]byte)
+	if len(a.files) == 0 {
+		for key, value := range secret.Data {
+			payload[key] = value
+		}
+		return payload, nil
+	}
+
+	for key, path := range a.files {
+		value, found := secret.Data[key]
+		if !found {
+			return nil, fmt.Errorf("the key '%s' doesn't exist, the files are left untouched", key)
+		}
+		payload[path] = value
+	}
+	return payload, nil
+}
+
+func signalProcess(pid int, sig os.Signal) error {
+	// kill(2) treats 0 and negative PIDs as process groups.
+	if pid <= 0 {
+		return fmt.Errorf("invalid PID %d", pid)
+	}
+	proc, err := os.FindProcess(pid)
+	if err != nil {
+		return err
+	}
+	return proc.Signal(sig)
+}
+
+func readPIDFile(path string) (int, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(content)))
+	if err != nil {
+		return 0, fmt.Errorf("%s: invalid PID: %w", path, err)
+	}
+	return pid, nil
+}
+
+// Returns the PID of the oldest process, i.e., the one with the lowest PID,
+// whose name is the given name. The names are read from /proc/<pid>/comm,
+// which the kernel truncates to 15 characters.
+func findProcessByName(procDir, name string) (int, error) {
+	if len(name) > 15 {
+		name = name[:15]
+	}
+	entries, err := os.ReadDir(procDir)
+	if err != nil {
+		return 0, err
+	}
+
+	var pids []int
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		comm, err := os.ReadFile(filepath.Join(procDir, entry.Name(), "comm"))
+		if err != nil {
+			// The process may have exited in the meantime.
+			continue
+		}
+		if strings.TrimSpace(string(comm)) == name {
+			pids = append(pids, pid)
+		}
+	}
+	if len(pids) == 0 {
+		return 0, fmt.Errorf("no process named '%s' found", name)
+	}
+	sort.Ints(pids)
+	return pids[0], nil
+}
+
+func defaultNamespace() string {
+	if ns := os.Getenv("POD_NAMESPACE"); ns != "" {
+		return ns
+	}
+	content, err := os.ReadFile(serviceAccountNamespaceFile)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(content))
+}
+
+// fileMapping is a repeatable flag of the form KEY=PATH.
+type fileMapping map[string]string
+
+func (m fileMapping) String() string {
+	var pairs []string
+	for key, path := range m {
+		pairs = append(pairs, key+"="+path)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (m fileMapping) Set(value string) error {
+	key, path, found := strings.Cut(value, "=")
+	if !found || key == "" {
+		return errors.New("must be of the form KEY=PATH")
+	}
+	if err := validatePath(path); err != nil {
+		return err
+	}
+	m[key] = path
+	return nil
+}
+
+// fileMode is a flag holding file permissions written in octal.
+type fileMode os.FileMode
+
+func (m *fileMode) String() string { return fmt.Sprintf("%#o", uint32(*m)) }
+
+func (m *fileMode) Set(value string) error {
+	mode, err := strconv.ParseUint(value, 8, 32)
+	if err != nil || mode > 0o777 {
+		return errors.New("must be an octal number between 0 and 0777, e.g., 0640")
+	}
+	*m = fileMode(mode)
+	return nil
+}
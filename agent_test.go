@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestAtomicWriter(t *testing.T) {
+	dir := t.TempDir()
+	w := atomicWriter{dir: dir, mode: 0o640, uid: -1, gid: -1}
+	readFile := func(t *testing.T, path string) string {
+		t.Helper()
+		content, err := os.ReadFile(filepath.Join(dir, path))
+		require.NoError(t, err)
+		return string(content)
+	}
+
+	assert.False(t, w.hasData())
+	changed, err := w.write(map[string][]byte{"tls.pem": []byte("v1"), "certs/ca.crt": []byte("ca")})
+	require.NoError(t, err)
+	assert.True(t, changed)
+	assert.True(t, w.hasData())
+	assert.Equal(t, "v1", readFile(t, "tls.pem"))
+	assert.Equal(t, "ca", readFile(t, "certs/ca.crt"))
+
+	link, err := os.Readlink(filepath.Join(dir, "tls.pem"))
+	require.NoError(t, err)
+	assert.Equal(t, "..data/tls.pem", link, "the files must be symlinks going through ..data")
+
+	info, err := os.Stat(filepath.Join(dir, "tls.pem"))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o640), info.Mode().Perm())
+
+	firstTsDir, err := os.Readlink(filepath.Join(dir, "..data"))
+	require.NoError(t, err)
+
+	t.Run("the same contents aren't written again", func(t *testing.T) {
+		changed, err := w.write(map[string][]byte{"tls.pem": []byte("v1"), "certs/ca.crt": []byte("ca")})
+		require.NoError(t, err)
+		assert.False(t, changed)
+
+		tsDir, err := os.Readlink(filepath.Join(dir, "..data"))
+		require.NoError(t, err)
+		assert.Equal(t, firstTsDir, tsDir)
+	})
+
+	t.Run("a new mode is applied even when the contents are the same", func(t *testing.T) {
+		w := w
+		w.mode = 0o600
+		changed, err := w.write(map[string][]byte{"tls.pem": []byte("v1"), "certs/ca.crt": []byte("ca")})
+		require.NoError(t, err)
+		assert.True(t, changed)
+
+		info, err := os.Stat(filepath.Join(dir, "tls.pem"))
+		require.NoError(t, err)
+		assert.Equal(t, os.FileMode(0o600), info.Mode().Perm())
+		_, err = os.Stat(filepath.Join(dir, firstTsDir))
+		assert.ErrorIs(t, err, os.ErrNotExist)
+
+		changed, err = w.write(map[string][]byte{"tls.pem": []byte("v1"), "certs/ca.crt": []byte("ca")})
+		require.NoError(t, err)
+		assert.False(t, changed)
+	})
+
+	t.Run("new contents replace the files and the previous directory is removed", func(t *testing.T) {
+		changed, err := w.write(map[string][]byte{"tls.pem": []byte("v2")})
+		require.NoError(t, err)
+		assert.True(t, changed)
+		assert.Equal(t, "v2", readFile(t, "tls.pem"))
+
+		_, err = os.Lstat(filepath.Join(dir, "certs"))
+		assert.ErrorIs(t, err, os.ErrNotExist, "the symlinks of the removed files must be removed")
+		_, err = os.Stat(filepath.Join(dir, firstTsDir))
+		assert.ErrorIs(t, err, os.ErrNotExist)
+		_, err = os.Lstat(filepath.Join(dir, "..data_tmp"))
+		assert.ErrorIs(t, err, os.ErrNotExist)
+	})
+
+	t.Run("paths escaping the directory are rejected", func(t *testing.T) {
+		_, err := w.write(map[string][]byte{"../tls.pem": []byte("v3")})
+		assert.EqualError(t, err, "the path '../tls.pem' must not contain elements starting with '..'")
+		_, err = w.write(map[string][]byte{"/tls.pem": []byte("v3")})
+		assert.EqualError(t, err, "the path '/tls.pem' must be relative")
+		assert.Equal(t, "v2", readFile(t, "tls.pem"))
+	})
+}
+
+func TestAgentSync(t *testing.T) {
+	secret := func(tlsKey string) *corev1.Secret {
+		return &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "haproxy-tls", Annotations: map[string]string{
+				"secret-transform/secret-transform": "tls.pem",
+			}},
+			Data: map[string][]byte{"tls.crt": []byte("crt\n"), "tls.key": []byte(tlsKey)},
+		}
+	}
+
+	t.Run("the transformed keys are written and the process is only signaled when files are replaced", func(t *testing.T) {
+		dir := t.TempDir()
+		var log bytes.Buffer
+		lookups := 0
+		a := &agent{
+			writer: atomicWriter{dir: dir, mode: 0o600, uid: -1, gid: -1},
+			files:  fileMapping{"tls.pem": "haproxy/tls.pem"},
+			// An invalid PID, so that no process gets signaled; only the
+			// lookups are counted.
+			findProcess: func() (int, error) { lookups++; return -1, nil },
+			log:         &log,
+		}
+
+		require.NoError(t, a.sync(secret("key1\n")))
+		content, err := os.ReadFile(filepath.Join(dir, "haproxy/tls.pem"))
+		require.NoError(t, err)
+		assert.Equal(t, "key1\ncrt\n", string(content))
+		assert.Equal(t, 0, lookups, "the first write must not signal the process")
+
+		require.NoError(t, a.sync(secret("key1\n")))
+		assert.Equal(t, 0, lookups, "nothing changed")
+
+		err = a.sync(secret("key2\n"))
+		assert.Equal(t, 1, lookups)
+		assert.EqualError(t, err, "while sending SIGHUP to the process -1: invalid PID -1")
+		assert.Equal(t, "ns/haproxy-tls: wrote 1 files into "+dir+"\nns/haproxy-tls: wrote 1 files into "+dir+"\n", log.String())
+	})
+
+	t.Run("a missing key leaves the files untouched", func(t *testing.T) {
+		a := &agent{
+			writer: atomicWriter{dir: t.TempDir(), mode: 0o600, uid: -1, gid: -1},
+			files:  fileMapping{"ca.crt": "ca.crt"},
+			log:    &bytes.Buffer{},
+		}
+		err := a.sync(secret("key1\n"))
+		assert.EqualError(t, err, "the key 'ca.crt' doesn't exist, the files are left untouched")
+		assert.False(t, a.writer.hasData())
+	})
+
+	t.Run("a failed transform leaves the files untouched", func(t *testing.T) {
+		var log bytes.Buffer
+		a := &agent{writer: atomicWriter{dir: t.TempDir(), mode: 0o600, uid: -1, gid: -1}, log: &log}
+		s := secret("key1\n")
+		s.Annotations["secret-transform/condition"] = "("
+		assert.Error(t, a.sync(s))
+		assert.Contains(t, log.String(), "ns/haproxy-tls: Warning InvalidCondition: ")
+		assert.False(t, a.writer.hasData())
+	})
+}
+
+func TestFindProcessByName(t *testing.T) {
+	procDir := t.TempDir()
+	for pid, comm := range map[string]string{"1": "pause", "12": "haproxy", "7": "haproxy", "self": "secret-transfor"} {
+		require.NoError(t, os.MkdirAll(filepath.Join(procDir, pid), 0o755))
+		require.NoError(t, os.WriteFile(filepath.Join(procDir, pid, "comm"), []byte(comm+"\n"), 0o644))
+	}
+
+	pid, err := findProcessByName(procDir, "haproxy")
+	require.NoError(t, err)
+	assert.Equal(t, 7, pid, "the oldest process is signaled")
+
+	_, err = findProcessByName(procDir, "nginx")
+	assert.EqualError(t, err, "no process named 'nginx' found")
+}
+
+func TestAgentFlags(t *testing.T) {
+	files := fileMapping{}
+	require.NoError(t, files.Set("tls.pem=haproxy/tls.pem"))
+	assert.EqualError(t, files.Set("tls.pem"), "must be of the form KEY=PATH")
+	assert.EqualError(t, files.Set("tls.pem=../tls.pem"), "the path '../tls.pem' must not contain elements starting with '..'")
+	assert.Equal(t, "tls.pem=haproxy/tls.pem", files.String())
+
+	var mode fileMode
+	require.NoError(t, mode.Set("0640"))
+	assert.Equal(t, fileMode(0o640), mode)
+	assert.Error(t, mode.Set("0999"))
+	assert.Error(t, mode.Set("01777"))
+
+	var stderr bytes.Buffer
+	assert.Equal(t, 2, agentCmd([]string{"--secret=foo"}, &bytes.Buffer{}, &stderr))
+	assert.Contains(t, stderr.String(), "Usage: secret-transform agent")
+}
@@ -0,0 +1,91 @@
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// DeepCopyInto copies the receiver into out.
+func (in *TrustBundle) DeepCopyInto(out *TrustBundle) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	in.Spec.DeepCopyInto(&out.Spec)
+	in.Status.DeepCopyInto(&out.Status)
+}
+
+// DeepCopy returns a deep copy of the TrustBundle.
+func (in *TrustBundle) DeepCopy() *TrustBundle {
+	if in == nil {
+		return nil
+	}
+	out := new(TrustBundle)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject implements runtime.Object.
+func (in *TrustBundle) DeepCopyObject() runtime.Object {
+	return in.DeepCopy()
+}
+
+// DeepCopyInto copies the receiver into out.
+func (in *TrustBundleSpec) DeepCopyInto(out *TrustBundleSpec) {
+	*out = *in
+	in.Sources.Selector.DeepCopyInto(&out.Sources.Selector)
+	if in.Sources.Namespaces != nil {
+		out.Sources.Namespaces = make([]string, len(in.Sources.Namespaces))
+		copy(out.Sources.Namespaces, in.Sources.Namespaces)
+	}
+	if in.Target.JKS != nil {
+		jks := *in.Target.JKS
+		out.Target.JKS = &jks
+	}
+	if in.Target.PKCS12 != nil {
+		pkcs12 := *in.Target.PKCS12
+		out.Target.PKCS12 = &pkcs12
+	}
+	if in.RotationGracePeriod != nil {
+		grace := *in.RotationGracePeriod
+		out.RotationGracePeriod = &grace
+	}
+}
+
+// DeepCopyInto copies the receiver into out.
+func (in *TrustBundleStatus) DeepCopyInto(out *TrustBundleStatus) {
+	*out = *in
+	if in.Conditions != nil {
+		out.Conditions = make([]metav1.Condition, len(in.Conditions))
+		for i := range in.Conditions {
+			in.Conditions[i].DeepCopyInto(&out.Conditions[i])
+		}
+	}
+}
+
+// DeepCopyInto copies the receiver into out.
+func (in *TrustBundleList) DeepCopyInto(out *TrustBundleList) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ListMeta.DeepCopyInto(&out.ListMeta)
+	if in.Items != nil {
+		out.Items = make([]TrustBundle, len(in.Items))
+		for i := range in.Items {
+			in.Items[i].DeepCopyInto(&out.Items[i])
+		}
+	}
+}
+
+// DeepCopy returns a deep copy of the TrustBundleList.
+func (in *TrustBundleList) DeepCopy() *TrustBundleList {
+	if in == nil {
+		return nil
+	}
+	out := new(TrustBundleList)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject implements runtime.Object.
+func (in *TrustBundleList) DeepCopyObject() runtime.Object {
+	return in.DeepCopy()
+}
@@ -0,0 +1,98 @@
+// Package v1alpha1 contains the custom resources of secret-transform in the
+// API group secret-transform.io.
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// GroupVersion is the API group and version of the resources of this package.
+var GroupVersion = schema.GroupVersion{Group: "secret-transform.io", Version: "v1alpha1"}
+
+// AddToScheme adds the resources of this package to the scheme.
+func AddToScheme(scheme *runtime.Scheme) error {
+	scheme.AddKnownTypes(GroupVersion, &TrustBundle{}, &TrustBundleList{})
+	metav1.AddToGroupVersion(scheme, GroupVersion)
+	return nil
+}
+
+// TrustBundle collects the CA certificates found in a set of Secrets into a
+// single bundle written to a target Secret or ConfigMap. It is
+// cluster-scoped.
+type TrustBundle struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   TrustBundleSpec   `json:"spec"`
+	Status TrustBundleStatus `json:"status,omitempty"`
+}
+
+type TrustBundleSpec struct {
+	Sources TrustBundleSources `json:"sources"`
+	Target  TrustBundleTarget  `json:"target"`
+
+	// How long a CA certificate that is no longer found in the sources is
+	// kept in the bundle, so that the clients holding a certificate issued by
+	// the previous CA keep working while the CA rotates. When not set, the
+	// CA certificates are dropped as soon as they disappear from the sources.
+	RotationGracePeriod *metav1.Duration `json:"rotationGracePeriod,omitempty"`
+}
+
+// TrustBundleSources selects the Secrets the CA certificates are read from.
+type TrustBundleSources struct {
+	// The Secrets matching this selector are used.
+	Selector metav1.LabelSelector `json:"selector"`
+
+	// The namespaces in which the Secrets are looked up. All namespaces when
+	// empty.
+	Namespaces []string `json:"namespaces,omitempty"`
+
+	// The key of the Secrets that contains the PEM-encoded CA certificates.
+	// Defaults to ca.crt.
+	Key string `json:"key,omitempty"`
+}
+
+// TrustBundleTarget is where the bundle is written.
+type TrustBundleTarget struct {
+	// Either Secret or ConfigMap. Defaults to Secret.
+	Kind      string `json:"kind,omitempty"`
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+
+	// The key in which the PEM bundle is written. Defaults to ca-bundle.pem.
+	Key string `json:"key,omitempty"`
+
+	// When set, the bundle is also written as a JKS truststore.
+	JKS *TrustStore `json:"jks,omitempty"`
+
+	// When set, the bundle is also written as a PKCS#12 truststore.
+	PKCS12 *TrustStore `json:"pkcs12,omitempty"`
+}
+
+type TrustStore struct {
+	// The key in which the truststore is written.
+	Key string `json:"key"`
+
+	// The password of the truststore. Defaults to "changeit". Since a
+	// truststore only contains public certificates, the password doesn't
+	// protect anything secret.
+	Password string `json:"password,omitempty"`
+}
+
+type TrustBundleStatus struct {
+	// The number of distinct CA certificates in the bundle.
+	Certificates int `json:"certificates,omitempty"`
+
+	// The Ready condition tells whether the bundle was written.
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+}
+
+// TrustBundleList is a list of TrustBundles.
+type TrustBundleList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+
+	Items []TrustBundle `json:"items"`
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	dataDirName    = "..data"
+	newDataDirName = "..data_tmp"
+)
+
+// atomicWriter writes a set of files into a directory so that the readers
+// always see a consistent set of files, the same way the kubelet updates the
+// Secret volumes. The files are written into a new timestamped directory,
+// and the symlink "..data" is then swapped to point to it with a rename. Each
+// file is exposed through a symlink going through "..data":
+//
+//	tls.pem -> ..data/tls.pem
+//	..data -> ..2024_01_02_15_04_05.123456
+//	..2024_01_02_15_04_05.123456/tls.pem
+type atomicWriter struct {
+	dir  string
+	mode os.FileMode
+
+	// The owner of the files and directories. -1 leaves it unchanged.
+	uid, gid int
+}
+
+// validatePath checks that the path is relative, stays within the directory,
+// and doesn't collide with the files used for the swap.
+func validatePath(path string) error {
+	switch {
+	case path == "":
+		return errors.New("the path must not be empty")
+	case filepath.IsAbs(path):
+		return fmt.Errorf("the path '%s' must be relative", path)
+	case filepath.Clean(path) != path:
+		return fmt.Errorf("the path '%s' must be clean", path)
+	}
+	for _, elem := range strings.Split(path, string(filepath.Separator)) {
+		if strings.HasPrefix(elem, "..") {
+			return fmt.Errorf("the path '%s' must not contain elements starting with '..'", path)
+		}
+	}
+	return nil
+}
+
+// hasData returns true if the files were already written once.
+func (w atomicWriter) hasData() bool {
+	_, err := os.Readlink(filepath.Join(w.dir, dataDirName))
+	return err == nil
+}
+
+// write replaces the files of the directory with the payload, which maps the
+// paths relative to the directory to their contents. Returns false when the
+// files already had these contents, mode, and owner, in which case nothing is
+// written.
+func (w atomicWriter) write(payload map[string][]byte) (bool, error) {
+	for path := range payload {
+		if err := validatePath(path); err != nil {
+			return false, err
+		}
+	}
+	if err := os.MkdirAll(w.dir, 0o755); err != nil {
+		return false, err
+	}
+
+	oldTsName, err := os.Readlink(filepath.Join(w.dir, dataDirName))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return false, err
+	}
+	var oldPayload map[string][]byte
+	if oldTsName != "" {
+		oldPayload, err = readDataDir(filepath.Join(w.dir, oldTsName))
+		if err != nil {
+			return false, fmt.Errorf("while reading the previous files: %w", err)
+		}
+		sameAttrs, err := w.sameAttributes(filepath.Join(w.dir, oldTsName))
+		if err != nil {
+			return false, fmt.Errorf("while reading the previous files: %w", err)
+		}
+		if sameAttrs && samePayload(oldPayload, payload) {
+			return false, w.createUserVisiblePaths(payload)
+		}
+	}
+
+	tsDir, err := os.MkdirTemp(w.dir, time.Now().UTC().Format("..2006_01_02_15_04_05."))
+	if err != nil {
+		return false, err
+	}
+	if err := w.chmodChown(tsDir, 0o755); err != nil {
+		return false, err
+	}
+	for path, content := range payload {
+		if err := w.writeFile(tsDir, path, content); err != nil {
+			_ = os.RemoveAll(tsDir)
+			return false, err
+		}
+	}
+
+	// The rename of the symlink is what makes the swap atomic.
+	newDataDir := filepath.Join(w.dir, newDataDirName)
+	if err := os.Remove(newDataDir); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return false, err
+	}
+	if err := os.Symlink(filepath.Base(tsDir), newDataDir); err != nil {
+		return false, err
+	}
+	if err := os.Rename(newDataDir, filepath.Join(w.dir, dataDirName)); err != nil {
+		return false, err
+	}
+
+	if err := w.createUserVisiblePaths(payload); err != nil {
+		return true, err
+	}
+	if err := w.removeUserVisiblePaths(oldPayload, payload); err != nil {
+		return true, err
+	}
+	if oldTsName != "" {
+		if err := os.RemoveAll(filepath.Join(w.dir, oldTsName)); err != nil {
+			return true, err
+		}
+	}
+	return true, nil
+}
+
+func (w atomicWriter) writeFile(tsDir, path string, content []byte) error {
+	// The intermediate directories are created one by one so that they all
+	// get the owner.
+	dir := tsDir
+	for _, elem := range strings.Split(filepath.Dir(path), string(filepath.Separator)) {
+		if elem == "." {
+			break
+		}
+		dir = filepath.Join(dir, elem)
+		if err := os.Mkdir(dir, 0o755); err != nil && !errors.Is(err, fs.ErrExist) {
+			return err
+		}
+		if err := w.chmodChown(dir, 0o755); err != nil {
+			return err
+		}
+	}
+
+	file := filepath.Join(tsDir, path)
+	if err := os.WriteFile(file, content, w.mode); err != nil {
+		return err
+	}
+	// WriteFile is subject to the umask.
+	return w.chmodChown(file, w.mode)
+}
+
+func (w atomicWriter) chmodChown(path string, mode os.FileMode) error {
+	if err := os.Chmod(path, mode); err != nil {
+		return err
+	}
+	if w.uid == -1 && w.gid == -1 {
+		return nil
+	}
+	return os.Lchown(path, w.uid, w.gid)
+}
+
+// Creates the symlinks "<top>" -> "..data/<top>" for the top-level element of
+// each path of the payload.
+func (w atomicWriter) createUserVisiblePaths(payload map[string][]byte) error {
+	for top := range topLevelElems(payload) {
+		link := filepath.Join(w.dir, top)
+		if _, err := os.Lstat(link); err == nil {
+			continue
+		}
+		if err := os.Symlink(filepath.Join(dataDirName, top), link); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Removes the symlinks of the previous payload that aren't in the new
+// payload anymore. Files that weren't created by the writer are left alone.
+func (w atomicWriter) removeUserVisiblePaths(oldPayload, payload map[string][]byte) error {
+	newTops := topLevelElems(payload)
+	for top := range topLevelElems(oldPayload) {
+		if newTops[top] {
+			continue
+		}
+		link := filepath.Join(w.dir, top)
+		target, err := os.Readlink(link)
+		if err != nil || target != filepath.Join(dataDirName, top) {
+			continue
+		}
+		if err := os.Remove(link); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func topLevelElems(payload map[string][]byte) map[string]bool {
+	tops := make(map[string]bool)
+	for path := range payload {
+		tops[strings.Split(path, string(filepath.Separator))[0]] = true
+	}
+	return tops
+}
+
+// Returns the files found in the timestamped directory, keyed by their path
+// relative to it.
+func readDataDir(tsDir string) (map[string][]byte, error) {
+	payload := make(map[string][]byte)
+	err := filepath.WalkDir(tsDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(tsDir, path)
+		if err != nil {
+			return err
+		}
+		payload[rel] = content
+		return nil
+	})
+	return payload, err
+}
+
+// Returns true if the files and directories found in the timestamped
+// directory have the mode and the owner the writer gives them, so that a
+// change of --file-mode, --uid, or --gid is applied even when the contents
+// don't change.
+func (w atomicWriter) sameAttributes(tsDir string) (bool, error) {
+	same := true
+	err := filepath.WalkDir(tsDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		mode := w.mode
+		if d.IsDir() {
+			mode = 0o755
+		}
+		if info.Mode().Perm() != mode.Perm() {
+			same = false
+			return fs.SkipAll
+		}
+		stat, ok := info.Sys().(*syscall.Stat_t)
+		if ok && ((w.uid != -1 && int(stat.Uid) != w.uid) || (w.gid != -1 && int(stat.Gid) != w.gid)) {
+			same = false
+			return fs.SkipAll
+		}
+		return nil
+	})
+	return same, err
+}
+
+func samePayload(a, b map[string][]byte) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for path, content := range a {
+		other, found := b[path]
+		if !found || !bytes.Equal(content, other) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,405 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/maelvls/secret-transform/api/v1alpha1"
+	"github.com/maelvls/secret-transform/controller"
+	"github.com/maelvls/secret-transform/sds"
+	"github.com/maelvls/secret-transform/transform"
+	"go.uber.org/zap/zapcore"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/selection"
+	"k8s.io/apimachinery/pkg/util/validation"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	configAPIVersion = "secret-transform.io/v1alpha1"
+	configKind       = "ControllerConfiguration"
+)
+
+// controllerConfig is the configuration of the controller. It is read from the
+// file given with --config, and each field can be overridden with a flag.
+type controllerConfig struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+
+	// The address the metrics endpoint binds to. "0" disables it.
+	MetricsBindAddress string `json:"metricsBindAddress"`
+	// The address the health probes bind to. "0" disables them.
+	HealthProbeBindAddress string `json:"healthProbeBindAddress"`
+
+	LeaderElection leaderElectionConfig `json:"leaderElection"`
+
+	// The namespaces in which Secrets are watched. All namespaces when empty.
+	Namespaces []string `json:"namespaces,omitempty"`
+
+	// When set, only the Secrets matching this label selector are watched.
+	// The filtering is done by the API server.
+	SecretLabelSelector string `json:"secretLabelSelector,omitempty"`
+
+	// When true, only the Secrets labelled secret-transform.io/enabled=true
+	// are watched.
+	RequireEnabledLabel bool `json:"requireEnabledLabel"`
+
+	MaxConcurrentReconciles int `json:"maxConcurrentReconciles"`
+
+	// How often all the watched Secrets are reconciled again even when they
+	// didn't change.
+	SyncPeriod metav1.Duration `json:"syncPeriod"`
+
+	Logging loggingConfig `json:"logging"`
+
+	// One of "all", "warnings" or "none".
+	Events controller.EventVerbosity `json:"events"`
+
+	WarnLegacyAnnotations bool `json:"warnLegacyAnnotations"`
+
+	// When true, the workloads of the Secrets annotated with
+	// secret-transform/rollout are rolled out when the Secret is updated.
+	RolloutWorkloads bool `json:"rolloutWorkloads"`
+
+	// When true, the TrustBundle resources are reconciled. Requires the
+	// TrustBundle CRD to be installed.
+	TrustBundles bool `json:"trustBundles"`
+
+	// The address of the Envoy SDS gRPC server, either "host:port" or
+	// "unix:///path/to/socket". "0" disables it.
+	SDSBindAddress string `json:"sdsBindAddress"`
+	// The files used to serve SDS over mutual TLS. Required unless the SDS
+	// server binds to a Unix socket or a loopback address.
+	SDSTLS sdsTLSConfig `json:"sdsTLS"`
+
+	SystemRoots systemRootsConfig `json:"systemRoots"`
+}
+
+type sdsTLSConfig struct {
+	CertFile string `json:"certFile,omitempty"`
+	KeyFile  string `json:"keyFile,omitempty"`
+	// The CA that signs the certificates of the Envoy proxies.
+	ClientCAFile string `json:"clientCAFile,omitempty"`
+}
+
+// Returns nil when SDS is served without TLS.
+func (cfg sdsTLSConfig) files() *sds.TLSFiles {
+	if cfg == (sdsTLSConfig{}) {
+		return nil
+	}
+	return &sds.TLSFiles{CertFile: cfg.CertFile, KeyFile: cfg.KeyFile, ClientCAFile: cfg.ClientCAFile}
+}
+
+type systemRootsConfig struct {
+	// The PEM file holding the root store appended by the
+	// secret-transform/ca-bundle-with-system-roots annotation. Defaults to
+	// the root store of the controller image.
+	File string `json:"file,omitempty"`
+	// Recorded along with the digest of the file, e.g., the version of the
+	// ca-certificates package the file comes from.
+	Version string `json:"version,omitempty"`
+}
+
+type leaderElectionConfig struct {
+	Enabled bool `json:"enabled"`
+	// The namespace of the Lease. Defaults to the namespace the controller
+	// runs in.
+	Namespace string `json:"namespace,omitempty"`
+	// How long the other replicas wait before taking over when the leader
+	// stops renewing the Lease.
+	LeaseDuration metav1.Duration `json:"leaseDuration"`
+	// How long the leader keeps trying to renew the Lease before giving up.
+	RenewDeadline metav1.Duration `json:"renewDeadline"`
+	// How often the replicas try to acquire or renew the Lease.
+	RetryPeriod metav1.Duration `json:"retryPeriod"`
+}
+
+type loggingConfig struct {
+	// Either "json" or "text".
+	Format string `json:"format"`
+	// The higher, the more verbose. 0 only shows the info messages.
+	Verbosity int `json:"verbosity"`
+}
+
+func defaultControllerConfig() controllerConfig {
+	return controllerConfig{
+		APIVersion:             configAPIVersion,
+		Kind:                   configKind,
+		MetricsBindAddress:     ":8080",
+		HealthProbeBindAddress: ":8081",
+		SDSBindAddress:         "0",
+		SystemRoots:            systemRootsConfig{File: transform.DefaultSystemRootsFile},
+		LeaderElection: leaderElectionConfig{
+			LeaseDuration: metav1.Duration{Duration: 15 * time.Second},
+			RenewDeadline: metav1.Duration{Duration: 10 * time.Second},
+			RetryPeriod:   metav1.Duration{Duration: 2 * time.Second},
+		},
+		MaxConcurrentReconciles: 1,
+		SyncPeriod:              metav1.Duration{Duration: 10 * time.Hour},
+		Logging:                 loggingConfig{Format: "json"},
+		Events:                  controller.EventsAll,
+	}
+}
+
+// Returns the configuration of the controller from the defaults, then the
+// config file if --config is given, then the flags.
+func loadControllerConfig(args []string, stderr io.Writer) (controllerConfig, error) {
+	cfg := defaultControllerConfig()
+
+	// The flags are parsed twice: the first time to find the config file, and
+	// the second time, once the config file is loaded, so that the flags take
+	// precedence over the file.
+	var configFile string
+	fs := controllerFlags(&cfg, &configFile)
+	fs.SetOutput(io.Discard)
+	_ = fs.Parse(args) // The errors are reported by the second parse.
+
+	if configFile != "" {
+		content, err := os.ReadFile(configFile)
+		if err != nil {
+			return cfg, fmt.Errorf("while reading the config file: %w", err)
+		}
+		if err := yaml.UnmarshalStrict(content, &cfg); err != nil {
+			return cfg, fmt.Errorf("while parsing the config file %s: %w", configFile, err)
+		}
+		if cfg.APIVersion != configAPIVersion || cfg.Kind != configKind {
+			return cfg, fmt.Errorf("the config file %s must have 'apiVersion: %s' and 'kind: %s', got '%s' and '%s'", configFile, configAPIVersion, configKind, cfg.APIVersion, cfg.Kind)
+		}
+	}
+
+	fs = controllerFlags(&cfg, &configFile)
+	fs.SetOutput(stderr)
+	if err := fs.Parse(args); err != nil {
+		return cfg, err
+	}
+	if fs.NArg() > 0 {
+		return cfg, fmt.Errorf("unexpected argument: %s", fs.Arg(0))
+	}
+
+	return cfg, cfg.validate()
+}
+
+// Returns the flags of the controller. Their defaults are the current values
+// of cfg.
+func controllerFlags(cfg *controllerConfig, configFile *string) *flag.FlagSet {
+	fs := flag.NewFlagSet("secret-transform", flag.ContinueOnError)
+	fs.StringVar(configFile, "config", *configFile, "Path to a config file of kind "+configKind+". The flags take precedence over it.")
+	fs.StringVar(&cfg.MetricsBindAddress, "metrics-bind-address", cfg.MetricsBindAddress, `The address the metrics endpoint binds to. Use "0" to disable it.`)
+	fs.StringVar(&cfg.HealthProbeBindAddress, "health-probe-bind-address", cfg.HealthProbeBindAddress, `The address the health probes bind to. Use "0" to disable them.`)
+	fs.BoolVar(&cfg.LeaderElection.Enabled, "leader-elect", cfg.LeaderElection.Enabled, "Enable leader election so that only one replica reconciles at a time.")
+	fs.StringVar(&cfg.LeaderElection.Namespace, "leader-elect-namespace", cfg.LeaderElection.Namespace, "The namespace of the leader election Lease. Defaults to the namespace the controller runs in.")
+	fs.DurationVar(&cfg.LeaderElection.LeaseDuration.Duration, "leader-elect-lease-duration", cfg.LeaderElection.LeaseDuration.Duration, "How long the other replicas wait before taking over when the leader stops renewing the Lease.")
+	fs.DurationVar(&cfg.LeaderElection.RenewDeadline.Duration, "leader-elect-renew-deadline", cfg.LeaderElection.RenewDeadline.Duration, "How long the leader keeps trying to renew the Lease before giving up.")
+	fs.DurationVar(&cfg.LeaderElection.RetryPeriod.Duration, "leader-elect-retry-period", cfg.LeaderElection.RetryPeriod.Duration, "How often the replicas try to acquire or renew the Lease.")
+	fs.Var((*stringList)(&cfg.Namespaces), "namespaces", "Comma-separated list of the namespaces to watch. All namespaces when empty.")
+	fs.StringVar(&cfg.SecretLabelSelector, "secret-label-selector", cfg.SecretLabelSelector, "Only watch the Secrets matching this label selector, e.g., 'team=a'. All Secrets when empty.")
+	fs.BoolVar(&cfg.RequireEnabledLabel, "require-enabled-label", cfg.RequireEnabledLabel, "Only watch the Secrets labelled "+controller.EnabledLabelKey+"=true.")
+	fs.IntVar(&cfg.MaxConcurrentReconciles, "max-concurrent-reconciles", cfg.MaxConcurrentReconciles, "The maximum number of Secrets reconciled at the same time.")
+	fs.DurationVar(&cfg.SyncPeriod.Duration, "sync-period", cfg.SyncPeriod.Duration, "How often all the watched Secrets are reconciled again.")
+	fs.StringVar(&cfg.Logging.Format, "log-format", cfg.Logging.Format, `The log format, either "json" or "text".`)
+	fs.IntVar(&cfg.Logging.Verbosity, "v", cfg.Logging.Verbosity, "The log verbosity. The higher, the more verbose.")
+	fs.StringVar((*string)(&cfg.Events), "events", string(cfg.Events), `Which events are recorded on the Secrets: "all", "warnings" or "none".`)
+	fs.BoolVar(&cfg.WarnLegacyAnnotations, "warn-legacy-annotations", cfg.WarnLegacyAnnotations, "Show a Warning event on the Secrets that use the legacy cert-manager.io/* annotations.")
+	fs.BoolVar(&cfg.RolloutWorkloads, "rollout-workloads", cfg.RolloutWorkloads, "Roll out the workloads of the Secrets annotated with "+controller.RolloutAnnotKey+" when the Secret is updated.")
+	fs.BoolVar(&cfg.TrustBundles, "trust-bundles", cfg.TrustBundles, "Reconcile the TrustBundle resources. Requires the TrustBundle CRD.")
+	fs.StringVar(&cfg.SDSBindAddress, "sds-bind-address", cfg.SDSBindAddress, `The address of the Envoy SDS server serving the Secrets annotated with `+controller.SDSAnnotKey+`=true, either "host:port" or "unix:///path/to/socket". "0" disables it. Requires mutual TLS unless it is a Unix socket or a loopback address.`)
+	fs.StringVar(&cfg.SDSTLS.CertFile, "sds-tls-cert-file", cfg.SDSTLS.CertFile, "The PEM certificate of the SDS server.")
+	fs.StringVar(&cfg.SDSTLS.KeyFile, "sds-tls-key-file", cfg.SDSTLS.KeyFile, "The PEM private key of the SDS server.")
+	fs.StringVar(&cfg.SDSTLS.ClientCAFile, "sds-tls-client-ca-file", cfg.SDSTLS.ClientCAFile, "The PEM CA that signs the client certificates. The clients can only fetch the Secrets of the namespace of their SPIFFE ID.")
+	fs.StringVar(&cfg.SystemRoots.File, "system-roots-file", cfg.SystemRoots.File, "The PEM file holding the root CAs appended by the "+transform.CABundleWithSystemRootsAnnotKey+" annotation.")
+	fs.StringVar(&cfg.SystemRoots.Version, "system-roots-version", cfg.SystemRoots.Version, "The version of the root CAs given with --system-roots-file, recorded in the "+transform.SystemRootsVersionAnnotKey+" annotation along with the digest of the file.")
+	return fs
+}
+
+func (cfg controllerConfig) validate() error {
+	var errs []error
+	if err := validateBindAddress(cfg.MetricsBindAddress); err != nil {
+		errs = append(errs, fmt.Errorf("metricsBindAddress: %w", err))
+	}
+	if err := validateBindAddress(cfg.HealthProbeBindAddress); err != nil {
+		errs = append(errs, fmt.Errorf("healthProbeBindAddress: %w", err))
+	}
+	if err := cfg.validateSDS(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := cfg.LeaderElection.validate(); err != nil {
+		errs = append(errs, fmt.Errorf("leaderElection: %w", err))
+	}
+	for _, ns := range cfg.Namespaces {
+		if msgs := validation.IsDNS1123Label(ns); len(msgs) > 0 {
+			errs = append(errs, fmt.Errorf("namespaces: '%s': %s", ns, strings.Join(msgs, ", ")))
+		}
+	}
+	if _, err := labels.Parse(cfg.SecretLabelSelector); err != nil {
+		errs = append(errs, fmt.Errorf("secretLabelSelector: %w", err))
+	}
+	if cfg.MaxConcurrentReconciles < 1 {
+		errs = append(errs, fmt.Errorf("maxConcurrentReconciles: must be at least 1, got %d", cfg.MaxConcurrentReconciles))
+	}
+	if cfg.SyncPeriod.Duration <= 0 {
+		errs = append(errs, fmt.Errorf("syncPeriod: must be positive, got %s", cfg.SyncPeriod.Duration))
+	}
+	if cfg.Logging.Format != "json" && cfg.Logging.Format != "text" {
+		errs = append(errs, fmt.Errorf("logging.format: must be 'json' or 'text', got '%s'", cfg.Logging.Format))
+	}
+	if cfg.Logging.Verbosity < 0 {
+		errs = append(errs, fmt.Errorf("logging.verbosity: must not be negative, got %d", cfg.Logging.Verbosity))
+	}
+	if cfg.SystemRoots.File == "" {
+		errs = append(errs, fmt.Errorf("systemRoots.file: must not be empty"))
+	}
+	switch cfg.Events {
+	case controller.EventsAll, controller.EventsWarnings, controller.EventsNone:
+	default:
+		errs = append(errs, fmt.Errorf("events: must be 'all', 'warnings' or 'none', got '%s'", cfg.Events))
+	}
+	return errors.Join(errs...)
+}
+
+// The leader would lose the Lease without noticing if it didn't give up
+// renewing it before the Lease expires.
+func (cfg leaderElectionConfig) validate() error {
+	if cfg.Namespace != "" {
+		if msgs := validation.IsDNS1123Label(cfg.Namespace); len(msgs) > 0 {
+			return fmt.Errorf("namespace: '%s': %s", cfg.Namespace, strings.Join(msgs, ", "))
+		}
+	}
+	if cfg.RetryPeriod.Duration <= 0 {
+		return fmt.Errorf("retryPeriod: must be positive, got %s", cfg.RetryPeriod.Duration)
+	}
+	if cfg.RenewDeadline.Duration <= cfg.RetryPeriod.Duration {
+		return fmt.Errorf("renewDeadline (%s) must be greater than retryPeriod (%s)", cfg.RenewDeadline.Duration, cfg.RetryPeriod.Duration)
+	}
+	if cfg.LeaseDuration.Duration <= cfg.RenewDeadline.Duration {
+		return fmt.Errorf("leaseDuration (%s) must be greater than renewDeadline (%s)", cfg.LeaseDuration.Duration, cfg.RenewDeadline.Duration)
+	}
+	return nil
+}
+
+// The SDS server serves private keys, so it must either require mutual TLS or
+// only be reachable from the same Pod or node.
+func (cfg controllerConfig) validateSDS() error {
+	if err := cfg.SDSTLS.validate(); err != nil {
+		return fmt.Errorf("sdsTLS: %w", err)
+	}
+	if cfg.SDSBindAddress == "0" || strings.HasPrefix(cfg.SDSBindAddress, "unix://") {
+		return nil
+	}
+	if err := validateBindAddress(cfg.SDSBindAddress); err != nil {
+		return fmt.Errorf("sdsBindAddress: %w", err)
+	}
+	if cfg.SDSTLS.files() == nil {
+		if err := sds.CheckPlaintextAddress(cfg.SDSBindAddress); err != nil {
+			return fmt.Errorf("sdsBindAddress: %w", err)
+		}
+	}
+	return nil
+}
+
+func (cfg sdsTLSConfig) validate() error {
+	if cfg == (sdsTLSConfig{}) {
+		return nil
+	}
+	if cfg.CertFile == "" || cfg.KeyFile == "" || cfg.ClientCAFile == "" {
+		return fmt.Errorf("certFile, keyFile, and clientCAFile must be given together")
+	}
+	return nil
+}
+
+// The address must be of the form "host:port" or be "0", which disables the
+// endpoint.
+func validateBindAddress(addr string) error {
+	if addr == "0" {
+		return nil
+	}
+	_, _, err := net.SplitHostPort(addr)
+	return err
+}
+
+func (cfg controllerConfig) managerOptions() manager.Options {
+	opts := manager.Options{
+		MetricsBindAddress:     cfg.MetricsBindAddress,
+		HealthProbeBindAddress: cfg.HealthProbeBindAddress,
+		SyncPeriod:             &cfg.SyncPeriod.Duration,
+
+		LeaderElection:             cfg.LeaderElection.Enabled,
+		LeaderElectionID:           "secret-transform",
+		LeaderElectionNamespace:    cfg.LeaderElection.Namespace,
+		LeaderElectionResourceLock: resourcelock.LeasesResourceLock,
+		LeaseDuration:              &cfg.LeaderElection.LeaseDuration.Duration,
+		RenewDeadline:              &cfg.LeaderElection.RenewDeadline.Duration,
+		RetryPeriod:                &cfg.LeaderElection.RetryPeriod.Duration,
+		// On SIGTERM, the Lease is released right away so that another
+		// replica takes over without waiting for the Lease to expire.
+		LeaderElectionReleaseOnCancel: true,
+	}
+	opts.NewCache = controller.NewCache(cfg.cacheOptions())
+	if cfg.TrustBundles {
+		opts.Scheme = runtime.NewScheme()
+		// Cannot fail, the schemes are built in.
+		_ = clientgoscheme.AddToScheme(opts.Scheme)
+		_ = v1alpha1.AddToScheme(opts.Scheme)
+	}
+	return opts
+}
+
+func (cfg controllerConfig) cacheOptions() controller.CacheOptions {
+	opts := controller.CacheOptions{Namespaces: cfg.Namespaces}
+	if cfg.SecretLabelSelector == "" && !cfg.RequireEnabledLabel {
+		return opts
+	}
+
+	// Already validated.
+	selector, _ := labels.Parse(cfg.SecretLabelSelector)
+	if cfg.RequireEnabledLabel {
+		enabled, _ := labels.NewRequirement(controller.EnabledLabelKey, selection.Equals, []string{"true"})
+		selector = selector.Add(*enabled)
+	}
+	opts.SecretSelector = selector
+	return opts
+}
+
+func (cfg controllerConfig) controllerOptions() controller.Options {
+	return controller.Options{
+		WarnLegacyAnnotations:   cfg.WarnLegacyAnnotations,
+		Events:                  cfg.Events,
+		MaxConcurrentReconciles: cfg.MaxConcurrentReconciles,
+		RolloutWorkloads:        cfg.RolloutWorkloads,
+	}
+}
+
+func (cfg controllerConfig) logger() logr.Logger {
+	encoder := zap.JSONEncoder()
+	if cfg.Logging.Format == "text" {
+		encoder = zap.ConsoleEncoder()
+	}
+	return zap.New(encoder, zap.Level(zapcore.Level(-cfg.Logging.Verbosity)))
+}
+
+// stringList is a flag.Value for comma-separated lists.
+type stringList []string
+
+func (l *stringList) String() string { return strings.Join(*l, ",") }
+
+func (l *stringList) Set(s string) error {
+	*l = nil
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*l = append(*l, item)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/maelvls/secret-transform/api/v1alpha1"
+	"github.com/maelvls/secret-transform/controller"
+	"github.com/maelvls/secret-transform/sds"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadControllerConfig(t *testing.T) {
+	writeConfig := func(t *testing.T, content string) string {
+		t.Helper()
+		path := filepath.Join(t.TempDir(), "config.yaml")
+		require.NoError(t, os.WriteFile(path, []byte(content), 0o644))
+		return path
+	}
+
+	t.Run("defaults", func(t *testing.T) {
+		cfg, err := loadControllerConfig(nil, io.Discard)
+		require.NoError(t, err)
+		assert.Equal(t, defaultControllerConfig(), cfg)
+	})
+
+	t.Run("the chart's -v=2 sets the verbosity", func(t *testing.T) {
+		cfg, err := loadControllerConfig([]string{"-v=2"}, io.Discard)
+		require.NoError(t, err)
+		assert.Equal(t, 2, cfg.Logging.Verbosity)
+	})
+
+	t.Run("flags", func(t *testing.T) {
+		cfg, err := loadControllerConfig([]string{
+			"--metrics-bind-address=0",
+			"--health-probe-bind-address=:9000",
+			"--leader-elect",
+			"--namespaces=foo, bar",
+			"--max-concurrent-reconciles=4",
+			"--sync-period=1h",
+			"--log-format=text",
+			"--events=warnings",
+			"--warn-legacy-annotations",
+		}, io.Discard)
+		require.NoError(t, err)
+		assert.Equal(t, "0", cfg.MetricsBindAddress)
+		assert.Equal(t, ":9000", cfg.HealthProbeBindAddress)
+		assert.True(t, cfg.LeaderElection.Enabled)
+		assert.Equal(t, []string{"foo", "bar"}, cfg.Namespaces)
+		assert.Equal(t, 4, cfg.MaxConcurrentReconciles)
+		assert.Equal(t, time.Hour, cfg.SyncPeriod.Duration)
+		assert.Equal(t, "text", cfg.Logging.Format)
+		assert.Equal(t, controller.EventsWarnings, cfg.Events)
+		assert.True(t, cfg.WarnLegacyAnnotations)
+	})
+
+	t.Run("the flags take precedence over the config file", func(t *testing.T) {
+		path := writeConfig(t, `apiVersion: secret-transform.io/v1alpha1
+kind: ControllerConfiguration
+namespaces: [foo]
+maxConcurrentReconciles: 2
+syncPeriod: 30m
+logging:
+  format: text
+`)
+		cfg, err := loadControllerConfig([]string{"--config", path, "--max-concurrent-reconciles=3"}, io.Discard)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"foo"}, cfg.Namespaces)
+		assert.Equal(t, 3, cfg.MaxConcurrentReconciles)
+		assert.Equal(t, 30*time.Minute, cfg.SyncPeriod.Duration)
+		assert.Equal(t, "text", cfg.Logging.Format)
+		assert.Equal(t, ":8080", cfg.MetricsBindAddress, "unset fields keep their default")
+	})
+
+	t.Run("unknown fields are rejected", func(t *testing.T) {
+		path := writeConfig(t, `apiVersion: secret-transform.io/v1alpha1
+kind: ControllerConfiguration
+maxConcurentReconciles: 2
+`)
+		_, err := loadControllerConfig([]string{"--config", path}, io.Discard)
+		assert.ErrorContains(t, err, `unknown field "maxConcurentReconciles"`)
+	})
+
+	t.Run("the apiVersion and kind are checked", func(t *testing.T) {
+		path := writeConfig(t, `apiVersion: secret-transform.io/v2
+kind: ControllerConfiguration
+`)
+		_, err := loadControllerConfig([]string{"--config", path}, io.Discard)
+		assert.ErrorContains(t, err, "must have 'apiVersion: secret-transform.io/v1alpha1' and 'kind: ControllerConfiguration', got 'secret-transform.io/v2' and 'ControllerConfiguration'")
+	})
+
+	t.Run("invalid values are all reported", func(t *testing.T) {
+		_, err := loadControllerConfig([]string{
+			"--metrics-bind-address=8080",
+			"--sds-bind-address=localhost",
+			"--namespaces=Foo",
+			"--max-concurrent-reconciles=0",
+			"--sync-period=0s",
+			"--log-format=xml",
+			"--events=some",
+		}, io.Discard)
+		assert.EqualError(t, err, `metricsBindAddress: address 8080: missing port in address
+sdsBindAddress: address localhost: missing port in address
+namespaces: 'Foo': a lowercase RFC 1123 label must consist of lower case alphanumeric characters or '-', and must start and end with an alphanumeric character (e.g. 'my-name',  or '123-abc', regex used for validation is '[a-z0-9]([-a-z0-9]*[a-z0-9])?')
+maxConcurrentReconciles: must be at least 1, got 0
+syncPeriod: must be positive, got 0s
+logging.format: must be 'json' or 'text', got 'xml'
+events: must be 'all', 'warnings' or 'none', got 'some'`)
+	})
+
+	t.Run("leader election", func(t *testing.T) {
+		cfg, err := loadControllerConfig([]string{
+			"--leader-elect",
+			"--leader-elect-namespace=secret-transform",
+			"--leader-elect-lease-duration=30s",
+			"--leader-elect-renew-deadline=20s",
+			"--leader-elect-retry-period=5s",
+		}, io.Discard)
+		require.NoError(t, err)
+		opts := cfg.managerOptions()
+		assert.True(t, opts.LeaderElection)
+		assert.Equal(t, "secret-transform", opts.LeaderElectionNamespace)
+		assert.Equal(t, "leases", opts.LeaderElectionResourceLock)
+		assert.Equal(t, 30*time.Second, *opts.LeaseDuration)
+		assert.Equal(t, 20*time.Second, *opts.RenewDeadline)
+		assert.Equal(t, 5*time.Second, *opts.RetryPeriod)
+		assert.True(t, opts.LeaderElectionReleaseOnCancel)
+	})
+
+	t.Run("the Lease must outlive the renew deadline", func(t *testing.T) {
+		_, err := loadControllerConfig([]string{"--leader-elect-lease-duration=10s"}, io.Discard)
+		assert.EqualError(t, err, "leaderElection: leaseDuration (10s) must be greater than renewDeadline (10s)")
+	})
+
+	t.Run("cache options", func(t *testing.T) {
+		cfg, err := loadControllerConfig([]string{"--namespaces=team-a,team-b", "--secret-label-selector=team in (a, b)"}, io.Discard)
+		require.NoError(t, err)
+		opts := cfg.cacheOptions()
+		assert.Equal(t, []string{"team-a", "team-b"}, opts.Namespaces)
+		assert.Equal(t, "team in (a,b)", opts.SecretSelector.String())
+
+		cfg, err = loadControllerConfig([]string{"--require-enabled-label"}, io.Discard)
+		require.NoError(t, err)
+		assert.Equal(t, "secret-transform.io/enabled=true", cfg.cacheOptions().SecretSelector.String())
+
+		cfg, err = loadControllerConfig([]string{"--require-enabled-label", "--secret-label-selector=team=a"}, io.Discard)
+		require.NoError(t, err)
+		assert.Equal(t, "secret-transform.io/enabled=true,team=a", cfg.cacheOptions().SecretSelector.String())
+
+		assert.Nil(t, defaultControllerConfig().cacheOptions().SecretSelector)
+
+		_, err = loadControllerConfig([]string{"--secret-label-selector=team in"}, io.Discard)
+		assert.ErrorContains(t, err, "secretLabelSelector: ")
+	})
+
+	t.Run("the TrustBundle type is registered when enabled", func(t *testing.T) {
+		cfg, err := loadControllerConfig([]string{"--trust-bundles"}, io.Discard)
+		require.NoError(t, err)
+		assert.True(t, cfg.managerOptions().Scheme.Recognizes(v1alpha1.GroupVersion.WithKind("TrustBundle")))
+		assert.Nil(t, defaultControllerConfig().managerOptions().Scheme)
+	})
+
+	t.Run("the SDS server can listen on a unix socket", func(t *testing.T) {
+		cfg, err := loadControllerConfig([]string{"--sds-bind-address=unix:///var/run/sds.sock"}, io.Discard)
+		require.NoError(t, err)
+		assert.Equal(t, "unix:///var/run/sds.sock", cfg.SDSBindAddress)
+	})
+
+	t.Run("the SDS server requires mutual TLS unless it is local", func(t *testing.T) {
+		_, err := loadControllerConfig([]string{"--sds-bind-address=:8082"}, io.Discard)
+		assert.EqualError(t, err, "sdsBindAddress: ':8082' is neither a Unix socket nor a loopback address, mutual TLS is required")
+
+		_, err = loadControllerConfig([]string{"--sds-bind-address=127.0.0.1:8082"}, io.Discard)
+		assert.NoError(t, err)
+
+		cfg, err := loadControllerConfig([]string{
+			"--sds-bind-address=:8082",
+			"--sds-tls-cert-file=tls.crt",
+			"--sds-tls-key-file=tls.key",
+			"--sds-tls-client-ca-file=ca.crt",
+		}, io.Discard)
+		require.NoError(t, err)
+		assert.Equal(t, &sds.TLSFiles{CertFile: "tls.crt", KeyFile: "tls.key", ClientCAFile: "ca.crt"}, cfg.SDSTLS.files())
+
+		_, err = loadControllerConfig([]string{"--sds-bind-address=:8082", "--sds-tls-cert-file=tls.crt"}, io.Discard)
+		assert.EqualError(t, err, "sdsTLS: certFile, keyFile, and clientCAFile must be given together")
+	})
+
+	t.Run("unknown flags are rejected", func(t *testing.T) {
+		_, err := loadControllerConfig([]string{"--foo"}, io.Discard)
+		assert.EqualError(t, err, "flag provided but not defined: -foo")
+	})
+}
@@ -0,0 +1,108 @@
+package controller
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/util/workqueue"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+// EnabledLabelKey is the label that opts a Secret in when the controller only
+// watches the labelled Secrets. Unlike annotations, labels can be filtered on
+// by the API server.
+const EnabledLabelKey = "secret-transform.io/enabled"
+
+// CacheOptions configures the informer cache of the manager.
+type CacheOptions struct {
+	// The namespaces in which Secrets are cached. All namespaces when empty.
+	Namespaces []string
+
+	// When set, only the Secrets matching the selector are cached. The
+	// filtering is done by the API server.
+	SecretSelector labels.Selector
+}
+
+// NewCache returns the function the manager uses to create its informer
+// cache. Since there is no way to filter Secrets by annotation on the API
+// server side, every Secret has to be cached; to keep the memory usage low,
+// the Secrets that aren't annotated are cached without their data (see
+// StripSecret).
+func NewCache(opts CacheOptions) cache.NewCacheFunc {
+	return func(config *rest.Config, cacheOpts cache.Options) (cache.Cache, error) {
+		cacheOpts.TransformByObject = cache.TransformByObject{&corev1.Secret{}: StripSecret}
+		if opts.SecretSelector != nil {
+			cacheOpts.SelectorsByObject = cache.SelectorsByObject{&corev1.Secret{}: {Label: opts.SecretSelector}}
+		}
+
+		switch len(opts.Namespaces) {
+		case 0:
+			return cache.New(config, cacheOpts)
+		case 1:
+			cacheOpts.Namespace = opts.Namespaces[0]
+			return cache.New(config, cacheOpts)
+		default:
+			return cache.MultiNamespacedCacheBuilder(opts.Namespaces)(config, cacheOpts)
+		}
+	}
+}
+
+// StripSecret removes from a Secret what the controller doesn't need before
+// the Secret is stored into the informer cache. The managed fields are always
+// removed. The data and the kubectl last-applied annotation, which contains a
+// copy of the data, are removed from the Secrets that none of the registered
+// transformers is interested in. When such a Secret is annotated later on, the
+// update event brings the full Secret back into the cache.
+func StripSecret(obj interface{}) (interface{}, error) {
+	secret, ok := obj.(*corev1.Secret)
+	if !ok {
+		return obj, nil
+	}
+
+	secret.ManagedFields = nil
+	if ShouldReconcileSecret(secret.Annotations) {
+		return secret, nil
+	}
+
+	secret.Data = nil
+	secret.StringData = nil
+	delete(secret.Annotations, corev1.LastAppliedConfigAnnotation)
+	return secret, nil
+}
+
+var cachedSecrets = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "secret_transform_cached_secrets",
+	Help: "Number of Secrets held in the informer cache. The Secrets that aren't annotated are cached without their data.",
+}, []string{"annotated"})
+
+func init() {
+	metrics.Registry.MustRegister(cachedSecrets)
+}
+
+// Keeps the secret_transform_cached_secrets metric up to date. It doesn't
+// enqueue anything.
+var countCachedSecrets = handler.Funcs{
+	CreateFunc: func(e event.CreateEvent, _ workqueue.RateLimitingInterface) {
+		countSecret(e.Object, 1)
+	},
+	UpdateFunc: func(e event.UpdateEvent, _ workqueue.RateLimitingInterface) {
+		countSecret(e.ObjectOld, -1)
+		countSecret(e.ObjectNew, 1)
+	},
+	DeleteFunc: func(e event.DeleteEvent, _ workqueue.RateLimitingInterface) {
+		countSecret(e.Object, -1)
+	},
+}
+
+func countSecret(obj client.Object, delta float64) {
+	annotated := "false"
+	if ShouldReconcileSecret(obj.GetAnnotations()) {
+		annotated = "true"
+	}
+	cachedSecrets.WithLabelValues(annotated).Add(delta)
+}
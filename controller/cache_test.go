@@ -0,0 +1,82 @@
+package controller
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+)
+
+func TestStripSecret(t *testing.T) {
+	t.Run("the data of the Secrets that aren't annotated is removed", func(t *testing.T) {
+		got, err := StripSecret(&corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Annotations: map[string]string{
+					"meta.helm.sh/release-name":        "foo",
+					corev1.LastAppliedConfigAnnotation: `{"data":{"release":"..."}}`,
+				},
+				ManagedFields: []metav1.ManagedFieldsEntry{{Manager: "helm"}},
+			},
+			Data: map[string][]byte{"release": []byte("...")},
+		})
+		require.NoError(t, err)
+		assert.Equal(t, &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Annotations: map[string]string{"meta.helm.sh/release-name": "foo"},
+			},
+		}, got)
+	})
+
+	t.Run("the data of the annotated Secrets is kept", func(t *testing.T) {
+		got, err := StripSecret(&corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Annotations: map[string]string{
+					"secret-transform/secret-copy-ca.crt": "ca",
+					corev1.LastAppliedConfigAnnotation:    "{}",
+				},
+				ManagedFields: []metav1.ManagedFieldsEntry{{Manager: "cert-manager"}},
+			},
+			Data: map[string][]byte{"ca.crt": []byte("fakeCACrt")},
+		})
+		require.NoError(t, err)
+		assert.Equal(t, &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Annotations: map[string]string{
+					"secret-transform/secret-copy-ca.crt": "ca",
+					corev1.LastAppliedConfigAnnotation:    "{}",
+				},
+			},
+			Data: map[string][]byte{"ca.crt": []byte("fakeCACrt")},
+		}, got)
+	})
+
+	t.Run("other objects are left untouched", func(t *testing.T) {
+		cm := &corev1.ConfigMap{Data: map[string]string{"foo": "bar"}}
+		got, err := StripSecret(cm)
+		require.NoError(t, err)
+		assert.Equal(t, cm, got)
+	})
+}
+
+func TestCountCachedSecrets(t *testing.T) {
+	cachedSecrets.Reset()
+	annotated := secret(map[string]string{"secret-transform/secret-copy-ca.crt": "ca"}, nil)
+	other := secret(nil, nil)
+
+	countCachedSecrets.Create(event.CreateEvent{Object: annotated}, nil)
+	countCachedSecrets.Create(event.CreateEvent{Object: other}, nil)
+	countCachedSecrets.Create(event.CreateEvent{Object: other}, nil)
+	assert.Equal(t, 1.0, testutil.ToFloat64(cachedSecrets.WithLabelValues("true")))
+	assert.Equal(t, 2.0, testutil.ToFloat64(cachedSecrets.WithLabelValues("false")))
+
+	countCachedSecrets.Update(event.UpdateEvent{ObjectOld: other, ObjectNew: annotated}, nil)
+	assert.Equal(t, 2.0, testutil.ToFloat64(cachedSecrets.WithLabelValues("true")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(cachedSecrets.WithLabelValues("false")))
+
+	countCachedSecrets.Delete(event.DeleteEvent{Object: annotated}, nil)
+	assert.Equal(t, 1.0, testutil.ToFloat64(cachedSecrets.WithLabelValues("true")))
+}
@@ -0,0 +1,279 @@
+// Package controller contains the Kubernetes controller that watches Secrets
+// and applies the transforms of the transform package to them.
+package controller
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+
+	"github.com/maelvls/secret-transform/transform"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+)
+
+// Options configures the controller.
+type Options struct {
+	// When true, a Warning event is shown every time one of the legacy
+	// cert-manager.io/* annotations is used to transform a Secret.
+	WarnLegacyAnnotations bool
+
+	// Which events are recorded on the Secrets. Defaults to EventsAll.
+	Events EventVerbosity
+
+	// The maximum number of Secrets reconciled at the same time. Defaults to
+	// 1.
+	MaxConcurrentReconciles int
+
+	// When true, the workloads of the Secrets annotated with RolloutAnnotKey
+	// are rolled out when the Secret's data is updated.
+	RolloutWorkloads bool
+
+	// Notified of each Secret once it is reconciled.
+	Observers []SecretObserver
+
+	// Reads the Secrets referenced by the transformed Secrets, such as the
+	// ones holding a passphrase. Since these Secrets aren't annotated, the
+	// informer cache doesn't hold their data. Defaults to the client.
+	SecretReader client.Reader
+}
+
+// The index of the Secrets by the names of the Secrets they reference.
+const referencesIndex = "secret-transform.references"
+
+// SecretObserver is notified of the Secrets reconciled by the controller, for
+// example to serve their data through another channel than the Secret.
+type SecretObserver interface {
+	// Observe is called with the transformed Secret each time it is
+	// reconciled without error. The Secret must not be mutated.
+	Observe(secret *corev1.Secret)
+
+	// Forget is called when the Secret is deleted.
+	Forget(namespace, name string)
+}
+
+// SDSAnnotKey opts a Secret in for being served by the Envoy SDS server when
+// set to "true". The Secrets that only have this annotation are reconciled
+// too, so that they are served even when they don't need to be transformed.
+const SDSAnnotKey = "secret-transform/sds"
+
+// EventVerbosity tells which events are recorded on the Secrets.
+type EventVerbosity string
+
+const (
+	// Both the Normal and Warning events are recorded.
+	EventsAll EventVerbosity = "all"
+	// Only the Warning events are recorded.
+	EventsWarnings EventVerbosity = "warnings"
+	// No event is recorded.
+	EventsNone EventVerbosity = "none"
+)
+
+// Records the event unless the verbosity filters it out.
+func (v EventVerbosity) record(rec record.EventRecorder, secret *corev1.Secret, eventType, reason, message string) {
+	switch {
+	case v == EventsNone:
+		return
+	case v == EventsWarnings && eventType != corev1.EventTypeWarning:
+		return
+	}
+	rec.Event(secret, eventType, reason, message)
+}
+
+// Reconciler returns the function that applies the registered transformers to
+// the given Secret and updates it when its data changed.
+func Reconciler(client client.Client, rec record.EventRecorder, opts Options) reconcile.Func {
+	log := log.Log.WithName("secret-transform")
+	reader := opts.SecretReader
+	if reader == nil {
+		reader = client
+	}
+	return func(ctx context.Context, req reconcile.Request) (reconcile.Result, error) {
+		log := log.WithValues("secret_name", req.NamespacedName.Name, "namespace", req.NamespacedName.Namespace)
+		secret := corev1.Secret{}
+		err := client.Get(ctx, req.NamespacedName, &secret)
+		switch {
+		case k8serrors.IsNotFound(err):
+			for _, o := range opts.Observers {
+				o.Forget(req.Namespace, req.Name)
+			}
+			return reconcile.Result{}, nil
+		case err != nil:
+			return reconcile.Result{}, err
+		}
+
+		secretBefore := secret.DeepCopy()
+
+		if opts.WarnLegacyAnnotations {
+			// The transformers prefer the replacement over the legacy
+			// annotation, which is then ignored rather than deprecated.
+			for _, annot := range transform.LegacyAnnotations(secret.GetAnnotations()) {
+				replacement, _ := transform.IsLegacyAnnotation(annot)
+				if secret.Annotations[replacement] != "" {
+					opts.Events.record(rec, &secret, corev1.EventTypeWarning, "IgnoredAnnotation", fmt.Sprintf("The annotation '%s' is ignored since '%s' is also set, remove it", annot, replacement))
+					continue
+				}
+				opts.Events.record(rec, &secret, corev1.EventTypeWarning, "DeprecatedAnnotation", fmt.Sprintf("The annotation '%s' is deprecated, use '%s' instead. You can run 'secret-transform migrate' to migrate", annot, replacement))
+			}
+		}
+
+		events, err := transform.ApplyWithSecrets(&secret, func(name string) (map[string][]byte, error) {
+			referenced := corev1.Secret{}
+			if err := reader.Get(ctx, types.NamespacedName{Namespace: req.Namespace, Name: name}, &referenced); err != nil {
+				return nil, err
+			}
+			return referenced.Data, nil
+		})
+
+		// Warning events are shown right away. Normal events are only shown
+		// once the Secret has been updated.
+		var changes []transform.Event
+		for _, e := range events {
+			if e.Type == corev1.EventTypeNormal {
+				changes = append(changes, e)
+				continue
+			}
+			opts.Events.record(rec, &secret, e.Type, e.Reason, e.Message)
+		}
+		if err != nil {
+			log.Error(err, "not updating the Secret")
+			return reconcile.Result{}, nil
+		}
+
+		updated := false
+		// Some transformers record what they did in annotations, e.g., the
+		// version of the system roots.
+		if !reflect.DeepEqual(secret.Data, secretBefore.Data) || !reflect.DeepEqual(secret.Annotations, secretBefore.Annotations) {
+			err = client.Update(ctx, &secret)
+			if err != nil {
+				return reconcile.Result{}, err
+			}
+			updated = true
+
+			for _, e := range changes {
+				opts.Events.record(rec, &secret, e.Type, e.Reason, e.Message)
+			}
+		}
+
+		for _, o := range opts.Observers {
+			o.Observe(&secret)
+		}
+
+		if opts.RolloutWorkloads {
+			events, err := rollout(ctx, client, &secret, updated)
+			for _, e := range events {
+				opts.Events.record(rec, &secret, e.Type, e.Reason, e.Message)
+			}
+			if err != nil {
+				return reconcile.Result{}, err
+			}
+		}
+
+		return reconcile.Result{}, nil
+	}
+}
+
+// ShouldReconcileSecret returns true if the secret has any of the annotations
+// that the registered transformers are interested in, or the annotation
+// SDSAnnotKey.
+func ShouldReconcileSecret(annotations map[string]string) bool {
+	if annotations == nil {
+		return false
+	}
+
+	return transform.Matches(annotations) || annotations[SDSAnnotKey] == "true"
+}
+
+// SetupWithManager sets up the controller with the Manager. Transformers
+// registered with transform.Register must be registered before calling it.
+func SetupWithManager(mgr manager.Manager, opts Options) error {
+	rec := mgr.GetEventRecorderFor("secret-transform")
+
+	cl := mgr.GetClient()
+	if opts.RolloutWorkloads {
+		// The workloads are read from the API server rather than from the
+		// cache, which would otherwise hold every Deployment, StatefulSet and
+		// DaemonSet of the cluster.
+		direct, err := client.New(mgr.GetConfig(), client.Options{Scheme: mgr.GetScheme(), Mapper: mgr.GetRESTMapper()})
+		if err != nil {
+			return fmt.Errorf("unable to create the client for the workloads: %w", err)
+		}
+		cl, err = client.NewDelegatingClient(client.NewDelegatingClientInput{
+			CacheReader:     mgr.GetCache(),
+			Client:          direct,
+			UncachedObjects: []client.Object{&appsv1.Deployment{}, &appsv1.StatefulSet{}, &appsv1.DaemonSet{}},
+		})
+		if err != nil {
+			return fmt.Errorf("unable to create the client for the workloads: %w", err)
+		}
+	}
+	if opts.SecretReader == nil {
+		opts.SecretReader = mgr.GetAPIReader()
+	}
+	reconciler := Reconciler(cl, rec, opts)
+
+	c, err := controller.New("secret-transform", mgr, controller.Options{
+		Reconciler:              reconciler,
+		MaxConcurrentReconciles: opts.MaxConcurrentReconciles,
+	})
+	if err != nil {
+		return fmt.Errorf("unable to set up individual controller: %w", err)
+	}
+
+	if err := c.Watch(&source.Kind{Type: &corev1.Secret{}}, handler.EnqueueRequestsFromMapFunc(func(o client.Object) []reconcile.Request {
+		if !ShouldReconcileSecret(o.GetAnnotations()) {
+			return nil
+		}
+
+		return []reconcile.Request{{NamespacedName: types.NamespacedName{Namespace: o.GetNamespace(), Name: o.GetName()}}}
+	})); err != nil {
+		return fmt.Errorf("unable to watch Secrets: %w", err)
+	}
+
+	// The Secrets are re-transformed when a Secret they reference changes,
+	// e.g., when a passphrase is rotated.
+	err = mgr.GetFieldIndexer().IndexField(context.Background(), &corev1.Secret{}, referencesIndex, func(o client.Object) []string {
+		return transform.References(o.GetAnnotations())
+	})
+	if err != nil {
+		return fmt.Errorf("unable to index the Secrets by reference: %w", err)
+	}
+	if err := c.Watch(&source.Kind{Type: &corev1.Secret{}}, handler.EnqueueRequestsFromMapFunc(referencingSecrets(mgr.GetClient()))); err != nil {
+		return fmt.Errorf("unable to watch Secrets: %w", err)
+	}
+
+	if err := c.Watch(&source.Kind{Type: &corev1.Secret{}}, countCachedSecrets); err != nil {
+		return fmt.Errorf("unable to watch Secrets: %w", err)
+	}
+
+	return nil
+}
+
+// Returns the function that maps a Secret to the Secrets of the same namespace
+// that reference it.
+func referencingSecrets(cl client.Reader) handler.MapFunc {
+	return func(o client.Object) []reconcile.Request {
+		var secrets corev1.SecretList
+		err := cl.List(context.Background(), &secrets, client.InNamespace(o.GetNamespace()), client.MatchingFields{referencesIndex: o.GetName()})
+		if err != nil {
+			log.Log.WithName("secret-transform").Error(err, "unable to list the Secrets referencing the Secret", "secret_name", o.GetName(), "namespace", o.GetNamespace())
+			return nil
+		}
+
+		var reqs []reconcile.Request
+		for _, secret := range secrets.Items {
+			reqs = append(reqs, reconcile.Request{NamespacedName: types.NamespacedName{Namespace: secret.Namespace, Name: secret.Name}})
+		}
+		return reqs
+	}
+}
@@ -0,0 +1,434 @@
+package controller
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"testing"
+
+	"github.com/maelvls/secret-transform/transform"
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+func TestReconciler(t *testing.T) {
+
+	t.Run("the 'secret-transform/secret-transform' annot combines tls.key and tls.crt", run_TestReconciler(case_TestReconciler{
+		given: secret(
+			map[string]string{"secret-transform/secret-transform": "tls.pem"},
+			map[string][]byte{"tls.key": []byte("fakeKey"), "tls.crt": []byte("fakeCrt")},
+		),
+		expectKeys:   []string{"tls.pem"},
+		expectValues: map[string]string{"tls.pem": "fakeKeyfakeCrt"},
+	}))
+	t.Run("the 'cert-manager.io/secret-transform' annot combines tls.key and tls.crt", run_TestReconciler(case_TestReconciler{
+		given: secret(
+			map[string]string{"cert-manager.io/secret-transform": "tls.pem"},
+			map[string][]byte{"tls.key": []byte("fakeKey"), "tls.crt": []byte("fakeCrt")},
+		),
+		expectKeys:   []string{"tls.pem"},
+		expectValues: map[string]string{"tls.pem": "fakeKeyfakeCrt"},
+	}))
+
+	t.Run("the 'secret-transform/secret-copy-ca.crt' annot copies ca.crt", run_TestReconciler(case_TestReconciler{
+		given: secret(
+			map[string]string{"secret-transform/secret-copy-ca.crt": "ca"},
+			map[string][]byte{"ca.crt": []byte("fakeCACrt")},
+		),
+		expectKeys:   []string{"ca"},
+		expectValues: map[string]string{"ca": "fakeCACrt"},
+	}))
+	t.Run("the 'cert-manager.io/secret-copy-ca.crt' annot copies ca.crt", run_TestReconciler(case_TestReconciler{
+		given: secret(
+			map[string]string{"cert-manager.io/secret-copy-ca.crt": "ca"},
+			map[string][]byte{"ca.crt": []byte("fakeCACrt")},
+		),
+		expectKeys:   []string{"ca"},
+		expectValues: map[string]string{"ca": "fakeCACrt"},
+	}))
+
+	t.Run("the 'secret-transform/secret-copy-tls.crt' annot copies tls.crt", run_TestReconciler(case_TestReconciler{
+		given: secret(
+			map[string]string{"secret-transform/secret-copy-tls.crt": "cert"},
+			map[string][]byte{"tls.crt": []byte("fakeTLSCrt")},
+		),
+		expectKeys:   []string{"cert"},
+		expectValues: map[string]string{"cert": "fakeTLSCrt"},
+	}))
+	t.Run("the 'cert-manager.io/secret-copy-tls.crt' annot copies tls.crt", run_TestReconciler(case_TestReconciler{
+		given: secret(
+			map[string]string{"cert-manager.io/secret-copy-tls.crt": "cert"},
+			map[string][]byte{"tls.crt": []byte("fakeTLSCrt")},
+		),
+		expectKeys:   []string{"cert"},
+		expectValues: map[string]string{"cert": "fakeTLSCrt"},
+	}))
+
+	t.Run("the 'secret-transform/secret-copy-keystore.jks' annot copies keystore.jks", run_TestReconciler(case_TestReconciler{
+		given: secret(
+			map[string]string{"secret-transform/secret-copy-keystore.jks": "keystore"},
+			map[string][]byte{"keystore.jks": []byte("fakeKeystoreJKS")},
+		),
+		expectKeys:   []string{"keystore"},
+		expectValues: map[string]string{"keystore": "fakeKeystoreJKS"},
+	}))
+	t.Run("the 'cert-manager.io/secret-copy-keystore.jks' annot copies keystore.jks", run_TestReconciler(case_TestReconciler{
+		given: secret(
+			map[string]string{"cert-manager.io/secret-copy-keystore.jks": "keystore"},
+			map[string][]byte{"keystore.jks": []byte("fakeKeystoreJKS")},
+		),
+		expectKeys:   []string{"keystore"},
+		expectValues: map[string]string{"keystore": "fakeKeystoreJKS"},
+	}))
+
+	t.Run("the 'secret-transform/secret-copy-tls.key' annot copies tls.key", run_TestReconciler(case_TestReconciler{
+		given: secret(
+			map[string]string{"secret-transform/secret-copy-tls.key": "key"},
+			map[string][]byte{"tls.key": []byte("fakeTLSKey")},
+		),
+		expectKeys: []string{"key"},
+		expectValues: map[string]string{
+			"key": "fakeTLSKey",
+		},
+	}))
+	t.Run("the 'cert-manager.io/secret-copy-tls.key' annot copies tls.key", run_TestReconciler(case_TestReconciler{
+		given: secret(
+			map[string]string{"cert-manager.io/secret-copy-tls.key": "key"},
+			map[string][]byte{"tls.key": []byte("fakeTLSKey")},
+		),
+		expectKeys:   []string{"key"},
+		expectValues: map[string]string{"key": "fakeTLSKey"},
+	}))
+
+	t.Run("the 'secret-transform/secret-copy-truststore.jks' annot copies truststore.jks", run_TestReconciler(case_TestReconciler{
+		given: secret(
+			map[string]string{"secret-transform/secret-copy-truststore.jks": "truststore"},
+			map[string][]byte{"truststore.jks": []byte("fakeTruststoreJKS")},
+		),
+		expectKeys:   []string{"truststore"},
+		expectValues: map[string]string{"truststore": "fakeTruststoreJKS"},
+	}))
+	t.Run("the 'cert-manager.io/secret-copy-truststore.jks' annot copies truststore.jks", run_TestReconciler(case_TestReconciler{
+		given: secret(
+			map[string]string{"cert-manager.io/secret-copy-truststore.jks": "truststore"},
+			map[string][]byte{"truststore.jks": []byte("fakeTruststoreJKS")},
+		),
+		expectKeys:   []string{"truststore"},
+		expectValues: map[string]string{"truststore": "fakeTruststoreJKS"},
+	}))
+
+	t.Run("the secret-copy-keystore.p12 annot copies keystore.p12", run_TestReconciler(case_TestReconciler{
+		given: secret(
+			map[string]string{"cert-manager.io/secret-copy-keystore.p12": "keystore"},
+			map[string][]byte{"keystore.p12": []byte("fakeKeystoreP12")},
+		),
+		expectKeys:   []string{"keystore"},
+		expectValues: map[string]string{"keystore": "fakeKeystoreP12"},
+	}))
+
+	t.Run("the 'secret-transform/secret-template-*' annot renders a template", run_TestReconciler(case_TestReconciler{
+		given: secret(
+			map[string]string{"secret-transform/secret-template-app.properties": `key.sha256={{ index .Data "tls.key" | sha256 }}`},
+			map[string][]byte{"tls.key": []byte("fakeTLSKey")},
+		),
+		expectKeys:   []string{"app.properties"},
+		expectValues: map[string]string{"app.properties": "key.sha256=563e9cd9884f2de7f3526b267106625943de3ad6a3dad744e9805e1fc973f893"},
+	}))
+
+	t.Run("the 'secret-transform/condition' annot skips the transforms when false", run_TestReconciler(case_TestReconciler{
+		given: secret(
+			map[string]string{
+				"secret-transform/secret-copy-ca.crt": "ca",
+				"secret-transform/condition":          `secret.type == "kubernetes.io/tls"`,
+			},
+			map[string][]byte{"ca.crt": []byte("fakeCACrt")},
+		),
+		expectMissingKeys: []string{"ca"},
+	}))
+
+	t.Run("legacy annotations show a Warning when WarnLegacyAnnotations is set", run_TestReconciler(case_TestReconciler{
+		given: secret(
+			map[string]string{"cert-manager.io/secret-copy-ca.crt": "ca"},
+			map[string][]byte{"ca.crt": []byte("fakeCACrt")},
+		),
+		opts:         Options{WarnLegacyAnnotations: true},
+		expectKeys:   []string{"ca"},
+		expectValues: map[string]string{"ca": "fakeCACrt"},
+		expectEvents: []string{
+			"Warning DeprecatedAnnotation The annotation 'cert-manager.io/secret-copy-ca.crt' is deprecated, use 'secret-transform/secret-copy-ca.crt' instead. You can run 'secret-transform migrate' to migrate",
+			"Normal CopiedKey Copied the contents of 'ca.crt' into key 'ca'",
+		},
+	}))
+	t.Run("legacy annotations that are overridden by their replacement are reported as ignored", run_TestReconciler(case_TestReconciler{
+		given: secret(
+			map[string]string{
+				"cert-manager.io/secret-copy-ca.crt":  "old-ca",
+				"secret-transform/secret-copy-ca.crt": "ca",
+			},
+			map[string][]byte{"ca.crt": []byte("fakeCACrt")},
+		),
+		opts:              Options{WarnLegacyAnnotations: true},
+		expectKeys:        []string{"ca"},
+		expectMissingKeys: []string{"old-ca"},
+		expectValues:      map[string]string{"ca": "fakeCACrt"},
+		expectEvents: []string{
+			"Warning IgnoredAnnotation The annotation 'cert-manager.io/secret-copy-ca.crt' is ignored since 'secret-transform/secret-copy-ca.crt' is also set, remove it",
+			"Normal CopiedKey Copied the contents of 'ca.crt' into key 'ca'",
+		},
+	}))
+	t.Run("legacy annotations show no Warning by default", run_TestReconciler(case_TestReconciler{
+		given: secret(
+			map[string]string{"cert-manager.io/secret-copy-ca.crt": "ca"},
+			map[string][]byte{"ca.crt": []byte("fakeCACrt")},
+		),
+		expectKeys:   []string{"ca"},
+		expectValues: map[string]string{"ca": "fakeCACrt"},
+		expectEvents: []string{
+			"Normal CopiedKey Copied the contents of 'ca.crt' into key 'ca'",
+		},
+	}))
+
+	t.Run("only the Warning events are recorded with EventsWarnings", run_TestReconciler(case_TestReconciler{
+		given: secret(
+			map[string]string{"cert-manager.io/secret-copy-ca.crt": "ca"},
+			map[string][]byte{"ca.crt": []byte("fakeCACrt")},
+		),
+		opts:         Options{WarnLegacyAnnotations: true, Events: EventsWarnings},
+		expectKeys:   []string{"ca"},
+		expectValues: map[string]string{"ca": "fakeCACrt"},
+		expectEvents: []string{
+			"Warning DeprecatedAnnotation The annotation 'cert-manager.io/secret-copy-ca.crt' is deprecated, use 'secret-transform/secret-copy-ca.crt' instead. You can run 'secret-transform migrate' to migrate",
+		},
+	}))
+	t.Run("no event is recorded with EventsNone", run_TestReconciler(case_TestReconciler{
+		given: secret(
+			map[string]string{"cert-manager.io/secret-copy-ca.crt": "ca"},
+			map[string][]byte{"ca.crt": []byte("fakeCACrt")},
+		),
+		opts:         Options{WarnLegacyAnnotations: true, Events: EventsNone},
+		expectKeys:   []string{"ca"},
+		expectValues: map[string]string{"ca": "fakeCACrt"},
+		expectEvents: []string{},
+	}))
+}
+
+func TestShouldReconcileSecret(t *testing.T) {
+	t.Run("should not reconcile when no annotations are present", run(false))
+	t.Run("empty annotations should not reconcile", run(false))
+	t.Run("unrelated annotations should not reconcile", run(false, "foo", "bar"))
+
+	t.Run("secret-transform/secret-transform", run(true, "secret-transform/secret-transform", "tls.pem"))
+	t.Run("secret-transform/secret-copy-ca.crt", run(true, "secret-transform/secret-copy-ca.crt", "ca"))
+	t.Run("secret-transform/secret-copy-tls.crt", run(true, "secret-transform/secret-copy-tls.crt", "cert"))
+	t.Run("secret-transform/secret-copy-tls.key", run(true, "secret-transform/secret-copy-tls.key", "key"))
+	t.Run("secret-transform/secret-copy-keystore.jks", run(true, "secret-transform/secret-copy-keystore.jks", "keystore"))
+	t.Run("secret-transform/secret-copy-truststore.jks", run(true, "secret-transform/secret-copy-truststore.jks", "truststore"))
+	t.Run("secret-transform/secret-copy-keystore.p12", run(true, "secret-transform/secret-copy-keystore.p12", "keystore"))
+	t.Run("secret-transform/secret-copy-truststore.p12", run(true, "secret-transform/secret-copy-truststore.p12", "truststore"))
+	t.Run("secret-transform/secret-template-*", run(true, "secret-transform/secret-template-out.txt", "{{ .Name }}"))
+	t.Run("secret-transform/secret-template- without a data key", run(false, "secret-transform/secret-template-", "{{ .Name }}"))
+	t.Run("secret-transform/kubeconfig", run(true, "secret-transform/kubeconfig", "kubeconfig"))
+	t.Run("secret-transform/ssh-private-key", run(true, "secret-transform/ssh-private-key", "id_ecdsa"))
+	t.Run("secret-transform/jwks", run(true, "secret-transform/jwks", "jwks.json"))
+	t.Run("secret-transform/encrypted-key", run(true, "secret-transform/encrypted-key", "tls-encrypted.key"))
+
+	t.Run("cert-manager.io/secret-transform", run(true, "cert-manager.io/secret-transform", "tls.pem"))
+	t.Run("cert-manager.io/secret-copy-ca.crt", run(true, "cert-manager.io/secret-copy-ca.crt", "ca"))
+	t.Run("cert-manager.io/secret-copy-tls.crt", run(true, "cert-manager.io/secret-copy-tls.crt", "cert"))
+	t.Run("cert-manager.io/secret-copy-tls.key", run(true, "cert-manager.io/secret-copy-tls.key", "key"))
+	t.Run("cert-manager.io/secret-copy-keystore.jks", run(true, "cert-manager.io/secret-copy-keystore.jks", "keystore"))
+	t.Run("cert-manager.io/secret-copy-truststore.jks", run(true, "cert-manager.io/secret-copy-truststore.jks", "truststore"))
+	t.Run("cert-manager.io/secret-copy-keystore.p12", run(true, "cert-manager.io/secret-copy-keystore.p12", "keystore"))
+	t.Run("cert-manager.io/secret-copy-truststore.p12", run(true, "cert-manager.io/secret-copy-truststore.p12", "truststore"))
+
+	t.Run("secret-transform/sds", run(true, "secret-transform/sds", "true"))
+	t.Run("secret-transform/sds set to false", run(false, "secret-transform/sds", "false"))
+}
+
+type recordingObserver struct {
+	observed  []string
+	forgotten []string
+}
+
+func (o *recordingObserver) Observe(secret *corev1.Secret) {
+	o.observed = append(o.observed, secret.Namespace+"/"+secret.Name+": "+string(secret.Data["tls.pem"]))
+}
+
+func (o *recordingObserver) Forget(namespace, name string) {
+	o.forgotten = append(o.forgotten, namespace+"/"+name)
+}
+
+func TestReconciler_observers(t *testing.T) {
+	scheme := runtime.NewScheme()
+	_ = corev1.AddToScheme(scheme)
+	client := fake.NewClientBuilder().WithScheme(scheme).WithRuntimeObjects(secret(
+		map[string]string{"secret-transform/secret-transform": "tls.pem"},
+		map[string][]byte{"tls.key": []byte("fakeKey"), "tls.crt": []byte("fakeCrt")},
+	)).Build()
+
+	observer := &recordingObserver{}
+	reconciler := Reconciler(client, record.NewFakeRecorder(10), Options{Observers: []SecretObserver{observer}})
+
+	_, err := reconciler.Reconcile(t.Context(), reconcile.Request{NamespacedName: types.NamespacedName{Namespace: "default", Name: "test-secret"}})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"default/test-secret: fakeKeyfakeCrt"}, observer.observed, "the observers see the transformed Secret")
+
+	_, err = reconciler.Reconcile(t.Context(), reconcile.Request{NamespacedName: types.NamespacedName{Namespace: "default", Name: "deleted"}})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"default/deleted"}, observer.forgotten)
+}
+
+func TestReconciler_referencedSecrets(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	der, err := x509.MarshalECPrivateKey(key)
+	assert.NoError(t, err)
+
+	given := secret(map[string]string{
+		"secret-transform/encrypted-key":                   "tls-encrypted.key",
+		"secret-transform/encrypted-key-passphrase-secret": "passphrase",
+	}, map[string][]byte{"tls.key": pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})})
+	passphrase := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "passphrase"},
+		Data:       map[string][]byte{"passphrase": []byte("s3cr3t")},
+	}
+	other := given.DeepCopy()
+	other.Name = "other"
+	other.Annotations["secret-transform/encrypted-key-passphrase-secret"] = "other-passphrase"
+
+	scheme := runtime.NewScheme()
+	_ = corev1.AddToScheme(scheme)
+	cl := fake.NewClientBuilder().WithScheme(scheme).WithRuntimeObjects(given, passphrase, other).
+		WithIndex(&corev1.Secret{}, referencesIndex, func(o client.Object) []string { return transform.References(o.GetAnnotations()) }).
+		Build()
+
+	t.Run("the referenced Secrets are read with the SecretReader", func(t *testing.T) {
+		reconciler := Reconciler(cl, record.NewFakeRecorder(10), Options{})
+		_, err := reconciler.Reconcile(t.Context(), reconcile.Request{NamespacedName: types.NamespacedName{Namespace: "default", Name: "test-secret"}})
+		assert.NoError(t, err)
+
+		updated := &corev1.Secret{}
+		assert.NoError(t, cl.Get(t.Context(), types.NamespacedName{Namespace: "default", Name: "test-secret"}, updated))
+		block, _ := pem.Decode(updated.Data["tls-encrypted.key"])
+		if assert.NotNil(t, block) {
+			assert.Equal(t, "ENCRYPTED PRIVATE KEY", block.Type)
+		}
+	})
+
+	t.Run("a change of the referenced Secret enqueues the Secrets referencing it", func(t *testing.T) {
+		reqs := referencingSecrets(cl)(passphrase)
+		assert.Equal(t, []reconcile.Request{{NamespacedName: types.NamespacedName{Namespace: "default", Name: "test-secret"}}}, reqs)
+	})
+}
+
+type upperTransformer struct{}
+
+func (upperTransformer) Name() string          { return "upper" }
+func (upperTransformer) Annotations() []string { return []string{"example.com/upper"} }
+func (upperTransformer) Apply(secret *corev1.Secret) ([]transform.Event, error) {
+	secret.Data["upper"] = []byte("UPPER")
+	return []transform.Event{{Type: corev1.EventTypeNormal, Reason: "Upper", Message: "Added key upper"}}, nil
+}
+
+func TestReconciler_registeredTransformer(t *testing.T) {
+	t.Cleanup(transform.Register(upperTransformer{}))
+
+	t.Run("the watch predicate knows about the new transformer", run(true, "example.com/upper", "true"))
+	t.Run("the reconciler runs the new transformer", run_TestReconciler(case_TestReconciler{
+		given:        secret(map[string]string{"example.com/upper": "true"}, map[string][]byte{"foo": []byte("bar")}),
+		expectKeys:   []string{"upper"},
+		expectValues: map[string]string{"upper": "UPPER"},
+	}))
+}
+
+func run(shouldReconcile bool, annotsKeyAndValues ...string) func(*testing.T) {
+	return func(t *testing.T) {
+		t.Helper()
+		annotations := make(map[string]string)
+		for i := 0; i < len(annotsKeyAndValues); i += 2 {
+			annotations[annotsKeyAndValues[i]] = annotsKeyAndValues[i+1]
+		}
+
+		assert.Equal(t, shouldReconcile, ShouldReconcileSecret(annotations))
+	}
+}
+
+type case_TestReconciler struct {
+	given             *corev1.Secret
+	expectKeys        []string
+	expectValues      map[string]string
+	expectMissingKeys []string
+	opts              Options
+	expectEvents      []string
+}
+
+func run_TestReconciler(test case_TestReconciler) func(*testing.T) {
+	return func(t *testing.T) {
+		t.Helper()
+		scheme := runtime.NewScheme()
+		_ = corev1.AddToScheme(scheme)
+
+		client := fake.NewClientBuilder().
+			WithRuntimeObjects([]runtime.Object{test.given}...).
+			WithScheme(scheme).
+			Build()
+
+		recorder := record.NewFakeRecorder(10)
+		reconciler := Reconciler(client, recorder, test.opts)
+
+		req := reconcile.Request{NamespacedName: types.NamespacedName{
+			Name:      "test-secret",
+			Namespace: "default",
+		}}
+		result, err := reconciler.Reconcile(t.Context(), req)
+		assert.NoError(t, err)
+		assert.Equal(t, reconcile.Result{}, result)
+
+		updatedSecret := &corev1.Secret{}
+		err = client.Get(t.Context(), req.NamespacedName, updatedSecret)
+		assert.NoError(t, err)
+
+		for _, key := range test.expectKeys {
+			value, exists := updatedSecret.Data[key]
+			assert.True(t, exists, "expected key %s to exist in secret data", key)
+			expectedValue := test.expectValues[key]
+			assert.Equal(t, expectedValue, string(value), "expected value for key %s", key)
+		}
+		for _, key := range test.expectMissingKeys {
+			assert.NotContains(t, updatedSecret.Data, key, "expected key %s to not exist in secret data", key)
+		}
+
+		if test.expectEvents != nil {
+			close(recorder.Events)
+			var events []string
+			for e := range recorder.Events {
+				events = append(events, e)
+			}
+			if len(test.expectEvents) == 0 {
+				assert.Empty(t, events)
+			} else {
+				assert.Equal(t, test.expectEvents, events)
+			}
+		}
+	}
+}
+
+func secret(annotations map[string]string, data map[string][]byte) *corev1.Secret {
+	return &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "test-secret",
+			Namespace:   "default",
+			Annotations: annotations,
+		},
+		Data: data,
+	}
+}
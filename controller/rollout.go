@@ -0,0 +1,210 @@
+package controller
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/maelvls/secret-transform/transform"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// RolloutAnnotKey opts a Secret in for rolling out the workloads that use it
+// once the controller has updated its data. The value is either "auto", to
+// roll out the Deployments, StatefulSets and DaemonSets of the namespace that
+// reference the Secret in a volume or an environment variable, or a
+// comma-separated list of workloads such as "deployment/haproxy,statefulset/mongodb".
+const RolloutAnnotKey = "secret-transform/rollout"
+
+// ChecksumAnnotPrefix is the prefix of the annotation set on the pod template
+// of the workloads to roll them out. It is followed by the name of the Secret.
+const ChecksumAnnotPrefix = "checksum.secret-transform/"
+
+type workload struct {
+	kind     string
+	obj      client.Object
+	template *corev1.PodTemplateSpec
+}
+
+// Sets the checksum of the Secret's data on the pod template of the workloads
+// that use the Secret. When the data wasn't updated, only the workloads that
+// already have a stale checksum are rolled out, which happens when a previous
+// rollout failed half-way.
+func rollout(ctx context.Context, cl client.Client, secret *corev1.Secret, updated bool) ([]transform.Event, error) {
+	value := secret.Annotations[RolloutAnnotKey]
+	if value == "" {
+		return nil, nil
+	}
+
+	workloads, err := findWorkloads(ctx, cl, secret.Namespace, secret.Name, value)
+	if err != nil {
+		return []transform.Event{{Type: corev1.EventTypeWarning, Reason: "FailedRollout", Message: fmt.Sprintf("annot '%s': %v", RolloutAnnotKey, err)}}, err
+	}
+
+	key := checksumAnnotKey(secret.Name)
+	sum := dataChecksum(secret.Data)
+
+	var events []transform.Event
+	var errs []error
+	for _, w := range workloads {
+		current := w.template.Annotations[key]
+		if current == sum || (!updated && current == "") {
+			continue
+		}
+
+		patch := client.MergeFrom(w.obj.DeepCopyObject().(client.Object))
+		if w.template.Annotations == nil {
+			w.template.Annotations = make(map[string]string)
+		}
+		w.template.Annotations[key] = sum
+		if err := cl.Patch(ctx, w.obj, patch); err != nil {
+			events = append(events, transform.Event{Type: corev1.EventTypeWarning, Reason: "FailedRollout", Message: fmt.Sprintf("%s '%s': %v", w.kind, w.obj.GetName(), err)})
+			errs = append(errs, err)
+			continue
+		}
+		events = append(events, transform.Event{Type: corev1.EventTypeNormal, Reason: "RolloutTriggered", Message: fmt.Sprintf("Triggered a rollout of %s '%s'", w.kind, w.obj.GetName())})
+	}
+	if len(errs) > 0 {
+		return events, fmt.Errorf("while rolling out the workloads: %v", errs)
+	}
+	return events, nil
+}
+
+// Returns the workloads given in the rollout annotation, or, when the
+// annotation is "auto", the workloads of the namespace that use the Secret.
+func findWorkloads(ctx context.Context, cl client.Client, namespace, secretName, value string) ([]workload, error) {
+	if value == "auto" {
+		return referencingWorkloads(ctx, cl, namespace, secretName)
+	}
+
+	var workloads []workload
+	for _, item := range strings.Split(value, ",") {
+		kind, name, found := strings.Cut(strings.TrimSpace(item), "/")
+		if !found || name == "" {
+			return nil, fmt.Errorf("'%s' isn't of the form 'kind/name'", item)
+		}
+
+		var w workload
+		switch strings.ToLower(kind) {
+		case "deployment":
+			obj := &appsv1.Deployment{}
+			w = workload{kind: "Deployment", obj: obj, template: &obj.Spec.Template}
+		case "statefulset":
+			obj := &appsv1.StatefulSet{}
+			w = workload{kind: "StatefulSet", obj: obj, template: &obj.Spec.Template}
+		case "daemonset":
+			obj := &appsv1.DaemonSet{}
+			w = workload{kind: "DaemonSet", obj: obj, template: &obj.Spec.Template}
+		default:
+			return nil, fmt.Errorf("'%s': the kind must be one of deployment, statefulset or daemonset", item)
+		}
+		if err := cl.Get(ctx, types.NamespacedName{Namespace: namespace, Name: name}, w.obj); err != nil {
+			return nil, fmt.Errorf("'%s': %w", item, err)
+		}
+		workloads = append(workloads, w)
+	}
+	return workloads, nil
+}
+
+func referencingWorkloads(ctx context.Context, cl client.Client, namespace, secretName string) ([]workload, error) {
+	var workloads []workload
+
+	deployments := &appsv1.DeploymentList{}
+	if err := cl.List(ctx, deployments, client.InNamespace(namespace)); err != nil {
+		return nil, fmt.Errorf("while listing Deployments: %w", err)
+	}
+	for i := range deployments.Items {
+		obj := &deployments.Items[i]
+		if usesSecret(&obj.Spec.Template.Spec, secretName) {
+			workloads = append(workloads, workload{kind: "Deployment", obj: obj, template: &obj.Spec.Template})
+		}
+	}
+
+	statefulSets := &appsv1.StatefulSetList{}
+	if err := cl.List(ctx, statefulSets, client.InNamespace(namespace)); err != nil {
+		return nil, fmt.Errorf("while listing StatefulSets: %w", err)
+	}
+	for i := range statefulSets.Items {
+		obj := &statefulSets.Items[i]
+		if usesSecret(&obj.Spec.Template.Spec, secretName) {
+			workloads = append(workloads, workload{kind: "StatefulSet", obj: obj, template: &obj.Spec.Template})
+		}
+	}
+
+	daemonSets := &appsv1.DaemonSetList{}
+	if err := cl.List(ctx, daemonSets, client.InNamespace(namespace)); err != nil {
+		return nil, fmt.Errorf("while listing DaemonSets: %w", err)
+	}
+	for i := range daemonSets.Items {
+		obj := &daemonSets.Items[i]
+		if usesSecret(&obj.Spec.Template.Spec, secretName) {
+			workloads = append(workloads, workload{kind: "DaemonSet", obj: obj, template: &obj.Spec.Template})
+		}
+	}
+
+	return workloads, nil
+}
+
+// Returns true if the Secret is mounted as a volume, possibly projected, or
+// used in the environment of one of the containers.
+func usesSecret(spec *corev1.PodSpec, secretName string) bool {
+	for _, v := range spec.Volumes {
+		if v.Secret != nil && v.Secret.SecretName == secretName {
+			return true
+		}
+		if v.Projected == nil {
+			continue
+		}
+		for _, source := range v.Projected.Sources {
+			if source.Secret != nil && source.Secret.Name == secretName {
+				return true
+			}
+		}
+	}
+
+	containers := append(append([]corev1.Container{}, spec.InitContainers...), spec.Containers...)
+	for _, c := range containers {
+		for _, env := range c.Env {
+			if env.ValueFrom != nil && env.ValueFrom.SecretKeyRef != nil && env.ValueFrom.SecretKeyRef.Name == secretName {
+				return true
+			}
+		}
+		for _, envFrom := range c.EnvFrom {
+			if envFrom.SecretRef != nil && envFrom.SecretRef.Name == secretName {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// The name part of an annotation key can't be longer than 63 characters, in
+// which case the Secret name is replaced with its hash.
+func checksumAnnotKey(secretName string) string {
+	if len(secretName) > 63 {
+		sum := sha256.Sum256([]byte(secretName))
+		return ChecksumAnnotPrefix + hex.EncodeToString(sum[:16])
+	}
+	return ChecksumAnnotPrefix + secretName
+}
+
+func dataChecksum(data map[string][]byte) string {
+	keys := make([]string, 0, len(data))
+	for k := range data {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	h := sha256.New()
+	for _, k := range keys {
+		fmt.Fprintf(h, "%s=%d:", k, len(data[k]))
+		h.Write(data[k])
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
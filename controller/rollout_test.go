@@ -0,0 +1,159 @@
+package controller
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+func TestReconciler_rollout(t *testing.T) {
+	mounting := func(name string) *appsv1.Deployment {
+		return &appsv1.Deployment{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+			Spec: appsv1.DeploymentSpec{Template: corev1.PodTemplateSpec{Spec: corev1.PodSpec{
+				Volumes: []corev1.Volume{{Name: "tls", VolumeSource: corev1.VolumeSource{
+					Secret: &corev1.SecretVolumeSource{SecretName: "test-secret"},
+				}}},
+			}}},
+		}
+	}
+	unrelated := &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "unrelated", Namespace: "default"}}
+	statefulSet := &appsv1.StatefulSet{ObjectMeta: metav1.ObjectMeta{Name: "mongodb", Namespace: "default"}}
+
+	reconcileWith := func(t *testing.T, opts Options, given ...client.Object) (client.Client, []string) {
+		t.Helper()
+		cl := fake.NewClientBuilder().WithObjects(given...).Build()
+		recorder := record.NewFakeRecorder(10)
+		_, err := Reconciler(cl, recorder, opts).Reconcile(t.Context(), reconcile.Request{NamespacedName: types.NamespacedName{Namespace: "default", Name: "test-secret"}})
+		require.NoError(t, err)
+
+		close(recorder.Events)
+		var events []string
+		for e := range recorder.Events {
+			events = append(events, e)
+		}
+		return cl, events
+	}
+	checksum := func(t *testing.T, cl client.Client, obj client.Object) string {
+		t.Helper()
+		require.NoError(t, cl.Get(t.Context(), client.ObjectKeyFromObject(obj), obj))
+		switch obj := obj.(type) {
+		case *appsv1.Deployment:
+			return obj.Spec.Template.Annotations["checksum.secret-transform/test-secret"]
+		case *appsv1.StatefulSet:
+			return obj.Spec.Template.Annotations["checksum.secret-transform/test-secret"]
+		}
+		return ""
+	}
+	data := map[string][]byte{"tls.key": []byte("fakeKey"), "tls.crt": []byte("fakeCrt")}
+	expectedSum := dataChecksum(map[string][]byte{"tls.key": []byte("fakeKey"), "tls.crt": []byte("fakeCrt"), "tls.pem": []byte("fakeKeyfakeCrt")})
+
+	t.Run("the workloads mounting the Secret are rolled out after an update", func(t *testing.T) {
+		cl, events := reconcileWith(t, Options{RolloutWorkloads: true},
+			secret(map[string]string{"secret-transform/secret-transform": "tls.pem", "secret-transform/rollout": "auto"}, data),
+			mounting("haproxy"), unrelated.DeepCopy(),
+		)
+		assert.Equal(t, expectedSum, checksum(t, cl, &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "haproxy", Namespace: "default"}}))
+		assert.Equal(t, "", checksum(t, cl, unrelated.DeepCopy()))
+		assert.Equal(t, []string{
+			"Normal Transformed Added key tls.pem",
+			"Normal RolloutTriggered Triggered a rollout of Deployment 'haproxy'",
+		}, events)
+	})
+
+	t.Run("the workloads can be listed explicitly", func(t *testing.T) {
+		cl, events := reconcileWith(t, Options{RolloutWorkloads: true},
+			secret(map[string]string{"secret-transform/secret-transform": "tls.pem", "secret-transform/rollout": "statefulset/mongodb"}, data),
+			mounting("haproxy"), statefulSet.DeepCopy(),
+		)
+		assert.Equal(t, expectedSum, checksum(t, cl, statefulSet.DeepCopy()))
+		assert.Equal(t, "", checksum(t, cl, &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "haproxy", Namespace: "default"}}))
+		assert.Equal(t, []string{
+			"Normal Transformed Added key tls.pem",
+			"Normal RolloutTriggered Triggered a rollout of StatefulSet 'mongodb'",
+		}, events)
+	})
+
+	t.Run("nothing is rolled out when the feature is disabled", func(t *testing.T) {
+		cl, _ := reconcileWith(t, Options{},
+			secret(map[string]string{"secret-transform/secret-transform": "tls.pem", "secret-transform/rollout": "auto"}, data),
+			mounting("haproxy"),
+		)
+		assert.Equal(t, "", checksum(t, cl, &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "haproxy", Namespace: "default"}}))
+	})
+
+	t.Run("nothing is rolled out when the Secret is up to date", func(t *testing.T) {
+		upToDate := map[string][]byte{"tls.key": []byte("fakeKey"), "tls.crt": []byte("fakeCrt"), "tls.pem": []byte("fakeKeyfakeCrt")}
+		cl, events := reconcileWith(t, Options{RolloutWorkloads: true},
+			secret(map[string]string{"secret-transform/secret-transform": "tls.pem", "secret-transform/rollout": "auto"}, upToDate),
+			mounting("haproxy"),
+		)
+		assert.Equal(t, "", checksum(t, cl, &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "haproxy", Namespace: "default"}}))
+		assert.Empty(t, events)
+	})
+
+	t.Run("a stale checksum is fixed even when the Secret is up to date", func(t *testing.T) {
+		upToDate := map[string][]byte{"tls.key": []byte("fakeKey"), "tls.crt": []byte("fakeCrt"), "tls.pem": []byte("fakeKeyfakeCrt")}
+		stale := mounting("haproxy")
+		stale.Spec.Template.Annotations = map[string]string{"checksum.secret-transform/test-secret": "old"}
+		cl, events := reconcileWith(t, Options{RolloutWorkloads: true},
+			secret(map[string]string{"secret-transform/secret-transform": "tls.pem", "secret-transform/rollout": "auto"}, upToDate),
+			stale,
+		)
+		assert.Equal(t, expectedSum, checksum(t, cl, &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "haproxy", Namespace: "default"}}))
+		assert.Equal(t, []string{"Normal RolloutTriggered Triggered a rollout of Deployment 'haproxy'"}, events)
+	})
+
+	t.Run("an invalid list shows a Warning", func(t *testing.T) {
+		cl := fake.NewClientBuilder().WithObjects(
+			secret(map[string]string{"secret-transform/secret-transform": "tls.pem", "secret-transform/rollout": "pod/foo"}, data),
+		).Build()
+		recorder := record.NewFakeRecorder(10)
+		_, err := Reconciler(cl, recorder, Options{RolloutWorkloads: true}).Reconcile(t.Context(), reconcile.Request{NamespacedName: types.NamespacedName{Namespace: "default", Name: "test-secret"}})
+		assert.EqualError(t, err, "'pod/foo': the kind must be one of deployment, statefulset or daemonset")
+		assert.Equal(t, "Normal Transformed Added key tls.pem", <-recorder.Events)
+		assert.Equal(t, "Warning FailedRollout annot 'secret-transform/rollout': 'pod/foo': the kind must be one of deployment, statefulset or daemonset", <-recorder.Events)
+	})
+}
+
+func TestUsesSecret(t *testing.T) {
+	tests := map[string]corev1.PodSpec{
+		"volume": {Volumes: []corev1.Volume{{VolumeSource: corev1.VolumeSource{
+			Secret: &corev1.SecretVolumeSource{SecretName: "cert-1"},
+		}}}},
+		"projected volume": {Volumes: []corev1.Volume{{VolumeSource: corev1.VolumeSource{
+			Projected: &corev1.ProjectedVolumeSource{Sources: []corev1.VolumeProjection{{
+				Secret: &corev1.SecretProjection{LocalObjectReference: corev1.LocalObjectReference{Name: "cert-1"}},
+			}}},
+		}}}},
+		"env": {Containers: []corev1.Container{{Env: []corev1.EnvVar{{ValueFrom: &corev1.EnvVarSource{
+			SecretKeyRef: &corev1.SecretKeySelector{LocalObjectReference: corev1.LocalObjectReference{Name: "cert-1"}},
+		}}}}}},
+		"envFrom in an init container": {InitContainers: []corev1.Container{{EnvFrom: []corev1.EnvFromSource{{
+			SecretRef: &corev1.SecretEnvSource{LocalObjectReference: corev1.LocalObjectReference{Name: "cert-1"}},
+		}}}}},
+	}
+	for name, spec := range tests {
+		t.Run(name, func(t *testing.T) {
+			assert.True(t, usesSecret(&spec, "cert-1"))
+			assert.False(t, usesSecret(&spec, "cert-2"))
+		})
+	}
+}
+
+func TestChecksumAnnotKey(t *testing.T) {
+	assert.Equal(t, "checksum.secret-transform/cert-1", checksumAnnotKey("cert-1"))
+
+	long := "a-very-long-secret-name-that-is-longer-than-the-63-characters-allowed"
+	assert.Equal(t, "checksum.secret-transform/", checksumAnnotKey(long)[:26])
+	assert.Len(t, checksumAnnotKey(long), 26+32)
+}
@@ -0,0 +1,444 @@
+package controller
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/maelvls/secret-transform/api/v1alpha1"
+	"github.com/maelvls/secret-transform/transform"
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+)
+
+// TrustBundleAnnotKey is set on the Secrets and ConfigMaps written by a
+// TrustBundle. Its value is the name of the TrustBundle.
+const TrustBundleAnnotKey = "secret-transform.io/trust-bundle"
+
+// TrustBundleRetainedAnnotKey is set on the targets of the TrustBundles that
+// have a rotation grace period while previous CA certificates are kept in the
+// bundle. Its value is a JSON object mapping the SHA-256 fingerprint of each
+// previous CA certificate to the time it was last seen in the sources.
+const TrustBundleRetainedAnnotKey = "secret-transform.io/trust-bundle-retained"
+
+// The clock of the TrustBundle controller, replaced in tests.
+var now = time.Now
+
+const (
+	defaultTrustBundleSourceKey = "ca.crt"
+	defaultTrustBundleTargetKey = "ca-bundle.pem"
+	defaultTrustStorePassword   = "changeit"
+)
+
+// TrustBundleReconciler returns the function that collects the CA
+// certificates of the sources of a TrustBundle and writes the bundle into its
+// target. The sources and the target are read with reader, which must not be
+// the cache since the cache doesn't hold the data of the Secrets that aren't
+// annotated.
+func TrustBundleReconciler(cl client.Client, reader client.Reader, rec record.EventRecorder) reconcile.Func {
+	log := log.Log.WithName("trust-bundle")
+	return func(ctx context.Context, req reconcile.Request) (reconcile.Result, error) {
+		log := log.WithValues("trust_bundle", req.Name)
+		bundle := &v1alpha1.TrustBundle{}
+		err := cl.Get(ctx, req.NamespacedName, bundle)
+		switch {
+		case k8serrors.IsNotFound(err):
+			return reconcile.Result{}, nil
+		case err != nil:
+			return reconcile.Result{}, err
+		}
+
+		certs, err := collectCertificates(ctx, reader, rec, bundle)
+		if err != nil {
+			rec.Event(bundle, corev1.EventTypeWarning, "InvalidSources", err.Error())
+			return reconcile.Result{}, setTrustBundleStatus(ctx, cl, bundle, 0, metav1.ConditionFalse, "InvalidSources", err.Error())
+		}
+		if len(certs) == 0 {
+			msg := "No CA certificate found in the source Secrets, the target is left untouched"
+			return reconcile.Result{}, setTrustBundleStatus(ctx, cl, bundle, 0, metav1.ConditionFalse, "NoCertificates", msg)
+		}
+
+		written, err := writeTrustBundle(ctx, cl, reader, bundle, certs)
+		if err != nil {
+			log.Error(err, "while writing the bundle")
+			rec.Event(bundle, corev1.EventTypeWarning, "FailedWriting", err.Error())
+			_ = setTrustBundleStatus(ctx, cl, bundle, len(certs), metav1.ConditionFalse, "FailedWriting", err.Error())
+			return reconcile.Result{}, err
+		}
+
+		target := bundle.Spec.Target
+		msg := fmt.Sprintf("Wrote %d CA certificates into %s %s/%s", written.certs, targetKind(target), target.Namespace, target.Name)
+		if written.retained > 0 {
+			msg += fmt.Sprintf(", including %d previous CA certificates kept until the end of the rotation grace period", written.retained)
+		}
+		if written.changed {
+			rec.Event(bundle, corev1.EventTypeNormal, "Updated", msg)
+		}
+
+		// Reconcile again when the next previous CA certificate is due to be
+		// dropped, even if nothing else changes in the meantime.
+		result := reconcile.Result{}
+		if !written.nextDrop.IsZero() {
+			result.RequeueAfter = written.nextDrop.Sub(now())
+		}
+		return result, setTrustBundleStatus(ctx, cl, bundle, written.certs, metav1.ConditionTrue, "Written", msg)
+	}
+}
+
+// Returns the deduplicated and sorted certificates found in the sources of the
+// TrustBundle. A Warning event is shown for each source that can't be parsed,
+// and the source is skipped.
+func collectCertificates(ctx context.Context, reader client.Reader, rec record.EventRecorder, bundle *v1alpha1.TrustBundle) ([]*x509.Certificate, error) {
+	sources := bundle.Spec.Sources
+	selector, err := metav1.LabelSelectorAsSelector(&sources.Selector)
+	if err != nil {
+		return nil, fmt.Errorf("spec.sources.selector: %w", err)
+	}
+	key := sources.Key
+	if key == "" {
+		key = defaultTrustBundleSourceKey
+	}
+
+	namespaces := sources.Namespaces
+	if len(namespaces) == 0 {
+		namespaces = []string{""}
+	}
+
+	var certs []*x509.Certificate
+	for _, ns := range namespaces {
+		secrets := &corev1.SecretList{}
+		err := reader.List(ctx, secrets, client.InNamespace(ns), client.MatchingLabelsSelector{Selector: selector})
+		if err != nil {
+			return nil, fmt.Errorf("while listing the source Secrets: %w", err)
+		}
+		for _, secret := range secrets.Items {
+			data, found := secret.Data[key]
+			if !found || len(data) == 0 {
+				continue
+			}
+			parsed, err := transform.ParseCertificates(data)
+			if err != nil {
+				rec.Eventf(bundle, corev1.EventTypeWarning, "InvalidSource", "Secret %s/%s: key '%s': %v", secret.Namespace, secret.Name, key, err)
+				continue
+			}
+			certs = append(certs, parsed...)
+		}
+	}
+	return transform.Bundle(certs), nil
+}
+
+type trustBundleWrite struct {
+	changed bool
+
+	// The number of CA certificates written, including the retained ones.
+	certs int
+
+	// The number of previous CA certificates kept because of the rotation
+	// grace period, and when the first of them is due to be dropped.
+	retained int
+	nextDrop time.Time
+}
+
+// Writes the bundle into the target, creating the target if needed. The other
+// keys of the target are kept.
+func writeTrustBundle(ctx context.Context, cl client.Client, reader client.Reader, bundle *v1alpha1.TrustBundle, certs []*x509.Certificate) (trustBundleWrite, error) {
+	target := bundle.Spec.Target
+	key := target.Key
+	if key == "" {
+		key = defaultTrustBundleTargetKey
+	}
+
+	var obj client.Object
+	switch targetKind(target) {
+	case "Secret":
+		obj = &corev1.Secret{}
+	case "ConfigMap":
+		obj = &corev1.ConfigMap{}
+	default:
+		return trustBundleWrite{}, fmt.Errorf("spec.target.kind: must be Secret or ConfigMap, got '%s'", target.Kind)
+	}
+
+	err := reader.Get(ctx, types.NamespacedName{Namespace: target.Namespace, Name: target.Name}, obj)
+	notFound := k8serrors.IsNotFound(err)
+	if err != nil && !notFound {
+		return trustBundleWrite{}, err
+	}
+	if !notFound && obj.GetAnnotations()[TrustBundleAnnotKey] != bundle.Name {
+		return trustBundleWrite{}, fmt.Errorf("%s %s/%s already exists and isn't managed by this TrustBundle; add the annotation %s=%s to it to let the TrustBundle manage it", targetKind(target), target.Namespace, target.Name, TrustBundleAnnotKey, bundle.Name)
+	}
+
+	existing := targetData(obj)
+	var grace time.Duration
+	if bundle.Spec.RotationGracePeriod != nil {
+		grace = bundle.Spec.RotationGracePeriod.Duration
+	}
+	retained, lastSeen, nextDrop := retainPreviousCAs(existing[key], obj.GetAnnotations()[TrustBundleRetainedAnnotKey], certs, grace, now())
+	certs = transform.Bundle(append(append([]*x509.Certificate{}, certs...), retained...))
+	written := trustBundleWrite{certs: len(certs), retained: len(retained), nextDrop: nextDrop}
+
+	pemBundle := transform.EncodePEMBundle(certs)
+	outputs := map[string][]byte{key: pemBundle}
+	// The truststores are only re-encoded when the PEM bundle changes, since
+	// the PKCS#12 encoding changes every time.
+	upToDate := bytes.Equal(existing[key], pemBundle)
+	for _, store := range []struct {
+		spec   *v1alpha1.TrustStore
+		encode func([]*x509.Certificate, string) ([]byte, error)
+	}{
+		{target.JKS, transform.EncodeJKSTrustStore},
+		{target.PKCS12, transform.EncodePKCS12TrustStore},
+	} {
+		if store.spec == nil {
+			continue
+		}
+		if upToDate && len(existing[store.spec.Key]) > 0 {
+			outputs[store.spec.Key] = existing[store.spec.Key]
+			continue
+		}
+		password := store.spec.Password
+		if password == "" {
+			password = defaultTrustStorePassword
+		}
+		encoded, err := store.encode(certs, password)
+		if err != nil {
+			return trustBundleWrite{}, fmt.Errorf("while encoding the truststore '%s': %w", store.spec.Key, err)
+		}
+		outputs[store.spec.Key] = encoded
+	}
+
+	changed := obj.GetAnnotations()[TrustBundleRetainedAnnotKey] != lastSeen
+	for k, v := range outputs {
+		if !bytes.Equal(existing[k], v) {
+			changed = true
+		}
+	}
+	if !changed {
+		return written, nil
+	}
+	written.changed = true
+
+	obj.SetNamespace(target.Namespace)
+	obj.SetName(target.Name)
+	annots := obj.GetAnnotations()
+	if annots == nil {
+		annots = make(map[string]string)
+	}
+	annots[TrustBundleAnnotKey] = bundle.Name
+	if lastSeen != "" {
+		annots[TrustBundleRetainedAnnotKey] = lastSeen
+	} else {
+		delete(annots, TrustBundleRetainedAnnotKey)
+	}
+	obj.SetAnnotations(annots)
+	setTargetData(obj, key, outputs)
+
+	if notFound {
+		return written, cl.Create(ctx, obj)
+	}
+	return written, cl.Update(ctx, obj)
+}
+
+// Returns the CA certificates of the previous bundle that are no longer found
+// in the sources but are still within the grace period. The time at which
+// each of them was last seen in the sources is kept in the annotation
+// TrustBundleRetainedAnnotKey of the target; the new value of the annotation
+// is returned along with the time at which the first retained certificate is
+// due to be dropped. Expired certificates are dropped right away.
+func retainPreviousCAs(previous []byte, annot string, certs []*x509.Certificate, grace time.Duration, now time.Time) ([]*x509.Certificate, string, time.Time) {
+	if grace <= 0 || len(previous) == 0 {
+		return nil, "", time.Time{}
+	}
+
+	// An annotation that can't be parsed is ignored; the previous CA
+	// certificates are then considered as last seen now.
+	lastSeen := make(map[string]time.Time)
+	_ = json.Unmarshal([]byte(annot), &lastSeen)
+
+	current := make(map[string]bool)
+	for _, cert := range certs {
+		current[transform.Fingerprint(cert)] = true
+	}
+
+	// The previous bundle was written by the controller, so it is expected to
+	// parse; if it doesn't, there is nothing to retain.
+	previousCerts, _ := transform.ParseCertificates(previous)
+
+	var retained []*x509.Certificate
+	kept := make(map[string]time.Time)
+	var nextDrop time.Time
+	for _, cert := range previousCerts {
+		fingerprint := transform.Fingerprint(cert)
+		if current[fingerprint] {
+			continue
+		}
+		seen, found := lastSeen[fingerprint]
+		if !found {
+			seen = now.UTC().Truncate(time.Second)
+		}
+		drop := seen.Add(grace)
+		if !now.Before(drop) || !now.Before(cert.NotAfter) {
+			continue
+		}
+		retained = append(retained, cert)
+		kept[fingerprint] = seen
+		if nextDrop.IsZero() || drop.Before(nextDrop) {
+			nextDrop = drop
+		}
+	}
+	if len(kept) == 0 {
+		return nil, "", time.Time{}
+	}
+
+	// The keys of the map are sorted by json.Marshal, so the annotation only
+	// changes when the retained certificates change.
+	value, _ := json.Marshal(kept)
+	return retained, string(value), nextDrop
+}
+
+func targetKind(target v1alpha1.TrustBundleTarget) string {
+	if target.Kind == "" {
+		return "Secret"
+	}
+	return target.Kind
+}
+
+// Returns the contents of the Secret or ConfigMap as bytes.
+func targetData(obj client.Object) map[string][]byte {
+	data := make(map[string][]byte)
+	switch obj := obj.(type) {
+	case *corev1.Secret:
+		for k, v := range obj.Data {
+			data[k] = v
+		}
+	case *corev1.ConfigMap:
+		for k, v := range obj.Data {
+			data[k] = []byte(v)
+		}
+		for k, v := range obj.BinaryData {
+			data[k] = v
+		}
+	}
+	return data
+}
+
+// Sets the given keys in the Secret or ConfigMap. In ConfigMaps, the PEM
+// bundle goes into data and the truststores into binaryData.
+func setTargetData(obj client.Object, pemKey string, outputs map[string][]byte) {
+	switch obj := obj.(type) {
+	case *corev1.Secret:
+		if obj.Data == nil {
+			obj.Data = make(map[string][]byte)
+		}
+		for k, v := range outputs {
+			obj.Data[k] = v
+		}
+	case *corev1.ConfigMap:
+		if obj.Data == nil {
+			obj.Data = make(map[string]string)
+		}
+		if obj.BinaryData == nil {
+			obj.BinaryData = make(map[string][]byte)
+		}
+		for k, v := range outputs {
+			if k == pemKey {
+				obj.Data[k] = string(v)
+			} else {
+				obj.BinaryData[k] = v
+			}
+		}
+	}
+}
+
+func setTrustBundleStatus(ctx context.Context, cl client.Client, bundle *v1alpha1.TrustBundle, certs int, status metav1.ConditionStatus, reason, msg string) error {
+	ready := meta.FindStatusCondition(bundle.Status.Conditions, "Ready")
+	if ready != nil && ready.Status == status && ready.Reason == reason && ready.Message == msg &&
+		ready.ObservedGeneration == bundle.Generation && bundle.Status.Certificates == certs {
+		return nil
+	}
+
+	bundle.Status.Certificates = certs
+	meta.SetStatusCondition(&bundle.Status.Conditions, metav1.Condition{
+		Type:               "Ready",
+		Status:             status,
+		Reason:             reason,
+		Message:            msg,
+		ObservedGeneration: bundle.Generation,
+	})
+	return cl.Status().Update(ctx, bundle)
+}
+
+// Returns the TrustBundles that use the Secret as a source or as a target.
+func trustBundlesFor(ctx context.Context, cl client.Reader, secret client.Object) []reconcile.Request {
+	bundles := &v1alpha1.TrustBundleList{}
+	if err := cl.List(ctx, bundles); err != nil {
+		log.Log.WithName("trust-bundle").Error(err, "while listing the TrustBundles")
+		return nil
+	}
+
+	var reqs []reconcile.Request
+	for _, bundle := range bundles.Items {
+		target := bundle.Spec.Target
+		isTarget := targetKind(target) == "Secret" && target.Namespace == secret.GetNamespace() && target.Name == secret.GetName()
+		if isTarget || isTrustBundleSource(&bundle, secret) {
+			reqs = append(reqs, reconcile.Request{NamespacedName: types.NamespacedName{Name: bundle.Name}})
+		}
+	}
+	return reqs
+}
+
+func isTrustBundleSource(bundle *v1alpha1.TrustBundle, secret client.Object) bool {
+	sources := bundle.Spec.Sources
+	if len(sources.Namespaces) > 0 {
+		found := false
+		for _, ns := range sources.Namespaces {
+			found = found || ns == secret.GetNamespace()
+		}
+		if !found {
+			return false
+		}
+	}
+	selector, err := metav1.LabelSelectorAsSelector(&sources.Selector)
+	if err != nil {
+		return false
+	}
+	return selector.Matches(labels.Set(secret.GetLabels()))
+}
+
+// SetupTrustBundleWithManager sets up the TrustBundle controller with the
+// Manager. The TrustBundle CRD must be installed and v1alpha1 must be added to
+// the scheme of the Manager. The changes to the source Secrets are noticed
+// through the Secret informer of the Manager, so the sources that its cache
+// doesn't hold are only picked up on the next resync.
+func SetupTrustBundleWithManager(mgr manager.Manager) error {
+	rec := mgr.GetEventRecorderFor("secret-transform")
+	reconciler := TrustBundleReconciler(mgr.GetClient(), mgr.GetAPIReader(), rec)
+
+	c, err := controller.New("trust-bundle", mgr, controller.Options{Reconciler: reconciler})
+	if err != nil {
+		return fmt.Errorf("unable to set up the TrustBundle controller: %w", err)
+	}
+	if err := c.Watch(&source.Kind{Type: &v1alpha1.TrustBundle{}}, &handler.EnqueueRequestForObject{}); err != nil {
+		return fmt.Errorf("unable to watch TrustBundles: %w", err)
+	}
+	if err := c.Watch(&source.Kind{Type: &corev1.Secret{}}, handler.EnqueueRequestsFromMapFunc(func(o client.Object) []reconcile.Request {
+		return trustBundlesFor(context.Background(), mgr.GetClient(), o)
+	})); err != nil {
+		return fmt.Errorf("unable to watch Secrets: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,247 @@
+package controller
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/maelvls/secret-transform/api/v1alpha1"
+	"github.com/maelvls/secret-transform/transform"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+func TestTrustBundleReconciler(t *testing.T) {
+	ca1, ca2, ca3 := caPEM(t, "ca-1"), caPEM(t, "ca-2"), caPEM(t, "ca-3")
+	source := func(ns, name string, labels map[string]string, caCrt []byte) *corev1.Secret {
+		return &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Namespace: ns, Name: name, Labels: labels},
+			Data:       map[string][]byte{"ca.crt": caCrt},
+		}
+	}
+	internal := map[string]string{"ca": "internal"}
+	bundle := func(target v1alpha1.TrustBundleTarget) *v1alpha1.TrustBundle {
+		return &v1alpha1.TrustBundle{
+			ObjectMeta: metav1.ObjectMeta{Name: "internal"},
+			Spec: v1alpha1.TrustBundleSpec{
+				Sources: v1alpha1.TrustBundleSources{
+					Selector:   metav1.LabelSelector{MatchLabels: internal},
+					Namespaces: []string{"team-a", "team-b"},
+				},
+				Target: target,
+			},
+		}
+	}
+	reconcileBundle := func(t *testing.T, objs ...client.Object) (client.Client, *record.FakeRecorder, error) {
+		t.Helper()
+		scheme := runtime.NewScheme()
+		require.NoError(t, clientgoscheme.AddToScheme(scheme))
+		require.NoError(t, v1alpha1.AddToScheme(scheme))
+		cl := fake.NewClientBuilder().WithScheme(scheme).WithObjects(objs...).Build()
+		recorder := record.NewFakeRecorder(10)
+		_, err := TrustBundleReconciler(cl, cl, recorder).Reconcile(t.Context(), reconcile.Request{NamespacedName: types.NamespacedName{Name: "internal"}})
+		return cl, recorder, err
+	}
+
+	t.Run("the CAs of the matching Secrets are deduplicated, sorted, and written into a Secret", func(t *testing.T) {
+		cl, recorder, err := reconcileBundle(t,
+			bundle(v1alpha1.TrustBundleTarget{Namespace: "shared", Name: "ca-bundle", JKS: &v1alpha1.TrustStore{Key: "truststore.jks"}}),
+			source("team-a", "ca-2", internal, ca2),
+			source("team-b", "ca-1", internal, append(append([]byte{}, ca1...), ca2...)),
+			source("team-b", "not-labelled", nil, ca3),
+			source("team-c", "other-namespace", internal, ca3),
+		)
+		require.NoError(t, err)
+
+		target := &corev1.Secret{}
+		require.NoError(t, cl.Get(t.Context(), types.NamespacedName{Namespace: "shared", Name: "ca-bundle"}, target))
+		assert.Equal(t, string(ca1)+string(ca2), string(target.Data["ca-bundle.pem"]))
+		assert.NotEmpty(t, target.Data["truststore.jks"])
+		assert.Equal(t, "internal", target.Annotations["secret-transform.io/trust-bundle"])
+		assert.Equal(t, "Normal Updated Wrote 2 CA certificates into Secret shared/ca-bundle", <-recorder.Events)
+
+		got := &v1alpha1.TrustBundle{}
+		require.NoError(t, cl.Get(t.Context(), types.NamespacedName{Name: "internal"}, got))
+		assert.Equal(t, 2, got.Status.Certificates)
+		assert.True(t, meta.IsStatusConditionTrue(got.Status.Conditions, "Ready"))
+	})
+
+	t.Run("the PEM bundle goes into the data of a ConfigMap and the truststores into its binaryData", func(t *testing.T) {
+		cl, _, err := reconcileBundle(t,
+			bundle(v1alpha1.TrustBundleTarget{Kind: "ConfigMap", Namespace: "shared", Name: "ca-bundle", PKCS12: &v1alpha1.TrustStore{Key: "truststore.p12"}}),
+			source("team-a", "ca-1", internal, ca1),
+		)
+		require.NoError(t, err)
+
+		target := &corev1.ConfigMap{}
+		require.NoError(t, cl.Get(t.Context(), types.NamespacedName{Namespace: "shared", Name: "ca-bundle"}, target))
+		assert.Equal(t, string(ca1), target.Data["ca-bundle.pem"])
+		assert.NotEmpty(t, target.BinaryData["truststore.p12"])
+	})
+
+	t.Run("an up-to-date target isn't updated", func(t *testing.T) {
+		existing := &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "shared", Name: "ca-bundle", Annotations: map[string]string{"secret-transform.io/trust-bundle": "internal"}},
+			Data:       map[string][]byte{"ca-bundle.pem": ca1, "truststore.p12": []byte("kept")},
+		}
+		cl, recorder, err := reconcileBundle(t,
+			bundle(v1alpha1.TrustBundleTarget{Namespace: "shared", Name: "ca-bundle", PKCS12: &v1alpha1.TrustStore{Key: "truststore.p12"}}),
+			source("team-a", "ca-1", internal, ca1),
+			existing,
+		)
+		require.NoError(t, err)
+
+		target := &corev1.Secret{}
+		require.NoError(t, cl.Get(t.Context(), types.NamespacedName{Namespace: "shared", Name: "ca-bundle"}, target))
+		assert.Equal(t, existing.ResourceVersion, target.ResourceVersion)
+		assert.Equal(t, "kept", string(target.Data["truststore.p12"]))
+		assert.Empty(t, recorder.Events)
+	})
+
+	t.Run("a target that isn't managed by the TrustBundle isn't overwritten", func(t *testing.T) {
+		_, recorder, err := reconcileBundle(t,
+			bundle(v1alpha1.TrustBundleTarget{Namespace: "shared", Name: "ca-bundle"}),
+			source("team-a", "ca-1", internal, ca1),
+			&corev1.Secret{ObjectMeta: metav1.ObjectMeta{Namespace: "shared", Name: "ca-bundle"}},
+		)
+		assert.Error(t, err)
+		assert.Equal(t, "Warning FailedWriting Secret shared/ca-bundle already exists and isn't managed by this TrustBundle; add the annotation secret-transform.io/trust-bundle=internal to it to let the TrustBundle manage it", <-recorder.Events)
+	})
+
+	t.Run("invalid sources are skipped with a Warning", func(t *testing.T) {
+		cl, recorder, err := reconcileBundle(t,
+			bundle(v1alpha1.TrustBundleTarget{Namespace: "shared", Name: "ca-bundle"}),
+			source("team-a", "ca-1", internal, ca1),
+			source("team-a", "garbage", internal, []byte("garbage")),
+		)
+		require.NoError(t, err)
+		assert.Equal(t, "Warning InvalidSource Secret team-a/garbage: key 'ca.crt': no PEM-encoded certificate found", <-recorder.Events)
+
+		target := &corev1.Secret{}
+		require.NoError(t, cl.Get(t.Context(), types.NamespacedName{Namespace: "shared", Name: "ca-bundle"}, target))
+		assert.Equal(t, string(ca1), string(target.Data["ca-bundle.pem"]))
+	})
+}
+
+func TestTrustBundleRotationGracePeriod(t *testing.T) {
+	oldCA, newCA := caPEM(t, "ca"), caPEM(t, "ca")
+	start := time.Now().UTC().Truncate(time.Second)
+	t.Cleanup(func() { now = time.Now })
+
+	scheme := runtime.NewScheme()
+	require.NoError(t, clientgoscheme.AddToScheme(scheme))
+	require.NoError(t, v1alpha1.AddToScheme(scheme))
+	source := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "team-a", Name: "ca", Labels: map[string]string{"ca": "internal"}},
+		Data:       map[string][]byte{"ca.crt": newCA},
+	}
+	target := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "shared", Name: "ca-bundle", Annotations: map[string]string{"secret-transform.io/trust-bundle": "internal"}},
+		Data:       map[string][]byte{"ca-bundle.pem": oldCA},
+	}
+	cl := fake.NewClientBuilder().WithScheme(scheme).WithObjects(source, target, &v1alpha1.TrustBundle{
+		ObjectMeta: metav1.ObjectMeta{Name: "internal"},
+		Spec: v1alpha1.TrustBundleSpec{
+			Sources:             v1alpha1.TrustBundleSources{Selector: metav1.LabelSelector{MatchLabels: map[string]string{"ca": "internal"}}},
+			Target:              v1alpha1.TrustBundleTarget{Namespace: "shared", Name: "ca-bundle"},
+			RotationGracePeriod: &metav1.Duration{Duration: 30 * time.Minute},
+		},
+	}).Build()
+	recorder := record.NewFakeRecorder(10)
+	reconcileAt := func(t *testing.T, at time.Time) (reconcile.Result, *corev1.Secret) {
+		t.Helper()
+		now = func() time.Time { return at }
+		result, err := TrustBundleReconciler(cl, cl, recorder).Reconcile(t.Context(), reconcile.Request{NamespacedName: types.NamespacedName{Name: "internal"}})
+		require.NoError(t, err)
+		got := &corev1.Secret{}
+		require.NoError(t, cl.Get(t.Context(), types.NamespacedName{Namespace: "shared", Name: "ca-bundle"}, got))
+		return result, got
+	}
+	oldFingerprint := fingerprint(t, oldCA)
+
+	// The CA rotates: the previous CA is kept next to the new one.
+	result, got := reconcileAt(t, start)
+	assert.ElementsMatch(t, []string{oldFingerprint, fingerprint(t, newCA)}, fingerprints(t, got.Data["ca-bundle.pem"]))
+	assert.Equal(t, `{"`+oldFingerprint+`":"`+start.Format(time.RFC3339)+`"}`, got.Annotations["secret-transform.io/trust-bundle-retained"])
+	assert.Equal(t, 30*time.Minute, result.RequeueAfter)
+	assert.Equal(t, "Normal Updated Wrote 2 CA certificates into Secret shared/ca-bundle, including 1 previous CA certificates kept until the end of the rotation grace period", <-recorder.Events)
+
+	// Within the grace period, nothing changes.
+	result, got = reconcileAt(t, start.Add(10*time.Minute))
+	assert.Len(t, fingerprints(t, got.Data["ca-bundle.pem"]), 2)
+	assert.Equal(t, 20*time.Minute, result.RequeueAfter)
+	assert.Empty(t, recorder.Events)
+
+	// Once the grace period is over, the previous CA is dropped.
+	result, got = reconcileAt(t, start.Add(30*time.Minute))
+	assert.Equal(t, string(newCA), string(got.Data["ca-bundle.pem"]))
+	assert.NotContains(t, got.Annotations, "secret-transform.io/trust-bundle-retained")
+	assert.Zero(t, result.RequeueAfter)
+	assert.Equal(t, "Normal Updated Wrote 1 CA certificates into Secret shared/ca-bundle", <-recorder.Events)
+}
+
+func fingerprint(t *testing.T, certPEM []byte) string {
+	t.Helper()
+	fingerprints := fingerprints(t, certPEM)
+	require.Len(t, fingerprints, 1)
+	return fingerprints[0]
+}
+
+func fingerprints(t *testing.T, bundlePEM []byte) []string {
+	t.Helper()
+	certs, err := transform.ParseCertificates(bundlePEM)
+	require.NoError(t, err)
+	var fingerprints []string
+	for _, cert := range certs {
+		fingerprints = append(fingerprints, transform.Fingerprint(cert))
+	}
+	return fingerprints
+}
+
+func TestIsTrustBundleSource(t *testing.T) {
+	bundle := &v1alpha1.TrustBundle{Spec: v1alpha1.TrustBundleSpec{Sources: v1alpha1.TrustBundleSources{
+		Selector:   metav1.LabelSelector{MatchLabels: map[string]string{"ca": "internal"}},
+		Namespaces: []string{"team-a"},
+	}}}
+
+	assert.True(t, isTrustBundleSource(bundle, &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Namespace: "team-a", Labels: map[string]string{"ca": "internal"}}}))
+	assert.False(t, isTrustBundleSource(bundle, &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Namespace: "team-b", Labels: map[string]string{"ca": "internal"}}}))
+	assert.False(t, isTrustBundleSource(bundle, &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Namespace: "team-a"}}))
+}
+
+// caPEM returns a PEM-encoded self-signed CA certificate.
+func caPEM(t *testing.T, commonName string) []byte {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: commonName},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
@@ -5,3 +5,18 @@
 {{- define "secret-transform.selectorLabels" -}}
 {{- tpl (toYaml $.Values.selectorLabels) $ }}
 {{- end }}
+
+{{- /* The permissions needed in each of the watched namespaces. */ -}}
+{{- define "secret-transform.rules" }}
+- apiGroups: [""]
+  resources: ["secrets"]
+  verbs: ["get", "list", "watch", "update"]
+- apiGroups: [""]
+  resources: ["events"]
+  verbs: ["create", "patch"]
+{{- if .Values.rolloutWorkloads }}
+- apiGroups: ["apps"]
+  resources: ["deployments", "statefulsets", "daemonsets"]
+  verbs: ["get", "list", "patch"]
+{{- end }}
+{{- end }}
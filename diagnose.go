@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/maelvls/secret-transform/controller"
+	"github.com/maelvls/secret-transform/transform"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/config"
+)
+
+const diagnoseUsage = `Usage: secret-transform diagnose [--context CONTEXT] NAMESPACE/NAME
+
+Explains what secret-transform does with the given Secret: which annotations
+are recognized, which transforms would run, what would change, and whether
+the Secret has problems that would prevent the transforms from working. The
+Secret isn't modified.
+
+The kubeconfig is loaded from $KUBECONFIG or ~/.kube/config. To use this
+command as a kubectl plugin, copy or symlink the binary to a file named
+kubectl-secret_transform in your PATH and run:
+
+  kubectl secret-transform diagnose NAMESPACE/NAME
+
+Exits with 1 when problems were found.
+`
+
+// diagnoseCmd implements "secret-transform diagnose". Returns the exit code.
+func diagnoseCmd(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("diagnose", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() { fmt.Fprint(stderr, diagnoseUsage) }
+	kubeContext := fs.String("context", "", "the kubeconfig context to use")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	namespace, name, found := strings.Cut(fs.Arg(0), "/")
+	if fs.NArg() != 1 || !found || namespace == "" || name == "" {
+		fs.Usage()
+		return 2
+	}
+
+	cfg, err := config.GetConfigWithContext(*kubeContext)
+	if err != nil {
+		fmt.Fprintf(stderr, "error: %v\n", err)
+		return 2
+	}
+	cl, err := client.New(cfg, client.Options{})
+	if err != nil {
+		fmt.Fprintf(stderr, "error: %v\n", err)
+		return 2
+	}
+
+	secret := &corev1.Secret{}
+	err = cl.Get(context.Background(), types.NamespacedName{Namespace: namespace, Name: name}, secret)
+	if err != nil {
+		fmt.Fprintf(stderr, "error: %v\n", err)
+		return 2
+	}
+
+	get := func(name string) (map[string][]byte, error) {
+		referenced := &corev1.Secret{}
+		if err := cl.Get(context.Background(), types.NamespacedName{Namespace: namespace, Name: name}, referenced); err != nil {
+			return nil, err
+		}
+		return referenced.Data, nil
+	}
+	if !diagnose(stdout, secret, get, time.Now()) {
+		return 1
+	}
+	return 0
+}
+
+// Prints the diagnosis of the given Secret. The Secrets it references are
+// read with get. Returns false if problems were found.
+func diagnose(w io.Writer, secret *corev1.Secret, get transform.SecretGetter, now time.Time) bool {
+	var problems []string
+
+	fmt.Fprintf(w, "Secret %s/%s\n", secret.Namespace, secret.Name)
+
+	// Which transformer consumes which annotation.
+	consumedBy := make(map[string]string)
+	for _, t := range transform.Transformers() {
+		for _, annot := range transform.ConsumedAnnotations(t, secret.Annotations) {
+			consumedBy[annot] = t.Name()
+		}
+	}
+
+	fmt.Fprintf(w, "\nAnnotations:\n")
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	shown := 0
+	for _, annot := range sortedKeys(secret.Annotations) {
+		var comment string
+		switch {
+		case consumedBy[annot] != "":
+			comment = "used by " + consumedBy[annot]
+			if replacement, isLegacy := transform.IsLegacyAnnotation(annot); isLegacy {
+				comment += fmt.Sprintf(" (legacy, use %s instead)", replacement)
+			}
+		case annot == transform.SecretConditionAnnotKey:
+			comment = "condition"
+		case annot == controller.RolloutAnnotKey:
+			comment = "rollout of the workloads, if enabled with --rollout-workloads"
+		case annot == transform.TLSKeyPassphraseSecretAnnotKey || annot == transform.TLSKeyPassphraseKeyAnnotKey:
+			comment = "passphrase of tls.key, if encrypted"
+		case annot == transform.SystemRootsVersionAnnotKey:
+			comment = "version of the system root CAs, written by the controller"
+		case annot == controller.SDSAnnotKey:
+			comment = "served over Envoy SDS, if enabled with --sds-bind-address"
+		case secret.Annotations[annot] == "" && (strings.HasPrefix(annot, "secret-transform/") || isLegacy(annot)):
+			comment = "ignored because empty"
+		case strings.HasPrefix(annot, "secret-transform/"):
+			comment = "not recognized"
+			problems = append(problems, fmt.Sprintf("the annotation %s isn't recognized, check for typos", annot))
+		default:
+			continue
+		}
+		fmt.Fprintf(tw, "  %s\t%s\t%s\n", annot, firstLine(secret.Annotations[annot]), comment)
+		shown++
+	}
+	tw.Flush()
+	if shown == 0 {
+		fmt.Fprintf(w, "  none\n")
+		problems = append(problems, "the Secret has none of the annotations secret-transform looks for")
+	}
+
+	fmt.Fprintf(w, "\nCondition:\n")
+	ok, err := transform.EvalCondition(secret)
+	switch {
+	case secret.Annotations[transform.SecretConditionAnnotKey] == "":
+		fmt.Fprintf(w, "  none\n")
+	case err != nil:
+		fmt.Fprintf(w, "  error: %v\n", err)
+	case ok:
+		fmt.Fprintf(w, "  true, the transforms run\n")
+	default:
+		fmt.Fprintf(w, "  false, none of the transforms run\n")
+	}
+
+	fmt.Fprintf(w, "\nTransforms that would run:\n")
+	ran := 0
+	if ok {
+		for _, t := range transform.Transformers() {
+			if transform.Consumes(t, secret.Annotations) {
+				fmt.Fprintf(w, "  %s\n", t.Name())
+				ran++
+			}
+		}
+	}
+	if ran == 0 {
+		fmt.Fprintf(w, "  none\n")
+	}
+
+	after := secret.DeepCopy()
+	if after.Data == nil {
+		after.Data = make(map[string][]byte)
+	}
+	events, err := transform.ApplyWithSecrets(after, get)
+	if err != nil {
+		after = secret
+	}
+
+	fmt.Fprintf(w, "\nChanges:\n")
+	changed := 0
+	for _, key := range sortedKeys(after.Data) {
+		before, existed := secret.Data[key]
+		switch {
+		case !existed:
+			fmt.Fprintf(w, "  + %s (%d bytes)\n", key, len(after.Data[key]))
+		case string(before) != string(after.Data[key]):
+			fmt.Fprintf(w, "  ~ %s (%d bytes)\n", key, len(after.Data[key]))
+		default:
+			continue
+		}
+		changed++
+	}
+	if changed == 0 {
+		fmt.Fprintf(w, "  none, the Secret is up to date\n")
+	}
+
+	for _, e := range events {
+		if e.Type == corev1.EventTypeWarning {
+			problems = append(problems, fmt.Sprintf("%s: %s", e.Reason, e.Message))
+		}
+	}
+	problems = append(problems, certificateProblems(secret, get, now)...)
+
+	fmt.Fprintf(w, "\nProblems:\n")
+	if len(problems) == 0 {
+		fmt.Fprintf(w, "  none\n")
+		return true
+	}
+	for _, p := range problems {
+		fmt.Fprintf(w, "  - %s\n", p)
+	}
+	return false
+}
+
+// Looks for the common problems with the key material found in cert-manager
+// Secrets. An encrypted tls.key is decrypted with the passphrase read with get.
+func certificateProblems(secret *corev1.Secret, get transform.SecretGetter, now time.Time) []string {
+	var problems []string
+
+	crt, hasCrt := secret.Data["tls.crt"]
+	key, hasKey := secret.Data["tls.key"]
+
+	if hasCrt {
+		block, _ := pem.Decode(crt)
+		var cert *x509.Certificate
+		var err error
+		if block == nil || block.Type != "CERTIFICATE" {
+			err = fmt.Errorf("no PEM-encoded certificate found")
+		} else {
+			cert, err = x509.ParseCertificate(block.Bytes)
+		}
+		switch {
+		case err != nil:
+			problems = append(problems, fmt.Sprintf("tls.crt: %v", err))
+		case now.After(cert.NotAfter):
+			problems = append(problems, fmt.Sprintf("tls.crt: the certificate expired on %s", cert.NotAfter.UTC().Format(time.RFC3339)))
+		case now.Before(cert.NotBefore):
+			problems = append(problems, fmt.Sprintf("tls.crt: the certificate isn't valid before %s", cert.NotBefore.UTC().Format(time.RFC3339)))
+		}
+	}
+
+	// When tls.key can't be decrypted, the transforms reading it already
+	// reported why.
+	if hasKey {
+		var err error
+		if key, err = transform.DecryptedTLSKey(secret, get); err != nil {
+			hasKey = false
+		}
+	}
+	if hasCrt && hasKey {
+		if _, err := tls.X509KeyPair(crt, key); err != nil {
+			problems = append(problems, fmt.Sprintf("tls.crt and tls.key: %v", err))
+		}
+	}
+
+	if ca, found := secret.Data["ca.crt"]; found && len(ca) == 0 {
+		problems = append(problems, "ca.crt: empty, which is common with ACME issuers; some applications refuse to start with an empty CA file")
+	}
+
+	return problems
+}
+
+func isLegacy(annot string) bool {
+	_, isLegacy := transform.IsLegacyAnnotation(annot)
+	return isLegacy
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func firstLine(s string) string {
+	line, _, multiline := strings.Cut(s, "\n")
+	if multiline {
+		return line + "..."
+	}
+	return line
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestDiagnose(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	t.Run("everything is fine", func(t *testing.T) {
+		crt, key := selfSigned(t, now.Add(-time.Hour), now.Add(time.Hour))
+		var out bytes.Buffer
+
+		ok := diagnose(&out, &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "cert-1", Namespace: "default", Annotations: map[string]string{
+				"secret-transform/secret-transform":    "tls.pem",
+				"cert-manager.io/secret-copy-tls.crt":  "cert",
+				"cert-manager.io/issuer-name":          "unrelated",
+				"secret-transform/secret-copy-tls.key": "",
+			}},
+			Data: map[string][]byte{"tls.crt": crt, "tls.key": key, "cert": crt},
+		}, nil, now)
+
+		assert.True(t, ok)
+		assert.Equal(t, `Secret default/cert-1
+
+Annotations:
+  cert-manager.io/secret-copy-tls.crt   cert     used by copy-tls.crt (legacy, use secret-transform/secret-copy-tls.crt instead)
+  secret-transform/secret-copy-tls.key           ignored because empty
+  secret-transform/secret-transform     tls.pem  used by combined-pem
+
+Condition:
+  none
+
+Transforms that would run:
+  combined-pem
+  copy-tls.crt
+
+Changes:
+  + tls.pem (`+strconv.Itoa(len(key)+len(crt))+` bytes)
+
+Problems:
+  none
+`, out.String())
+	})
+
+	t.Run("the annotations written by the controller are recognized", func(t *testing.T) {
+		crt, _ := selfSigned(t, now.Add(-time.Hour), now.Add(time.Hour))
+		var out bytes.Buffer
+
+		ok := diagnose(&out, &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "cert-1", Namespace: "default", Annotations: map[string]string{
+				"secret-transform/secret-copy-ca.crt":   "ca",
+				"secret-transform/system-roots-version": "2024.1",
+			}},
+			Data: map[string][]byte{"ca.crt": crt, "ca": crt},
+		}, nil, now)
+
+		assert.True(t, ok)
+		assert.Contains(t, out.String(), "secret-transform/system-roots-version  2024.1  version of the system root CAs, written by the controller")
+		assert.NotContains(t, out.String(), "check for typos")
+	})
+
+	t.Run("an encrypted key is decrypted with its passphrase", func(t *testing.T) {
+		crt, key := selfSigned(t, now.Add(-time.Hour), now.Add(time.Hour))
+		block, _ := pem.Decode(key)
+		encrypted, err := x509.EncryptPEMBlock(rand.Reader, block.Type, block.Bytes, []byte("s3cr3t"), x509.PEMCipherAES256)
+		require.NoError(t, err)
+		var out bytes.Buffer
+
+		ok := diagnose(&out, &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "cert-1", Namespace: "default", Annotations: map[string]string{
+				"secret-transform/secret-transform":          "tls.pem",
+				"secret-transform/tls-key-passphrase-secret": "passphrase",
+			}},
+			Data: map[string][]byte{"tls.crt": crt, "tls.key": pem.EncodeToMemory(encrypted)},
+		}, func(name string) (map[string][]byte, error) {
+			return map[string][]byte{"passphrase": []byte("s3cr3t")}, nil
+		}, now)
+
+		assert.True(t, ok, out.String())
+		assert.Contains(t, out.String(), "Problems:\n  none\n")
+	})
+
+	t.Run("problems are listed", func(t *testing.T) {
+		crt, _ := selfSigned(t, now.Add(-2*time.Hour), now.Add(-time.Hour))
+		_, otherKey := selfSigned(t, now.Add(-2*time.Hour), now.Add(-time.Hour))
+		var out bytes.Buffer
+
+		ok := diagnose(&out, &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "cert-1", Namespace: "default", Annotations: map[string]string{
+				"secret-transform/secret-cpy-ca.crt":  "ca",
+				"secret-transform/secret-copy-ca.crt": "ca",
+			}},
+			Data: map[string][]byte{"tls.crt": crt, "tls.key": otherKey},
+		}, nil, now)
+
+		assert.False(t, ok)
+		assert.Equal(t, `Secret default/cert-1
+
+Annotations:
+  secret-transform/secret-copy-ca.crt  ca  used by copy-ca.crt
+  secret-transform/secret-cpy-ca.crt   ca  not recognized
+
+Condition:
+  none
+
+Transforms that would run:
+  copy-ca.crt
+
+Changes:
+  none, the Secret is up to date
+
+Problems:
+  - the annotation secret-transform/secret-cpy-ca.crt isn't recognized, check for typos
+  - FailedCopying: annot 'secret-transform/secret-copy-ca.crt': the key "ca.crt" does not exist
+  - tls.crt: the certificate expired on 2023-12-31T23:00:00Z
+  - tls.crt and tls.key: tls: private key does not match public key
+`, out.String())
+	})
+}
+
+// selfSigned returns a PEM-encoded self-signed certificate and its PEM-encoded
+// SEC 1 private key.
+func selfSigned(t *testing.T, notBefore, notAfter time.Time) (crtPEM, keyPEM []byte) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "example.com"},
+		NotBefore:    notBefore,
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
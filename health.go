@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"sigs.k8s.io/controller-runtime/pkg/healthz"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+)
+
+// Registers the checks served on /healthz and /readyz. Each check is also
+// served on its own path, e.g., /readyz/leader.
+//
+// The "leader" check fails on the replicas that aren't the leader. It is
+// meant to find out which replica is the leader; the readiness probe of the
+// Helm chart excludes it with /readyz?exclude=leader, since otherwise a
+// rolling update would never finish: the new Pod would wait for the old Pod
+// to release the Lease, and the old Pod would wait for the new Pod to be
+// ready.
+func addHealthChecks(mgr manager.Manager) error {
+	if err := mgr.AddHealthzCheck("ping", healthz.Ping); err != nil {
+		return err
+	}
+	if err := mgr.AddReadyzCheck("cache-sync", cacheSyncCheck(mgr.GetCache())); err != nil {
+		return err
+	}
+	if err := mgr.AddReadyzCheck("leader", leaderCheck(mgr.Elected())); err != nil {
+		return err
+	}
+	return nil
+}
+
+type cacheSyncer interface {
+	WaitForCacheSync(ctx context.Context) bool
+}
+
+// Fails until the informers of the cache have synced. Before that, the
+// controller would see an incomplete list of Secrets.
+func cacheSyncCheck(cache cacheSyncer) healthz.Checker {
+	return func(req *http.Request) error {
+		ctx, cancel := context.WithTimeout(req.Context(), time.Second)
+		defer cancel()
+		if !cache.WaitForCacheSync(ctx) {
+			return errors.New("the informer cache hasn't synced yet")
+		}
+		return nil
+	}
+}
+
+// Fails until this replica is elected leader. When the leader election is
+// disabled, the elected channel is closed right away and the check passes.
+func leaderCheck(elected <-chan struct{}) healthz.Checker {
+	return func(_ *http.Request) error {
+		select {
+		case <-elected:
+			return nil
+		default:
+			return errors.New("this replica isn't the leader")
+		}
+	}
+}
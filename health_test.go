@@ -0,0 +1,30 @@
+package main
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeCache struct{ synced bool }
+
+func (c fakeCache) WaitForCacheSync(_ context.Context) bool { return c.synced }
+
+func TestCacheSyncCheck(t *testing.T) {
+	req := httptest.NewRequest("GET", "/readyz", nil)
+
+	assert.EqualError(t, cacheSyncCheck(fakeCache{synced: false})(req), "the informer cache hasn't synced yet")
+	assert.NoError(t, cacheSyncCheck(fakeCache{synced: true})(req))
+}
+
+func TestLeaderCheck(t *testing.T) {
+	req := httptest.NewRequest("GET", "/readyz", nil)
+	elected := make(chan struct{})
+	check := leaderCheck(elected)
+
+	assert.EqualError(t, check(req), "this replica isn't the leader")
+	close(elected)
+	assert.NoError(t, check(req))
+}
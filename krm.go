@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"io"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"sigs.k8s.io/yaml"
+)
+
+const krmUsage = `Usage: secret-transform krm
+
+Runs secret-transform as a KRM function: reads a ResourceList on stdin,
+applies the secret-transform annotations to the Secrets it contains, and
+writes the resulting ResourceList on stdout. See
+https://github.com/kubernetes-sigs/kustomize/blob/master/cmd/config/docs/api-conventions/functions-spec.md.
+
+Exits with 1 when one of the Secrets would have gotten a Warning event. The
+warnings are reported as results with the severity "error".
+`
+
+// krmCmd implements "secret-transform krm". Returns the exit code.
+func krmCmd(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	if len(args) > 0 {
+		fmt.Fprint(stderr, krmUsage)
+		return 2
+	}
+
+	docs, err := decodeManifests(stdin)
+	if err != nil {
+		fmt.Fprintf(stderr, "error: while reading the ResourceList: %v\n", err)
+		return 2
+	}
+	if len(docs) != 1 || docs[0].GetAPIVersion() != "config.kubernetes.io/v1" || docs[0].GetKind() != "ResourceList" {
+		fmt.Fprintf(stderr, "error: expected a single config.kubernetes.io/v1 ResourceList on stdin\n")
+		return 2
+	}
+	list := docs[0]
+
+	items, _, err := unstructured.NestedSlice(list.Object, "items")
+	if err != nil {
+		fmt.Fprintf(stderr, "error: while reading the ResourceList's items: %v\n", err)
+		return 2
+	}
+
+	var objs []*unstructured.Unstructured
+	for _, item := range items {
+		if m, ok := item.(map[string]any); ok {
+			objs = append(objs, &unstructured.Unstructured{Object: m})
+		}
+	}
+
+	var results []any
+	failed := false
+	for i, item := range items {
+		m, ok := item.(map[string]any)
+		if !ok {
+			continue
+		}
+		obj := &unstructured.Unstructured{Object: m}
+		if !isSecret(obj) {
+			continue
+		}
+
+		_, out, events, err := transformManifest(obj, objs)
+		if err != nil {
+			failed = true
+			results = append(results, krmResult(obj, "error", err.Error()))
+			continue
+		}
+
+		for _, e := range events {
+			severity := "info"
+			if e.Type == corev1.EventTypeWarning {
+				severity = "error"
+				failed = true
+			}
+			results = append(results, krmResult(obj, severity, fmt.Sprintf("%s: %s", e.Reason, e.Message)))
+		}
+		// The Secrets that weren't transformed are left as they were written.
+		if out != obj {
+			items[i] = out.Object
+		}
+	}
+
+	list.Object["items"] = items
+	if len(results) > 0 {
+		list.Object["results"] = results
+	}
+
+	data, err := yaml.Marshal(list.Object)
+	if err != nil {
+		fmt.Fprintf(stderr, "error: %v\n", err)
+		return 2
+	}
+	stdout.Write(data)
+
+	if failed {
+		return 1
+	}
+	return 0
+}
+
+func krmResult(obj *unstructured.Unstructured, severity, message string) map[string]any {
+	ref := map[string]any{
+		"apiVersion": obj.GetAPIVersion(),
+		"kind":       obj.GetKind(),
+		"name":       obj.GetName(),
+	}
+	if obj.GetNamespace() != "" {
+		ref["namespace"] = obj.GetNamespace()
+	}
+	return map[string]any{
+		"message":     "secret-transform: " + message,
+		"severity":    severity,
+		"resourceRef": ref,
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKRMCmd(t *testing.T) {
+	t.Run("transforms the Secrets of the ResourceList", func(t *testing.T) {
+		stdin := strings.NewReader(`
+apiVersion: config.kubernetes.io/v1
+kind: ResourceList
+items:
+- apiVersion: v1
+  kind: Secret
+  metadata:
+    name: cert-1
+    annotations:
+      config.kubernetes.io/index: "0"
+      secret-transform/secret-copy-tls.crt: cert
+  data:
+    tls.crt: ZmFrZUNydA==
+- apiVersion: v1
+  kind: Secret
+  metadata:
+    name: plain
+  stringData:
+    password: hunter2
+- apiVersion: v1
+  kind: ConfigMap
+  metadata:
+    name: unrelated
+`)
+		var stdout, stderr bytes.Buffer
+
+		code := krmCmd(nil, stdin, &stdout, &stderr)
+
+		assert.Equal(t, 0, code)
+		assert.Empty(t, stderr.String())
+		assert.Equal(t, `apiVersion: config.kubernetes.io/v1
+items:
+- apiVersion: v1
+  data:
+    cert: ZmFrZUNydA==
+    tls.crt: ZmFrZUNydA==
+  kind: Secret
+  metadata:
+    annotations:
+      config.kubernetes.io/index: "0"
+      secret-transform/secret-copy-tls.crt: cert
+    name: cert-1
+- apiVersion: v1
+  kind: Secret
+  metadata:
+    name: plain
+  stringData:
+    password: hunter2
+- apiVersion: v1
+  kind: ConfigMap
+  metadata:
+    name: unrelated
+kind: ResourceList
+results:
+- message: 'secret-transform: CopiedKey: Copied the contents of ''tls.crt'' into key
+    ''cert'''
+  resourceRef:
+    apiVersion: v1
+    kind: Secret
+    name: cert-1
+  severity: info
+`, stdout.String())
+	})
+
+	t.Run("failures are reported as results and exit with 1", func(t *testing.T) {
+		stdin := strings.NewReader(`
+apiVersion: config.kubernetes.io/v1
+kind: ResourceList
+items:
+- apiVersion: v1
+  kind: Secret
+  metadata:
+    name: cert-1
+    namespace: default
+    annotations:
+      secret-transform/secret-transform: tls.pem
+  data: {}
+`)
+		var stdout, stderr bytes.Buffer
+
+		code := krmCmd(nil, stdin, &stdout, &stderr)
+
+		assert.Equal(t, 1, code)
+		assert.Contains(t, stdout.String(), `results:
+- message: 'secret-transform: MissingTLSKey: Secret cert-1 does not contain a ''tls.key''
+    data key'
+  resourceRef:
+    apiVersion: v1
+    kind: Secret
+    name: cert-1
+    namespace: default
+  severity: error
+`)
+	})
+
+	t.Run("rejects anything else than a ResourceList", func(t *testing.T) {
+		var stdout, stderr bytes.Buffer
+
+		code := krmCmd(nil, strings.NewReader("apiVersion: v1\nkind: Secret\n"), &stdout, &stderr)
+
+		assert.Equal(t, 2, code)
+		assert.Equal(t, "error: expected a single config.kubernetes.io/v1 ResourceList on stdin\n", stderr.String())
+
+		stderr.Reset()
+		code = krmCmd(nil, strings.NewReader("apiVersion: example.com/v1\nkind: ResourceList\nitems: []\n"), &stdout, &stderr)
+		assert.Equal(t, 2, code)
+		assert.Equal(t, "error: expected a single config.kubernetes.io/v1 ResourceList on stdin\n", stderr.String())
+	})
+}
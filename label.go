@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+
+	"github.com/maelvls/secret-transform/controller"
+	"github.com/maelvls/secret-transform/transform"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/config"
+)
+
+const labelUsage = `Usage: secret-transform label [--apply] [--context CONTEXT] [-n NAMESPACE]
+
+Adds the label secret-transform.io/enabled=true to the Secrets that have one of
+the secret-transform annotations but not the label, and to the Secrets they
+reference, such as the ones holding a passphrase. Run it before starting the
+controller with --require-enabled-label, which only watches the labelled
+Secrets.
+
+The Secrets of all namespaces are scanned unless -n is given. Without --apply,
+only prints what would be changed.
+`
+
+// labelCmd implements "secret-transform label". Returns the exit code.
+func labelCmd(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("label", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() { fmt.Fprint(stderr, labelUsage) }
+	apply := fs.Bool("apply", false, "apply the changes instead of printing them")
+	kubeContext := fs.String("context", "", "the kubeconfig context to use")
+	namespace := fs.String("n", "", "only label the Secrets of this namespace")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() > 0 {
+		fs.Usage()
+		return 2
+	}
+
+	cfg, err := config.GetConfigWithContext(*kubeContext)
+	if err != nil {
+		fmt.Fprintf(stderr, "error: %v\n", err)
+		return 2
+	}
+	cl, err := client.New(cfg, client.Options{})
+	if err != nil {
+		fmt.Fprintf(stderr, "error: %v\n", err)
+		return 2
+	}
+	if err := labelCluster(context.Background(), stdout, cl, *namespace, *apply); err != nil {
+		fmt.Fprintf(stderr, "error: %v\n", err)
+		return 2
+	}
+	return 0
+}
+
+func labelCluster(ctx context.Context, w io.Writer, cl client.Client, namespace string, apply bool) error {
+	secrets := &corev1.SecretList{}
+	err := cl.List(ctx, secrets, client.InNamespace(namespace))
+	if err != nil {
+		return fmt.Errorf("while listing Secrets: %w", err)
+	}
+
+	// The Secrets referenced by the annotated ones, such as the ones holding
+	// a passphrase, must be watched too for their changes to be noticed.
+	referencedBy := make(map[string]string)
+	for _, secret := range secrets.Items {
+		if !controller.ShouldReconcileSecret(secret.Annotations) {
+			continue
+		}
+		for _, ref := range transform.References(secret.Annotations) {
+			if _, found := referencedBy[secret.Namespace+"/"+ref]; !found {
+				referencedBy[secret.Namespace+"/"+ref] = secret.Namespace + "/" + secret.Name
+			}
+		}
+	}
+
+	for i := range secrets.Items {
+		secret := &secrets.Items[i]
+		name := secret.Namespace + "/" + secret.Name
+
+		annotated := controller.ShouldReconcileSecret(secret.Annotations)
+		referencer, referenced := referencedBy[name]
+		if (!annotated && !referenced) || secret.Labels[controller.EnabledLabelKey] == "true" {
+			continue
+		}
+		if annotated {
+			fmt.Fprintf(w, "%s: added the label %s=true\n", name, controller.EnabledLabelKey)
+		} else {
+			fmt.Fprintf(w, "%s: added the label %s=true, referenced by %s\n", name, controller.EnabledLabelKey, referencer)
+		}
+		if !apply {
+			continue
+		}
+
+		patch := client.MergeFrom(secret.DeepCopy())
+		if secret.Labels == nil {
+			secret.Labels = make(map[string]string)
+		}
+		secret.Labels[controller.EnabledLabelKey] = "true"
+		if err := cl.Patch(ctx, secret, patch); err != nil {
+			return fmt.Errorf("while patching Secret %s: %w", name, err)
+		}
+	}
+
+	if !apply {
+		fmt.Fprintf(w, "Dry run, nothing was changed. Run again with --apply to apply the changes.\n")
+	}
+	return nil
+}
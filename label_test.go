@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestLabelCluster(t *testing.T) {
+	given := []*corev1.Secret{
+		{ObjectMeta: metav1.ObjectMeta{Name: "annotated", Namespace: "default", Annotations: map[string]string{
+			"secret-transform/secret-copy-ca.crt": "ca",
+		}}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "already-labelled", Namespace: "default", Annotations: map[string]string{
+			"secret-transform/secret-copy-ca.crt": "ca",
+		}, Labels: map[string]string{"secret-transform.io/enabled": "true"}}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "not-annotated", Namespace: "default"}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "encrypted", Namespace: "default", Annotations: map[string]string{
+			"secret-transform/encrypted-key":                   "tls-encrypted.key",
+			"secret-transform/encrypted-key-passphrase-secret": "passphrase",
+		}, Labels: map[string]string{"secret-transform.io/enabled": "true"}}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "passphrase", Namespace: "default"}},
+	}
+	newClient := func() client.Client {
+		b := fake.NewClientBuilder()
+		for _, s := range given {
+			b = b.WithObjects(s.DeepCopy())
+		}
+		return b.Build()
+	}
+
+	t.Run("dry run", func(t *testing.T) {
+		cl := newClient()
+		var out bytes.Buffer
+
+		err := labelCluster(t.Context(), &out, cl, "", false)
+		require.NoError(t, err)
+		assert.Equal(t, `default/annotated: added the label secret-transform.io/enabled=true
+default/passphrase: added the label secret-transform.io/enabled=true, referenced by default/encrypted
+Dry run, nothing was changed. Run again with --apply to apply the changes.
+`, out.String())
+
+		got := &corev1.Secret{}
+		require.NoError(t, cl.Get(t.Context(), types.NamespacedName{Namespace: "default", Name: "annotated"}, got))
+		assert.Empty(t, got.Labels)
+	})
+
+	t.Run("apply", func(t *testing.T) {
+		cl := newClient()
+		var out bytes.Buffer
+
+		err := labelCluster(t.Context(), &out, cl, "", true)
+		require.NoError(t, err)
+
+		got := &corev1.Secret{}
+		require.NoError(t, cl.Get(t.Context(), types.NamespacedName{Namespace: "default", Name: "annotated"}, got))
+		assert.Equal(t, map[string]string{"secret-transform.io/enabled": "true"}, got.Labels)
+
+		require.NoError(t, cl.Get(t.Context(), types.NamespacedName{Namespace: "default", Name: "passphrase"}, got))
+		assert.Equal(t, map[string]string{"secret-transform.io/enabled": "true"}, got.Labels)
+
+		require.NoError(t, cl.Get(t.Context(), types.NamespacedName{Namespace: "default", Name: "not-annotated"}, got))
+		assert.Empty(t, got.Labels)
+	})
+}
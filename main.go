@@ -1,34 +1,86 @@
 package main
 
 import (
+	"errors"
+	"flag"
+	"fmt"
 	"os"
 
+	"github.com/maelvls/secret-transform/controller"
+	"github.com/maelvls/secret-transform/sds"
+	"github.com/maelvls/secret-transform/transform"
 	_ "k8s.io/client-go/plugin/pkg/client/auth/gcp"
 	"sigs.k8s.io/controller-runtime/pkg/client/config"
 	"sigs.k8s.io/controller-runtime/pkg/log"
-	"sigs.k8s.io/controller-runtime/pkg/log/zap"
 	"sigs.k8s.io/controller-runtime/pkg/manager"
 	"sigs.k8s.io/controller-runtime/pkg/manager/signals"
 )
 
-func init() {
-	log.SetLogger(zap.New())
-}
-
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "render":
+			os.Exit(renderCmd(os.Args[2:], os.Stdin, os.Stdout, os.Stderr))
+		case "krm":
+			os.Exit(krmCmd(os.Args[2:], os.Stdin, os.Stdout, os.Stderr))
+		case "diagnose":
+			os.Exit(diagnoseCmd(os.Args[2:], os.Stdout, os.Stderr))
+		case "migrate":
+			os.Exit(migrateCmd(os.Args[2:], os.Stdout, os.Stderr))
+		case "label":
+			os.Exit(labelCmd(os.Args[2:], os.Stdout, os.Stderr))
+		case "agent":
+			os.Exit(agentCmd(os.Args[2:], os.Stdout, os.Stderr))
+		}
+	}
+
+	cfg, err := loadControllerConfig(os.Args[1:], os.Stderr)
+	switch {
+	case errors.Is(err, flag.ErrHelp):
+		os.Exit(0)
+	case err != nil:
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(2)
+	}
+
+	log.SetLogger(cfg.logger())
+	transform.SetSystemRootsFile(cfg.SystemRoots.File, cfg.SystemRoots.Version)
 	log := log.Log.WithName("secret-transform")
 
-	mgr, err := manager.New(config.GetConfigOrDie(), manager.Options{})
+	mgr, err := manager.New(config.GetConfigOrDie(), cfg.managerOptions())
 	if err != nil {
 		log.Error(err, "unable to set up overall controller manager")
 		os.Exit(1)
 	}
 
-	if err := setupReconciler(mgr); err != nil {
+	opts := cfg.controllerOptions()
+	if cfg.SDSBindAddress != "0" {
+		// Unlike the reconciler, the SDS server runs on every replica and is
+		// fed from the informer cache.
+		err := sds.NewServer().SetupWithManager(mgr, cfg.SDSBindAddress, cfg.SDSTLS.files())
+		if err != nil {
+			log.Error(err, "problem setting up the SDS server")
+			os.Exit(1)
+		}
+	}
+
+	if err := controller.SetupWithManager(mgr, opts); err != nil {
 		log.Error(err, "problem setting up controller")
 		os.Exit(1)
 	}
 
+	if cfg.TrustBundles {
+		if err := controller.SetupTrustBundleWithManager(mgr); err != nil {
+			log.Error(err, "problem setting up the trust bundle controller")
+			os.Exit(1)
+		}
+	}
+
+	if err := addHealthChecks(mgr); err != nil {
+		log.Error(err, "problem setting up the health checks")
+		os.Exit(1)
+	}
+
 	log.Info("starting manager")
 	if err := mgr.Start(signals.SetupSignalHandler()); err != nil {
 		log.Error(err, "unable to run manager")
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+
+	"github.com/maelvls/secret-transform/transform"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/yaml"
+)
+
+// Reads a stream of YAML or JSON documents. Empty documents are skipped.
+func decodeManifests(r io.Reader) ([]*unstructured.Unstructured, error) {
+	dec := yaml.NewYAMLOrJSONDecoder(r, 4096)
+
+	var objs []*unstructured.Unstructured
+	for {
+		obj := map[string]any{}
+		err := dec.Decode(&obj)
+		if errors.Is(err, io.EOF) {
+			return objs, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(obj) == 0 {
+			continue
+		}
+		objs = append(objs, &unstructured.Unstructured{Object: obj})
+	}
+}
+
+func isSecret(obj *unstructured.Unstructured) bool {
+	return obj.GetAPIVersion() == "v1" && obj.GetKind() == "Secret"
+}
+
+// Converts an unstructured Secret into a corev1.Secret. Like the API server
+// does, the contents of stringData are merged into data.
+func secretFromUnstructured(obj *unstructured.Unstructured) (*corev1.Secret, error) {
+	secret := &corev1.Secret{}
+	err := runtime.DefaultUnstructuredConverter.FromUnstructured(obj.Object, secret)
+	if err != nil {
+		return nil, fmt.Errorf("while decoding Secret %s: %w", secretName(obj), err)
+	}
+
+	if secret.Data == nil {
+		secret.Data = make(map[string][]byte)
+	}
+	for k, v := range secret.StringData {
+		secret.Data[k] = []byte(v)
+	}
+	secret.StringData = nil
+
+	return secret, nil
+}
+
+// Returns a copy of the given unstructured Secret with its data replaced with
+// the data of the given Secret. The annotations are only replaced when a
+// transformer changed them. The rest of the manifest is left untouched so that
+// the output stays close to what the user wrote.
+func withSecretData(obj *unstructured.Unstructured, secret *corev1.Secret) *unstructured.Unstructured {
+	out := obj.DeepCopy()
+	delete(out.Object, "stringData")
+	if !reflect.DeepEqual(obj.GetAnnotations(), secret.Annotations) {
+		out.SetAnnotations(secret.Annotations)
+	}
+
+	// DefaultUnstructuredConverter base64-encodes []byte values, which is
+	// what the "data" field expects.
+	converted, err := runtime.DefaultUnstructuredConverter.ToUnstructured(&corev1.Secret{Data: secret.Data})
+	if err == nil && converted["data"] != nil {
+		out.Object["data"] = converted["data"]
+	}
+	return out
+}
+
+// Applies the transforms to the given Secret manifest. When the transforms
+// change the Secret, both returned manifests have their stringData merged
+// into data: `in` is the manifest before the transforms, `out` after.
+// Otherwise, both are the given manifest, untouched, so that the Secrets
+// without annotations or already up to date don't show up in a diff. Like the
+// controller, none of the changes are kept when one of the transformers fails;
+// the returned Warning events explain why. An error is only returned when the
+// manifest isn't a valid Secret. The Secrets referenced by the transformers,
+// such as the ones holding a passphrase, are looked up in `all`.
+func transformManifest(obj *unstructured.Unstructured, all []*unstructured.Unstructured) (in, out *unstructured.Unstructured, events []transform.Event, err error) {
+	secret, err := secretFromUnstructured(obj)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	before := secret.DeepCopy()
+
+	events, err = transform.ApplyWithSecrets(secret, manifestSecretGetter(all, obj.GetNamespace()))
+	if err != nil || (reflect.DeepEqual(before.Data, secret.Data) && reflect.DeepEqual(before.Annotations, secret.Annotations)) {
+		return obj, obj, events, nil
+	}
+
+	return withSecretData(obj, before), withSecretData(obj, secret), events, nil
+}
+
+func secretName(obj *unstructured.Unstructured) string {
+	if obj.GetNamespace() == "" {
+		return obj.GetName()
+	}
+	return obj.GetNamespace() + "/" + obj.GetName()
+}
+
+// Returns a SecretGetter that looks up the Secrets of the given namespace
+// among the given manifests.
+func manifestSecretGetter(objs []*unstructured.Unstructured, namespace string) transform.SecretGetter {
+	return func(name string) (map[string][]byte, error) {
+		for _, obj := range objs {
+			if !isSecret(obj) || obj.GetNamespace() != namespace || obj.GetName() != name {
+				continue
+			}
+			secret, err := secretFromUnstructured(obj)
+			if err != nil {
+				return nil, err
+			}
+			return secret.Data, nil
+		}
+		return nil, fmt.Errorf("the Secret '%s' isn't part of the input manifests", name)
+	}
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/maelvls/secret-transform/transform"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/config"
+)
+
+const migrateUsage = `Usage: secret-transform migrate [--apply] [--context CONTEXT] [-n NAMESPACE]
+       secret-transform migrate [--apply] FILE...
+
+Rewrites the legacy cert-manager.io/secret-* annotations into their
+secret-transform/* equivalents.
+
+When no file is given, the Secrets of the cluster are scanned (all namespaces
+unless -n is given). When files are given, the annotations are rewritten in
+the files, leaving the rest of the files untouched.
+
+Without --apply, only prints what would be changed.
+`
+
+// migrateCmd implements "secret-transform migrate". Returns the exit code.
+func migrateCmd(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() { fmt.Fprint(stderr, migrateUsage) }
+	apply := fs.Bool("apply", false, "apply the changes instead of printing them")
+	kubeContext := fs.String("context", "", "the kubeconfig context to use")
+	namespace := fs.String("n", "", "only migrate the Secrets of this namespace")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	if fs.NArg() > 0 {
+		for _, file := range fs.Args() {
+			if err := migrateFile(stdout, file, *apply); err != nil {
+				fmt.Fprintf(stderr, "error: %v\n", err)
+				return 2
+			}
+		}
+		if !*apply {
+			fmt.Fprintf(stdout, "Dry run, nothing was changed. Run again with --apply to apply the changes.\n")
+		}
+		return 0
+	}
+
+	cfg, err := config.GetConfigWithContext(*kubeContext)
+	if err != nil {
+		fmt.Fprintf(stderr, "error: %v\n", err)
+		return 2
+	}
+	cl, err := client.New(cfg, client.Options{})
+	if err != nil {
+		fmt.Fprintf(stderr, "error: %v\n", err)
+		return 2
+	}
+	if err := migrateCluster(context.Background(), stdout, cl, *namespace, *apply); err != nil {
+		fmt.Fprintf(stderr, "error: %v\n", err)
+		return 2
+	}
+	return 0
+}
+
+func migrateCluster(ctx context.Context, w io.Writer, cl client.Client, namespace string, apply bool) error {
+	secrets := &corev1.SecretList{}
+	err := cl.List(ctx, secrets, client.InNamespace(namespace))
+	if err != nil {
+		return fmt.Errorf("while listing Secrets: %w", err)
+	}
+
+	for i := range secrets.Items {
+		secret := &secrets.Items[i]
+		name := secret.Namespace + "/" + secret.Name
+
+		migrated, changes := migrateAnnotations(secret.Annotations)
+		if len(changes) == 0 {
+			continue
+		}
+		for _, change := range changes {
+			fmt.Fprintf(w, "%s: %s\n", name, change)
+		}
+		if !apply {
+			continue
+		}
+
+		patch := client.MergeFrom(secret.DeepCopy())
+		secret.Annotations = migrated
+		if err := cl.Patch(ctx, secret, patch); err != nil {
+			return fmt.Errorf("while patching Secret %s: %w", name, err)
+		}
+	}
+
+	if !apply {
+		fmt.Fprintf(w, "Dry run, nothing was changed. Run again with --apply to apply the changes.\n")
+	}
+	return nil
+}
+
+// Returns a copy of the annotations in which the legacy annotations are
+// replaced with their secret-transform/* equivalents, along with a description
+// of each change. When both the legacy annotation and its replacement are
+// present, the replacement wins and the legacy annotation is removed.
+func migrateAnnotations(annots map[string]string) (map[string]string, []string) {
+	legacy := transform.LegacyAnnotations(annots)
+	if len(legacy) == 0 {
+		return annots, nil
+	}
+
+	migrated := make(map[string]string, len(annots))
+	for k, v := range annots {
+		migrated[k] = v
+	}
+
+	var changes []string
+	for _, old := range legacy {
+		replacement, _ := transform.IsLegacyAnnotation(old)
+		delete(migrated, old)
+
+		if existing := annots[replacement]; existing != "" {
+			if existing != annots[old] {
+				changes = append(changes, fmt.Sprintf("removed %s=%s, keeping %s=%s", old, annots[old], replacement, existing))
+			} else {
+				changes = append(changes, fmt.Sprintf("removed %s, already set as %s", old, replacement))
+			}
+			continue
+		}
+
+		migrated[replacement] = annots[old]
+		changes = append(changes, fmt.Sprintf("renamed %s to %s", old, replacement))
+	}
+	return migrated, changes
+}
+
+// Rewrites the legacy annotation keys found in the file. The file is edited as
+// text so that comments and formatting are kept.
+func migrateFile(w io.Writer, file string, apply bool) error {
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+
+	migrated, changes := migrateText(string(content))
+	for _, change := range changes {
+		fmt.Fprintf(w, "%s: %s\n", file, change)
+	}
+	if len(changes) == 0 || !apply {
+		return nil
+	}
+
+	info, err := os.Stat(file)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(file, []byte(migrated), info.Mode())
+}
+
+// The suffixes after which a legacy annotation key is taken to be a YAML or
+// JSON key, i.e., a colon or a closing quote and a colon.
+var keySuffixes = []string{":", `":`, `" :`, `':`}
+
+// Replaces the legacy annotation keys, as long as they appear as YAML or JSON
+// keys. Like in migrateAnnotations, when a document already has the
+// replacement key, the legacy key is removed instead of being renamed, which
+// would give a duplicate key.
+func migrateText(content string) (string, []string) {
+	var changes []string
+	docs := splitDocuments(content)
+	for _, old := range transform.LegacyAnnotationKeys() {
+		replacement, _ := transform.IsLegacyAnnotation(old)
+		renamed, removed := 0, 0
+		for i, doc := range docs {
+			if hasKey(doc, replacement) {
+				var count int
+				docs[i], count = removeKey(doc, old)
+				removed += count
+				continue
+			}
+			for _, suffix := range keySuffixes {
+				renamed += strings.Count(doc, old+suffix)
+				doc = strings.ReplaceAll(doc, old+suffix, replacement+suffix)
+			}
+			docs[i] = doc
+		}
+		if renamed > 0 {
+			changes = append(changes, fmt.Sprintf("renamed %s to %s (%d occurrences)", old, replacement, renamed))
+		}
+		if removed > 0 {
+			changes = append(changes, fmt.Sprintf("removed %s, already set as %s (%d occurrences)", old, replacement, removed))
+		}
+	}
+	return strings.Join(docs, ""), changes
+}
+
+// Splits a multi-document YAML file into its documents. Each document keeps
+// its trailing "---" separator so that joining them gives the file back.
+func splitDocuments(content string) []string {
+	var docs []string
+	var doc strings.Builder
+	for _, line := range strings.SplitAfter(content, "\n") {
+		doc.WriteString(line)
+		if strings.TrimRight(line, " \r\n") == "---" {
+			docs = append(docs, doc.String())
+			doc.Reset()
+		}
+	}
+	return append(docs, doc.String())
+}
+
+func hasKey(doc, key string) bool {
+	for _, suffix := range keySuffixes {
+		if strings.Contains(doc, key+suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Removes the lines on which the given key appears, along with the lines of
+// its value when it is a YAML block scalar. Returns the number of keys
+// removed.
+func removeKey(doc, key string) (string, int) {
+	lines := strings.SplitAfter(doc, "\n")
+	var kept []string
+	count := 0
+	for i := 0; i < len(lines); i++ {
+		line := lines[i]
+		if !hasKey(line, key) {
+			kept = append(kept, line)
+			continue
+		}
+		count++
+
+		// The lines that are more indented than the key belong to its value.
+		indent := len(line) - len(strings.TrimLeft(line, " "))
+		for i+1 < len(lines) && strings.TrimSpace(lines[i+1]) != "" && len(lines[i+1])-len(strings.TrimLeft(lines[i+1], " ")) > indent {
+			i++
+		}
+
+		// In JSON, the key may have been the last of its object, in which
+		// case the comma of the previous entry must go too.
+		if !strings.HasSuffix(strings.TrimSpace(line), ",") && len(kept) > 0 {
+			prev := kept[len(kept)-1]
+			if trimmed := strings.TrimRight(prev, " \r\n"); strings.HasSuffix(trimmed, ",") && strings.HasPrefix(strings.TrimSpace(trimmed), `"`) {
+				kept[len(kept)-1] = strings.TrimSuffix(trimmed, ",") + prev[len(trimmed):]
+			}
+		}
+	}
+	return strings.Join(kept, ""), count
+}
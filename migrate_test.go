@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestMigrateAnnotations(t *testing.T) {
+	t.Run("renames the legacy annotations", func(t *testing.T) {
+		got, changes := migrateAnnotations(map[string]string{
+			"cert-manager.io/secret-transform": "tls.pem",
+			"cert-manager.io/issuer-name":      "foo",
+		})
+		assert.Equal(t, map[string]string{
+			"secret-transform/secret-transform": "tls.pem",
+			"cert-manager.io/issuer-name":       "foo",
+		}, got)
+		assert.Equal(t, []string{"renamed cert-manager.io/secret-transform to secret-transform/secret-transform"}, changes)
+	})
+
+	t.Run("the existing secret-transform annotation wins", func(t *testing.T) {
+		got, changes := migrateAnnotations(map[string]string{
+			"cert-manager.io/secret-copy-ca.crt":  "ca",
+			"secret-transform/secret-copy-ca.crt": "caFile",
+		})
+		assert.Equal(t, map[string]string{"secret-transform/secret-copy-ca.crt": "caFile"}, got)
+		assert.Equal(t, []string{"removed cert-manager.io/secret-copy-ca.crt=ca, keeping secret-transform/secret-copy-ca.crt=caFile"}, changes)
+	})
+
+	t.Run("nothing to do", func(t *testing.T) {
+		_, changes := migrateAnnotations(map[string]string{"secret-transform/secret-copy-ca.crt": "ca"})
+		assert.Empty(t, changes)
+	})
+}
+
+func TestMigrateText(t *testing.T) {
+	got, changes := migrateText(`kind: Secret
+metadata:
+  annotations:
+    # Keep me.
+    cert-manager.io/secret-copy-tls.crt: cert
+    "cert-manager.io/secret-copy-tls.key": key
+    cert-manager.io/issuer-name: foo
+`)
+	assert.Equal(t, `kind: Secret
+metadata:
+  annotations:
+    # Keep me.
+    secret-transform/secret-copy-tls.crt: cert
+    "secret-transform/secret-copy-tls.key": key
+    cert-manager.io/issuer-name: foo
+`, got)
+	assert.Equal(t, []string{
+		"renamed cert-manager.io/secret-copy-tls.crt to secret-transform/secret-copy-tls.crt (1 occurrences)",
+		"renamed cert-manager.io/secret-copy-tls.key to secret-transform/secret-copy-tls.key (1 occurrences)",
+	}, changes)
+}
+
+func TestMigrateText_replacementAlreadyPresent(t *testing.T) {
+	t.Run("yaml", func(t *testing.T) {
+		got, changes := migrateText(`kind: Secret
+metadata:
+  annotations:
+    cert-manager.io/secret-copy-ca.crt: ca
+    secret-transform/secret-copy-ca.crt: ca
+---
+kind: Secret
+metadata:
+  annotations:
+    cert-manager.io/secret-copy-ca.crt: ca
+`)
+		assert.Equal(t, `kind: Secret
+metadata:
+  annotations:
+    secret-transform/secret-copy-ca.crt: ca
+---
+kind: Secret
+metadata:
+  annotations:
+    secret-transform/secret-copy-ca.crt: ca
+`, got)
+		assert.Equal(t, []string{
+			"renamed cert-manager.io/secret-copy-ca.crt to secret-transform/secret-copy-ca.crt (1 occurrences)",
+			"removed cert-manager.io/secret-copy-ca.crt, already set as secret-transform/secret-copy-ca.crt (1 occurrences)",
+		}, changes)
+	})
+
+	t.Run("json", func(t *testing.T) {
+		got, _ := migrateText(`{
+  "kind": "Secret",
+  "metadata": {
+    "annotations": {
+      "secret-transform/secret-copy-ca.crt": "ca",
+      "cert-manager.io/secret-copy-ca.crt": "ca"
+    }
+  }
+}
+`)
+		assert.Equal(t, `{
+  "kind": "Secret",
+  "metadata": {
+    "annotations": {
+      "secret-transform/secret-copy-ca.crt": "ca"
+    }
+  }
+}
+`, got)
+	})
+}
+
+func TestMigrateCluster(t *testing.T) {
+	given := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "cert-1", Namespace: "default", Annotations: map[string]string{
+		"cert-manager.io/secret-copy-ca.crt": "ca",
+	}}}
+
+	t.Run("dry run", func(t *testing.T) {
+		cl := fake.NewClientBuilder().WithObjects(given.DeepCopy()).Build()
+		var out bytes.Buffer
+
+		err := migrateCluster(t.Context(), &out, cl, "", false)
+		require.NoError(t, err)
+		assert.Equal(t, `default/cert-1: renamed cert-manager.io/secret-copy-ca.crt to secret-transform/secret-copy-ca.crt
+Dry run, nothing was changed. Run again with --apply to apply the changes.
+`, out.String())
+
+		got := &corev1.Secret{}
+		require.NoError(t, cl.Get(t.Context(), types.NamespacedName{Namespace: "default", Name: "cert-1"}, got))
+		assert.Equal(t, given.Annotations, got.Annotations)
+	})
+
+	t.Run("apply", func(t *testing.T) {
+		cl := fake.NewClientBuilder().WithObjects(given.DeepCopy()).Build()
+		var out bytes.Buffer
+
+		err := migrateCluster(t.Context(), &out, cl, "", true)
+		require.NoError(t, err)
+
+		got := &corev1.Secret{}
+		require.NoError(t, cl.Get(t.Context(), types.NamespacedName{Namespace: "default", Name: "cert-1"}, got))
+		assert.Equal(t, map[string]string{"secret-transform/secret-copy-ca.crt": "ca"}, got.Annotations)
+	})
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/maelvls/secret-transform/transform"
+	"github.com/pmezard/go-difflib/difflib"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"sigs.k8s.io/yaml"
+)
+
+const renderUsage = `Usage: secret-transform render [--diff] [FILE...]
+
+Applies the secret-transform annotations to the Secrets found in the given
+files, without talking to a cluster. The files may contain multiple YAML or
+JSON documents. When no file is given or when FILE is "-", reads from stdin.
+Documents that aren't Secrets, and the Secrets that the transforms don't
+change, are printed unchanged.
+
+Exits with 1 when one of the Secrets would have gotten a Warning event.
+`
+
+// renderCmd implements "secret-transform render". Returns the exit code.
+func renderCmd(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("render", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() { fmt.Fprint(stderr, renderUsage) }
+	diff := fs.Bool("diff", false, "print a unified diff instead of the resulting manifests")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	files := fs.Args()
+	if len(files) == 0 {
+		files = []string{"-"}
+	}
+
+	var objs []*unstructured.Unstructured
+	for _, file := range files {
+		r := stdin
+		if file != "-" {
+			f, err := os.Open(file)
+			if err != nil {
+				fmt.Fprintf(stderr, "error: %v\n", err)
+				return 2
+			}
+			defer f.Close()
+			r = f
+		}
+
+		decoded, err := decodeManifests(r)
+		if err != nil {
+			fmt.Fprintf(stderr, "error: while reading %s: %v\n", file, err)
+			return 2
+		}
+		objs = append(objs, decoded...)
+	}
+
+	failed := false
+	for i, obj := range objs {
+		in, out := obj, obj
+		if isSecret(obj) {
+			var events []transform.Event
+			var err error
+			in, out, events, err = transformManifest(obj, objs)
+			if err != nil {
+				fmt.Fprintf(stderr, "error: %v\n", err)
+				return 2
+			}
+			for _, e := range events {
+				if e.Type == corev1.EventTypeWarning {
+					failed = true
+					fmt.Fprintf(stderr, "%s: %s %s: %s\n", secretName(obj), e.Type, e.Reason, e.Message)
+				}
+			}
+		}
+
+		if *diff {
+			if err := printDiff(stdout, in, out); err != nil {
+				fmt.Fprintf(stderr, "error: %v\n", err)
+				return 2
+			}
+			continue
+		}
+
+		if i > 0 {
+			fmt.Fprintln(stdout, "---")
+		}
+		data, err := yaml.Marshal(out.Object)
+		if err != nil {
+			fmt.Fprintf(stderr, "error: %v\n", err)
+			return 2
+		}
+		stdout.Write(data)
+	}
+
+	if failed {
+		return 1
+	}
+	return 0
+}
+
+// Prints a unified diff between the two manifests. Nothing is printed when
+// they are identical.
+func printDiff(w io.Writer, before, after *unstructured.Unstructured) error {
+	a, err := yaml.Marshal(before.Object)
+	if err != nil {
+		return err
+	}
+	b, err := yaml.Marshal(after.Object)
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(a, b) {
+		return nil
+	}
+
+	name := after.GetKind() + "/" + secretName(after)
+	return difflib.WriteUnifiedDiff(w, difflib.UnifiedDiff{
+		A:        difflib.SplitLines(string(a)),
+		B:        difflib.SplitLines(string(b)),
+		FromFile: name,
+		ToFile:   name,
+		Context:  3,
+	})
+}
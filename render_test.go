@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRenderCmd(t *testing.T) {
+	t.Run("transforms the Secrets and leaves the rest untouched", func(t *testing.T) {
+		stdin := strings.NewReader(`
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: unrelated
+data:
+  foo: bar
+---
+apiVersion: v1
+kind: Secret
+metadata:
+  name: cert-1
+  namespace: default
+  annotations:
+    secret-transform/secret-copy-tls.crt: cert
+stringData:
+  tls.crt: fakeCrt
+`)
+		var stdout, stderr bytes.Buffer
+
+		code := renderCmd(nil, stdin, &stdout, &stderr)
+
+		assert.Equal(t, 0, code)
+		assert.Empty(t, stderr.String())
+		assert.Equal(t, `apiVersion: v1
+data:
+  foo: bar
+kind: ConfigMap
+metadata:
+  name: unrelated
+---
+apiVersion: v1
+data:
+  cert: ZmFrZUNydA==
+  tls.crt: ZmFrZUNydA==
+kind: Secret
+metadata:
+  annotations:
+    secret-transform/secret-copy-tls.crt: cert
+  name: cert-1
+  namespace: default
+`, stdout.String())
+	})
+
+	t.Run("the Secrets that aren't changed are printed as they were written", func(t *testing.T) {
+		stdin := strings.NewReader(`
+apiVersion: v1
+kind: Secret
+metadata:
+  name: plain
+stringData:
+  password: hunter2
+---
+apiVersion: v1
+kind: Secret
+metadata:
+  name: cert-1
+  annotations:
+    secret-transform/secret-copy-tls.crt: cert
+stringData:
+  tls.crt: fakeCrt
+  cert: fakeCrt
+`)
+		var stdout, stderr bytes.Buffer
+
+		code := renderCmd(nil, stdin, &stdout, &stderr)
+
+		assert.Equal(t, 0, code)
+		assert.Empty(t, stderr.String())
+		assert.Equal(t, `apiVersion: v1
+kind: Secret
+metadata:
+  name: plain
+stringData:
+  password: hunter2
+---
+apiVersion: v1
+kind: Secret
+metadata:
+  annotations:
+    secret-transform/secret-copy-tls.crt: cert
+  name: cert-1
+stringData:
+  cert: fakeCrt
+  tls.crt: fakeCrt
+`, stdout.String())
+	})
+
+	t.Run("--diff only shows the changes made by the transforms", func(t *testing.T) {
+		stdin := strings.NewReader(`{"apiVersion": "v1", "kind": "Secret", "metadata": {"name": "cert-1", "annotations": {"secret-transform/secret-copy-tls.crt": "cert"}}, "data": {"tls.crt": "ZmFrZUNydA=="}}`)
+		var stdout, stderr bytes.Buffer
+
+		code := renderCmd([]string{"--diff"}, stdin, &stdout, &stderr)
+
+		assert.Equal(t, 0, code)
+		assert.Equal(t, `--- Secret/cert-1
++++ Secret/cert-1
+@@ -1,5 +1,6 @@
+ apiVersion: v1
+ data:
++  cert: ZmFrZUNydA==
+   tls.crt: ZmFrZUNydA==
+ kind: Secret
+ metadata:
+`, stdout.String())
+	})
+
+	t.Run("exits with 1 on Warning events", func(t *testing.T) {
+		stdin := strings.NewReader(`
+apiVersion: v1
+kind: Secret
+metadata:
+  name: cert-1
+  namespace: default
+  annotations:
+    secret-transform/secret-copy-ca.crt: ca
+`)
+		var stdout, stderr bytes.Buffer
+
+		code := renderCmd(nil, stdin, &stdout, &stderr)
+
+		assert.Equal(t, 1, code)
+		assert.Equal(t, `default/cert-1: Warning FailedCopying: annot 'secret-transform/secret-copy-ca.crt': the key "ca.crt" does not exist`+"\n", stderr.String())
+	})
+
+	t.Run("the referenced Secrets are looked up in the input manifests", func(t *testing.T) {
+		_, key := selfSigned(t, time.Now(), time.Now().Add(time.Hour))
+		manifest := fmt.Sprintf(`
+apiVersion: v1
+kind: Secret
+metadata:
+  name: cert-1
+  namespace: default
+  annotations:
+    secret-transform/encrypted-key: tls-encrypted.key
+    secret-transform/encrypted-key-passphrase-secret: passphrase
+stringData:
+  tls.key: %q
+`, key)
+		passphrase := `
+---
+apiVersion: v1
+kind: Secret
+metadata:
+  name: passphrase
+  namespace: default
+stringData:
+  passphrase: s3cr3t
+`
+
+		var stdout, stderr bytes.Buffer
+		code := renderCmd(nil, strings.NewReader(manifest+passphrase), &stdout, &stderr)
+		assert.Equal(t, 0, code)
+		assert.Empty(t, stderr.String())
+		assert.Contains(t, stdout.String(), "tls-encrypted.key: ")
+
+		stdout.Reset()
+		code = renderCmd(nil, strings.NewReader(manifest), &stdout, &stderr)
+		assert.Equal(t, 1, code)
+		assert.Equal(t, "default/cert-1: Warning FailedEncryptingKey: annot 'secret-transform/encrypted-key-passphrase-secret': while reading the passphrase: the Secret 'passphrase' isn't part of the input manifests\n", stderr.String())
+	})
+}
@@ -0,0 +1,152 @@
+package sds
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	discoveryv3 "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	serverv3 "github.com/envoyproxy/go-control-plane/pkg/server/v3"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// client is what a client is allowed to fetch.
+type client struct {
+	// The namespace of the Secrets the client can fetch. Empty when the
+	// client can fetch any Secret, i.e., when it didn't connect over TLS,
+	// which is only possible on a Unix socket or a loopback address.
+	namespace string
+
+	// Whether the first request of a delta stream was received.
+	subscribed bool
+}
+
+// authorizer restricts the Secrets the clients can fetch to the ones of the
+// namespace of their SPIFFE ID. The state-of-the-world and the delta streams
+// are numbered separately, hence the two maps.
+type authorizer struct {
+	mu      sync.Mutex
+	streams map[int64]*client
+	deltas  map[int64]*client
+}
+
+func newAuthorizer() serverv3.Callbacks {
+	a := &authorizer{streams: make(map[int64]*client), deltas: make(map[int64]*client)}
+	return serverv3.CallbackFuncs{
+		StreamOpenFunc: func(ctx context.Context, id int64, _ string) error {
+			return a.open(ctx, a.streams, id)
+		},
+		StreamClosedFunc: func(id int64, _ *corev3.Node) { a.close(a.streams, id) },
+		StreamRequestFunc: func(id int64, req *discoveryv3.DiscoveryRequest) error {
+			return a.get(a.streams, id).authorize(req.ResourceNames)
+		},
+		DeltaStreamOpenFunc: func(ctx context.Context, id int64, _ string) error {
+			return a.open(ctx, a.deltas, id)
+		},
+		DeltaStreamClosedFunc: func(id int64, _ *corev3.Node) { a.close(a.deltas, id) },
+		StreamDeltaRequestFunc: func(id int64, req *discoveryv3.DeltaDiscoveryRequest) error {
+			c := a.get(a.deltas, id)
+			if c == nil {
+				return status.Error(codes.Internal, "unknown stream")
+			}
+			// The first request of a delta stream subscribes to all the
+			// resources when it doesn't name any, and the next ones only
+			// change the subscriptions.
+			if !c.subscribed || len(req.ResourceNamesSubscribe) > 0 {
+				c.subscribed = true
+				return c.authorize(req.ResourceNamesSubscribe)
+			}
+			return nil
+		},
+		FetchRequestFunc: func(ctx context.Context, req *discoveryv3.DiscoveryRequest) error {
+			c, err := clientFrom(ctx)
+			if err != nil {
+				return err
+			}
+			return c.authorize(req.ResourceNames)
+		},
+	}
+}
+
+func (a *authorizer) open(ctx context.Context, streams map[int64]*client, id int64) error {
+	c, err := clientFrom(ctx)
+	if err != nil {
+		return err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	streams[id] = c
+	return nil
+}
+
+func (a *authorizer) close(streams map[int64]*client, id int64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(streams, id)
+}
+
+func (a *authorizer) get(streams map[int64]*client, id int64) *client {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return streams[id]
+}
+
+// Returns what the client of the request is allowed to fetch. The clients
+// connected over TLS must have a SPIFFE ID.
+func clientFrom(ctx context.Context) (*client, error) {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return nil, status.Error(codes.Unauthenticated, "unknown client")
+	}
+	info, isTLS := p.AuthInfo.(credentials.TLSInfo)
+	if !isTLS {
+		return &client{}, nil
+	}
+	if len(info.State.VerifiedChains) == 0 || len(info.State.VerifiedChains[0]) == 0 {
+		return nil, status.Error(codes.Unauthenticated, "no client certificate")
+	}
+	for _, uri := range info.State.VerifiedChains[0][0].URIs {
+		if ns := spiffeNamespace(uri.Scheme, uri.Path); ns != "" {
+			return &client{namespace: ns}, nil
+		}
+	}
+	return nil, status.Error(codes.Unauthenticated, "the client certificate must have a SPIFFE ID of the form spiffe://<trust-domain>/ns/<namespace>/sa/<service-account>")
+}
+
+// Returns the namespace of a SPIFFE ID of the form
+// spiffe://<trust-domain>/ns/<namespace>/sa/<service-account>, or "" when the
+// ID doesn't have that form.
+func spiffeNamespace(scheme, path string) string {
+	if scheme != "spiffe" {
+		return ""
+	}
+	parts := strings.Split(strings.TrimPrefix(path, "/"), "/")
+	if len(parts) != 4 || parts[0] != "ns" || parts[1] == "" || parts[2] != "sa" || parts[3] == "" {
+		return ""
+	}
+	return parts[1]
+}
+
+// The Secrets must be requested by name since requesting none means
+// requesting all of them.
+func (c *client) authorize(names []string) error {
+	if c == nil {
+		return status.Error(codes.Internal, "unknown stream")
+	}
+	if c.namespace == "" {
+		return nil
+	}
+	if len(names) == 0 {
+		return status.Error(codes.PermissionDenied, "the Secrets must be requested by name")
+	}
+	for _, name := range names {
+		if !strings.HasPrefix(name, c.namespace+"/") {
+			return status.Errorf(codes.PermissionDenied, "the Secret '%s' isn't in the namespace '%s' of the client", name, c.namespace)
+		}
+	}
+	return nil
+}
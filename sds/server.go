@@ -0,0 +1,338 @@
+// Package sds serves the transformed Secrets to Envoy with the Secret
+// Discovery Service (SDS). The Secrets are fed to the server from the informer
+// cache, so that every replica serves them, or by the controller each time it
+// reconciles them; the Envoy proxies watching a Secret get the new version
+// pushed right away.
+//
+// Over TCP, the clients must present a certificate with a SPIFFE ID of the
+// form spiffe://<trust-domain>/ns/<namespace>/sa/<service-account>, and can
+// only fetch the Secrets of that namespace.
+package sds
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"strings"
+
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	tlsv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/transport_sockets/tls/v3"
+	secretservice "github.com/envoyproxy/go-control-plane/envoy/service/secret/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/cache/types"
+	cachev3 "github.com/envoyproxy/go-control-plane/pkg/cache/v3"
+	resourcev3 "github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+	serverv3 "github.com/envoyproxy/go-control-plane/pkg/server/v3"
+	"github.com/maelvls/secret-transform/controller"
+	"github.com/maelvls/secret-transform/transform"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/protobuf/proto"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	toolscache "k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	ctrlclient "sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+)
+
+// CASuffix is appended to the name of the Envoy Secret holding the CA
+// certificate of a Secret. The Envoy Secret holding the certificate chain and
+// the private key is named "<namespace>/<name>".
+const CASuffix = "/ca"
+
+// Server keeps the Envoy Secrets built from the observed Secrets and serves
+// them over SDS.
+type Server struct {
+	cache *cachev3.LinearCache
+
+	// Reads the Secrets holding the passphrases of the encrypted keys. When
+	// nil, the encrypted keys aren't served.
+	reader ctrlclient.Reader
+	rec    record.EventRecorder
+}
+
+var _ controller.SecretObserver = &Server{}
+
+// NewServer returns a Server that doesn't serve any Secret yet.
+func NewServer() *Server {
+	return &Server{cache: cachev3.NewLinearCache(resourcev3.SecretType)}
+}
+
+// Observe updates the Envoy Secrets of the Secret. Only the Secrets annotated
+// with controller.SDSAnnotKey are served; the Envoy Secrets of a Secret whose
+// annotation was removed are removed too.
+func (s *Server) Observe(secret *corev1.Secret) {
+	var resources map[string]*tlsv3.Secret
+	if secret.Annotations[controller.SDSAnnotKey] == "true" {
+		resources = EnvoySecrets(s.decryptKey(secret))
+	}
+	name := secret.Namespace + "/" + secret.Name
+
+	existing := s.cache.GetResources()
+	toUpdate := make(map[string]types.Resource)
+	var toDelete []string
+	for _, n := range []string{name, name + CASuffix} {
+		res, found := resources[n]
+		old, exists := existing[n]
+		switch {
+		case found && (!exists || !proto.Equal(old, res)):
+			toUpdate[n] = res
+		case !found && exists:
+			toDelete = append(toDelete, n)
+		}
+	}
+	if len(toUpdate) == 0 && len(toDelete) == 0 {
+		return
+	}
+	// Only fails when the resources can't be marshaled, which can't happen
+	// with the resources built by EnvoySecrets.
+	_ = s.cache.UpdateResources(toUpdate, toDelete)
+}
+
+// Envoy can't load an encrypted key, so tls.key is decrypted with the
+// passphrase given in transform.TLSKeyPassphraseSecretAnnotKey, like for the
+// transformers. When it can't be, the certificate and the key aren't served
+// and a Warning event is shown on the Secret.
+func (s *Server) decryptKey(secret *corev1.Secret) *corev1.Secret {
+	key, found := secret.Data[corev1.TLSPrivateKeyKey]
+	if !found {
+		return secret
+	}
+	get := func(name string) (map[string][]byte, error) {
+		if s.reader == nil {
+			return nil, fmt.Errorf("the Secrets can't be read")
+		}
+		referenced := &corev1.Secret{}
+		err := s.reader.Get(context.Background(), ctrlclient.ObjectKey{Namespace: secret.Namespace, Name: name}, referenced)
+		return referenced.Data, err
+	}
+	decrypted, err := transform.DecryptedTLSKey(secret, get)
+	if err == nil && bytes.Equal(decrypted, key) {
+		return secret
+	}
+
+	secret = secret.DeepCopy()
+	if err != nil {
+		delete(secret.Data, corev1.TLSPrivateKeyKey)
+		if s.rec != nil {
+			s.rec.Eventf(secret, corev1.EventTypeWarning, "FailedServingKey", "tls.key isn't served over SDS since it can't be decrypted: %v", err)
+		}
+		return secret
+	}
+	secret.Data[corev1.TLSPrivateKeyKey] = decrypted
+	return secret
+}
+
+// Forget removes the Envoy Secrets of the Secret.
+func (s *Server) Forget(namespace, name string) {
+	s.Observe(&corev1.Secret{ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name}})
+}
+
+// EnvoySecrets returns the Envoy Secrets built from the keys tls.crt, tls.key
+// and ca.crt of the Secret, keyed by their name. The certificate chain and the
+// private key are only served when both are present.
+func EnvoySecrets(secret *corev1.Secret) map[string]*tlsv3.Secret {
+	name := secret.Namespace + "/" + secret.Name
+	resources := make(map[string]*tlsv3.Secret)
+
+	crt, key := secret.Data[corev1.TLSCertKey], secret.Data[corev1.TLSPrivateKeyKey]
+	if len(crt) > 0 && len(key) > 0 {
+		resources[name] = &tlsv3.Secret{
+			Name: name,
+			Type: &tlsv3.Secret_TlsCertificate{TlsCertificate: &tlsv3.TlsCertificate{
+				CertificateChain: inline(crt),
+				PrivateKey:       inline(key),
+			}},
+		}
+	}
+
+	if ca := secret.Data["ca.crt"]; len(ca) > 0 {
+		resources[name+CASuffix] = &tlsv3.Secret{
+			Name: name + CASuffix,
+			Type: &tlsv3.Secret_ValidationContext{ValidationContext: &tlsv3.CertificateValidationContext{
+				TrustedCa: inline(ca),
+			}},
+		}
+	}
+	return resources
+}
+
+func inline(data []byte) *corev3.DataSource {
+	return &corev3.DataSource{Specifier: &corev3.DataSource_InlineBytes{InlineBytes: data}}
+}
+
+// Register registers the SDS service on the gRPC server. The streams are
+// closed when the context is done. The clients that connected over TLS can
+// only fetch the Secrets of the namespace of their SPIFFE ID.
+func (s *Server) Register(ctx context.Context, g *grpc.Server) {
+	secretservice.RegisterSecretDiscoveryServiceServer(g, serverv3.NewServer(ctx, s.cache, newAuthorizer()))
+}
+
+// TLSFiles are the PEM files used to serve SDS over mutual TLS. They are read
+// again on each handshake so that their rotation is picked up.
+type TLSFiles struct {
+	CertFile string
+	KeyFile  string
+	// The CA that signs the certificates of the clients.
+	ClientCAFile string
+}
+
+func (f TLSFiles) config() (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(f.CertFile, f.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	ca, err := os.ReadFile(f.ClientCAFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("%s: no certificate found", f.ClientCAFile)
+	}
+	return &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+		NextProtos:   []string{"h2"},
+	}, nil
+}
+
+// ListenAndServe serves SDS on the address until the context is done. The
+// address is either "host:port" or "unix:///path/to/socket". When tlsFiles is
+// nil, the clients aren't authenticated and can fetch any Secret, so the
+// address must be a Unix socket or a loopback address.
+func (s *Server) ListenAndServe(ctx context.Context, addr string, tlsFiles *TLSFiles) error {
+	var opts []grpc.ServerOption
+	if tlsFiles == nil {
+		if err := CheckPlaintextAddress(addr); err != nil {
+			return err
+		}
+	} else {
+		// Fails early when the files are wrong rather than on the first
+		// handshake.
+		if _, err := tlsFiles.config(); err != nil {
+			return fmt.Errorf("while loading the TLS files: %w", err)
+		}
+		opts = append(opts, grpc.Creds(credentials.NewTLS(&tls.Config{
+			MinVersion: tls.VersionTLS12,
+			GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+				return tlsFiles.config()
+			},
+		})))
+	}
+
+	lis, err := Listen(addr)
+	if err != nil {
+		return err
+	}
+
+	g := grpc.NewServer(opts...)
+	s.Register(ctx, g)
+	go func() {
+		<-ctx.Done()
+		g.Stop()
+	}()
+	return g.Serve(lis)
+}
+
+// CheckPlaintextAddress returns an error unless the address is a Unix socket
+// or a loopback address, which are the only addresses on which SDS can be
+// served without TLS.
+func CheckPlaintextAddress(addr string) error {
+	if strings.HasPrefix(addr, "unix://") {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); host == "localhost" || (ip != nil && ip.IsLoopback()) {
+		return nil
+	}
+	return fmt.Errorf("'%s' is neither a Unix socket nor a loopback address, mutual TLS is required", addr)
+}
+
+// SetupWithManager serves SDS on every replica, leader or not, with the
+// Secrets of the informer cache of the Manager.
+func (s *Server) SetupWithManager(mgr manager.Manager, addr string, tlsFiles *TLSFiles) error {
+	s.reader = mgr.GetCache()
+	s.rec = mgr.GetEventRecorderFor("secret-transform")
+	return mgr.Add(&runnable{server: s, cache: mgr.GetCache(), addr: addr, tlsFiles: tlsFiles})
+}
+
+type runnable struct {
+	server   *Server
+	cache    cache.Cache
+	addr     string
+	tlsFiles *TLSFiles
+}
+
+// The followers serve SDS too, so that the Service can route to any replica.
+func (*runnable) NeedLeaderElection() bool { return false }
+
+func (r *runnable) Start(ctx context.Context) error {
+	informer, err := r.cache.GetInformer(ctx, &corev1.Secret{})
+	if err != nil {
+		return fmt.Errorf("while getting the Secret informer: %w", err)
+	}
+	_, err = informer.AddEventHandler(toolscache.ResourceEventHandlerFuncs{
+		AddFunc:    func(obj any) { r.observe(obj) },
+		UpdateFunc: func(_, obj any) { r.observe(obj) },
+		DeleteFunc: func(obj any) {
+			if tombstone, ok := obj.(toolscache.DeletedFinalStateUnknown); ok {
+				obj = tombstone.Obj
+			}
+			if secret, ok := obj.(*corev1.Secret); ok {
+				r.server.Forget(secret.Namespace, secret.Name)
+			}
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("while watching the Secrets: %w", err)
+	}
+	return r.server.ListenAndServe(ctx, r.addr, r.tlsFiles)
+}
+
+// The Secrets whose tls.key is encrypted with the passphrase held by the
+// observed Secret are observed again, so that a passphrase created or rotated
+// after the key is picked up.
+func (r *runnable) observe(obj any) {
+	secret, ok := obj.(*corev1.Secret)
+	if !ok {
+		return
+	}
+	r.server.Observe(secret)
+
+	var secrets corev1.SecretList
+	if err := r.cache.List(context.Background(), &secrets, ctrlclient.InNamespace(secret.Namespace)); err != nil {
+		return
+	}
+	for i := range secrets.Items {
+		s := &secrets.Items[i]
+		if s.Annotations[controller.SDSAnnotKey] == "true" && s.Annotations[transform.TLSKeyPassphraseSecretAnnotKey] == secret.Name {
+			r.server.Observe(s)
+		}
+	}
+}
+
+// Listen listens on the address, which is either "host:port" or
+// "unix:///path/to/socket". A stale socket file is removed.
+func Listen(addr string) (net.Listener, error) {
+	path, isUnix := strings.CutPrefix(addr, "unix://")
+	if !isUnix {
+		return net.Listen("tcp", addr)
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("while removing the stale socket: %w", err)
+	}
+	return net.Listen("unix", path)
+}
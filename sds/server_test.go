@@ -0,0 +1,255 @@
+package sds
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	tlsv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/transport_sockets/tls/v3"
+	discoveryv3 "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	secretservice "github.com/envoyproxy/go-control-plane/envoy/service/secret/v3"
+	resourcev3 "github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func secret(annots map[string]string, data map[string]string) *corev1.Secret {
+	s := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "envoy-tls", Annotations: annots},
+		Data:       make(map[string][]byte),
+	}
+	for k, v := range data {
+		s.Data[k] = []byte(v)
+	}
+	return s
+}
+
+func TestEnvoySecrets(t *testing.T) {
+	resources := EnvoySecrets(secret(nil, map[string]string{"tls.crt": "crt", "tls.key": "key", "ca.crt": "ca"}))
+	require.Len(t, resources, 2)
+	assert.Equal(t, "crt", string(resources["ns/envoy-tls"].GetTlsCertificate().GetCertificateChain().GetInlineBytes()))
+	assert.Equal(t, "key", string(resources["ns/envoy-tls"].GetTlsCertificate().GetPrivateKey().GetInlineBytes()))
+	assert.Equal(t, "ca", string(resources["ns/envoy-tls/ca"].GetValidationContext().GetTrustedCa().GetInlineBytes()))
+
+	resources = EnvoySecrets(secret(nil, map[string]string{"tls.crt": "crt"}))
+	assert.Empty(t, resources, "the certificate is only served along with its key")
+}
+
+func TestServer(t *testing.T) {
+	ctx, cancel := context.WithTimeout(t.Context(), 10*time.Second)
+	defer cancel()
+
+	srv := NewServer()
+	lis := bufconn.Listen(1 << 20)
+	g := grpc.NewServer()
+	srv.Register(ctx, g)
+	go func() { _ = g.Serve(lis) }()
+	defer g.Stop()
+
+	conn, err := grpc.NewClient("passthrough:///bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// The Secret is observed before Envoy asks for it.
+	sdsAnnot := map[string]string{"secret-transform/sds": "true"}
+	srv.Observe(secret(sdsAnnot, map[string]string{"tls.crt": "crt-1", "tls.key": "key-1"}))
+
+	stream, err := secretservice.NewSecretDiscoveryServiceClient(conn).StreamSecrets(ctx)
+	require.NoError(t, err)
+	require.NoError(t, stream.Send(&discoveryv3.DiscoveryRequest{TypeUrl: resourcev3.SecretType, ResourceNames: []string{"ns/envoy-tls"}}))
+
+	recv := func(t *testing.T) (*discoveryv3.DiscoveryResponse, *tlsv3.Secret) {
+		t.Helper()
+		resp, err := stream.Recv()
+		require.NoError(t, err)
+		require.Len(t, resp.Resources, 1)
+		got := &tlsv3.Secret{}
+		require.NoError(t, resp.Resources[0].UnmarshalTo(got))
+		return resp, got
+	}
+	resp, got := recv(t)
+	assert.Equal(t, "ns/envoy-tls", got.Name)
+	assert.Equal(t, "crt-1", string(got.GetTlsCertificate().GetCertificateChain().GetInlineBytes()))
+
+	// Envoy acknowledges the first version, and the next one is pushed as
+	// soon as the Secret is observed again.
+	require.NoError(t, stream.Send(&discoveryv3.DiscoveryRequest{
+		TypeUrl:       resourcev3.SecretType,
+		ResourceNames: []string{"ns/envoy-tls"},
+		VersionInfo:   resp.VersionInfo,
+		ResponseNonce: resp.Nonce,
+	}))
+	srv.Observe(secret(sdsAnnot, map[string]string{"tls.crt": "crt-2", "tls.key": "key-2"}))
+	_, got = recv(t)
+	assert.Equal(t, "crt-2", string(got.GetTlsCertificate().GetCertificateChain().GetInlineBytes()))
+	assert.Equal(t, "key-2", string(got.GetTlsCertificate().GetPrivateKey().GetInlineBytes()))
+}
+
+func TestServerObserve(t *testing.T) {
+	srv := NewServer()
+	data := map[string]string{"tls.crt": "crt", "tls.key": "key", "ca.crt": "ca"}
+
+	srv.Observe(secret(nil, data))
+	assert.Empty(t, srv.cache.GetResources(), "the Secrets without the annotation aren't served")
+
+	srv.Observe(secret(map[string]string{"secret-transform/sds": "true"}, data))
+	assert.Len(t, srv.cache.GetResources(), 2)
+
+	srv.Observe(secret(map[string]string{"secret-transform/sds": "true"}, map[string]string{"ca.crt": "ca"}))
+	assert.Len(t, srv.cache.GetResources(), 1, "the certificate is removed along with its key")
+
+	srv.Forget("ns", "envoy-tls")
+	assert.Empty(t, srv.cache.GetResources())
+}
+
+func TestServerObserveEncryptedKey(t *testing.T) {
+	_, key := newCert(t, nil, nil, &x509.Certificate{Subject: pkix.Name{CommonName: "envoy"}})
+	der, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	encrypted, err := x509.EncryptPEMBlock(rand.Reader, "EC PRIVATE KEY", der, []byte("s3cr3t"), x509.PEMCipherAES256)
+	require.NoError(t, err)
+	data := map[string]string{"tls.crt": "crt", "tls.key": string(pem.EncodeToMemory(encrypted))}
+
+	rec := record.NewFakeRecorder(10)
+	srv := NewServer()
+	srv.reader = fake.NewClientBuilder().WithObjects(&corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "passphrase"},
+		Data:       map[string][]byte{"passphrase": []byte("s3cr3t")},
+	}).Build()
+	srv.rec = rec
+
+	srv.Observe(secret(map[string]string{"secret-transform/sds": "true", "secret-transform/tls-key-passphrase-secret": "passphrase"}, data))
+	got := srv.cache.GetResources()["ns/envoy-tls"].(*tlsv3.Secret)
+	assert.Equal(t, string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})), string(got.GetTlsCertificate().GetPrivateKey().GetInlineBytes()))
+
+	srv.Observe(secret(map[string]string{"secret-transform/sds": "true"}, data))
+	assert.Empty(t, srv.cache.GetResources(), "the key can't be decrypted without passphrase")
+	assert.Equal(t, "Warning FailedServingKey tls.key isn't served over SDS since it can't be decrypted: no passphrase for the encrypted tls.key", <-rec.Events)
+}
+
+func TestServerMutualTLS(t *testing.T) {
+	ctx, cancel := context.WithTimeout(t.Context(), 10*time.Second)
+	defer cancel()
+
+	dir := t.TempDir()
+	ca, caKey := newCert(t, nil, nil, &x509.Certificate{Subject: pkix.Name{CommonName: "ca"}, IsCA: true, BasicConstraintsValid: true, KeyUsage: x509.KeyUsageCertSign})
+	writePEM(t, filepath.Join(dir, "ca.crt"), "CERTIFICATE", ca.Raw)
+	srvCert, srvKey := newCert(t, ca, caKey, &x509.Certificate{Subject: pkix.Name{CommonName: "sds"}, DNSNames: []string{"sds"}, ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}})
+	writePEM(t, filepath.Join(dir, "tls.crt"), "CERTIFICATE", srvCert.Raw)
+	srvKeyDER, err := x509.MarshalPKCS8PrivateKey(srvKey)
+	require.NoError(t, err)
+	writePEM(t, filepath.Join(dir, "tls.key"), "PRIVATE KEY", srvKeyDER)
+
+	srv := NewServer()
+	sdsAnnot := map[string]string{"secret-transform/sds": "true"}
+	srv.Observe(secret(sdsAnnot, map[string]string{"tls.crt": "crt", "tls.key": "key"}))
+
+	sock := filepath.Join(dir, "sds.sock")
+	files := &TLSFiles{CertFile: filepath.Join(dir, "tls.crt"), KeyFile: filepath.Join(dir, "tls.key"), ClientCAFile: filepath.Join(dir, "ca.crt")}
+	go func() { _ = srv.ListenAndServe(ctx, "unix://"+sock, files) }()
+	require.Eventually(t, func() bool { _, err := os.Stat(sock); return err == nil }, 5*time.Second, 10*time.Millisecond)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	dial := func(t *testing.T, uris ...string) secretservice.SecretDiscoveryServiceClient {
+		t.Helper()
+		tmpl := &x509.Certificate{Subject: pkix.Name{CommonName: "envoy"}, ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}}
+		for _, u := range uris {
+			parsed, err := url.Parse(u)
+			require.NoError(t, err)
+			tmpl.URIs = append(tmpl.URIs, parsed)
+		}
+		cert, key := newCert(t, ca, caKey, tmpl)
+		creds := credentials.NewTLS(&tls.Config{
+			ServerName:   "sds",
+			RootCAs:      roots,
+			Certificates: []tls.Certificate{{Certificate: [][]byte{cert.Raw}, PrivateKey: key}},
+		})
+		conn, err := grpc.NewClient("unix://"+sock, grpc.WithTransportCredentials(creds))
+		require.NoError(t, err)
+		t.Cleanup(func() { conn.Close() })
+		return secretservice.NewSecretDiscoveryServiceClient(conn)
+	}
+	// Returns the error of the first response.
+	request := func(cl secretservice.SecretDiscoveryServiceClient, names ...string) error {
+		stream, err := cl.StreamSecrets(ctx)
+		require.NoError(t, err)
+		require.NoError(t, stream.Send(&discoveryv3.DiscoveryRequest{TypeUrl: resourcev3.SecretType, ResourceNames: names}))
+		_, err = stream.Recv()
+		return err
+	}
+
+	t.Run("the client can fetch the Secrets of its namespace", func(t *testing.T) {
+		cl := dial(t, "spiffe://cluster.local/ns/ns/sa/envoy")
+		assert.NoError(t, request(cl, "ns/envoy-tls"))
+	})
+
+	t.Run("the client can't fetch the Secrets of other namespaces", func(t *testing.T) {
+		cl := dial(t, "spiffe://cluster.local/ns/other/sa/envoy")
+		assert.Equal(t, codes.PermissionDenied, status.Code(request(cl, "ns/envoy-tls")))
+		assert.Equal(t, codes.PermissionDenied, status.Code(request(cl)), "requesting no name means requesting all the Secrets")
+	})
+
+	t.Run("the client certificate must have a SPIFFE ID", func(t *testing.T) {
+		cl := dial(t, "https://example.com")
+		assert.Equal(t, codes.Unauthenticated, status.Code(request(cl, "ns/envoy-tls")))
+	})
+}
+
+func TestCheckPlaintextAddress(t *testing.T) {
+	assert.NoError(t, CheckPlaintextAddress("unix:///var/run/sds.sock"))
+	assert.NoError(t, CheckPlaintextAddress("127.0.0.1:8082"))
+	assert.NoError(t, CheckPlaintextAddress("[::1]:8082"))
+	assert.NoError(t, CheckPlaintextAddress("localhost:8082"))
+	assert.Error(t, CheckPlaintextAddress(":8082"))
+	assert.Error(t, CheckPlaintextAddress("10.0.0.1:8082"))
+}
+
+// Returns a certificate signed by parent, or self-signed when parent is nil,
+// along with its private key.
+func newCert(t *testing.T, parent *x509.Certificate, parentKey any, tmpl *x509.Certificate) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl.SerialNumber = big.NewInt(time.Now().UnixNano())
+	tmpl.NotBefore = time.Now().Add(-time.Hour)
+	tmpl.NotAfter = time.Now().Add(time.Hour)
+	if parent == nil {
+		parent, parentKey = tmpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return cert, key
+}
+
+func writePEM(t *testing.T, path, blockType string, der []byte) {
+	t.Helper()
+	require.NoError(t, os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0o600))
+}
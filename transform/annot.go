@@ -0,0 +1,70 @@
+package transform
+
+import "sort"
+
+// GetOneOf returns the first annotation among the given annotation keys. When
+// the key isn't found, the returned `key` is left empty.
+//
+// This exists because the project started with annotations starting with
+// cert-manager.io/*, which caused issues:
+// https://github.com/maelvls/secret-transform/issues/11.
+func GetOneOf(annots map[string]string, keys ...string) (key, value string) {
+	if annots == nil {
+		return "", ""
+	}
+
+	for _, k := range keys {
+		value, found := annots[k]
+		if found && value != "" {
+			return k, value
+		}
+	}
+
+	return "", ""
+}
+
+// The legacy cert-manager.io/* annotations and the annotations that replace
+// them.
+var legacyAnnots = map[string]string{
+	OldSecretAnnotKey:                  SecretAnnotKey,
+	OldSecretSyncCACRTAnnotKey:         SecretSyncCACRTAnnotKey,
+	OldSecretSyncTLSCrtAnnotKey:        SecretSyncTLSCrtAnnotKey,
+	OldSecretSyncTLSKeyAnnotKey:        SecretSyncTLSKeyAnnotKey,
+	OldSecretSyncKeystoreJKSAnnotKey:   SecretSyncKeystoreJKSAnnotKey,
+	OldSecretSyncTruststoreJKSAnnotKey: SecretSyncTruststoreJKSAnnotKey,
+	OldSecretSyncKeystoreP12AnnotKey:   SecretSyncKeystoreP12AnnotKey,
+	OldSecretSyncTruststoreP12AnnotKey: SecretSyncTruststoreP12AnnotKey,
+}
+
+// IsLegacyAnnotation returns true for the cert-manager.io/* annotations that
+// are kept for backwards compatibility, along with the secret-transform/*
+// annotation that replaces it.
+func IsLegacyAnnotation(key string) (replacement string, isLegacy bool) {
+	replacement, isLegacy = legacyAnnots[key]
+	return replacement, isLegacy
+}
+
+// LegacyAnnotationKeys returns all the legacy cert-manager.io/* annotation
+// keys, sorted.
+func LegacyAnnotationKeys() []string {
+	keys := make([]string, 0, len(legacyAnnots))
+	for key := range legacyAnnots {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// LegacyAnnotations returns the legacy cert-manager.io/* annotations found in
+// the given annotations, sorted. Annotations with an empty value are ignored
+// since they are ignored by the transformers too.
+func LegacyAnnotations(annots map[string]string) []string {
+	var found []string
+	for key, value := range annots {
+		if _, isLegacy := legacyAnnots[key]; isLegacy && value != "" {
+			found = append(found, key)
+		}
+	}
+	sort.Strings(found)
+	return found
+}
@@ -0,0 +1,63 @@
+package transform
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_GetOneOfAnnots(t *testing.T) {
+	t.Run("returns first found annotation", func(t *testing.T) {
+		annots := map[string]string{
+			"foo": "foo-1",
+			"bar": "bar-1",
+			"baz": "baz-1",
+		}
+		annot, value := GetOneOf(annots, "bar", "foo", "baz")
+		assert.Equal(t, "bar", annot)
+		assert.Equal(t, "bar-1", value)
+	})
+
+	t.Run("returns an empty key when annot not found", func(t *testing.T) {
+		annots := map[string]string{
+			"foo": "foo-1",
+			"bar": "bar-1",
+		}
+		annot, value := GetOneOf(annots, "unknown")
+		assert.Equal(t, "", annot)
+		assert.Equal(t, "", value)
+	})
+
+	t.Run("returns an empty key when annots is nil", func(t *testing.T) {
+		annot, value := GetOneOf(nil, "foo", "bar")
+		assert.Equal(t, "", annot)
+		assert.Equal(t, "", value)
+	})
+}
+
+func TestIsLegacyAnnotation(t *testing.T) {
+	replacement, isLegacy := IsLegacyAnnotation("cert-manager.io/secret-copy-ca.crt")
+	assert.True(t, isLegacy)
+	assert.Equal(t, "secret-transform/secret-copy-ca.crt", replacement)
+
+	replacement, isLegacy = IsLegacyAnnotation("cert-manager.io/secret-transform")
+	assert.True(t, isLegacy)
+	assert.Equal(t, "secret-transform/secret-transform", replacement)
+
+	_, isLegacy = IsLegacyAnnotation("secret-transform/secret-copy-ca.crt")
+	assert.False(t, isLegacy)
+
+	_, isLegacy = IsLegacyAnnotation("cert-manager.io/issuer-name")
+	assert.False(t, isLegacy)
+}
+
+func TestLegacyAnnotations(t *testing.T) {
+	got := LegacyAnnotations(map[string]string{
+		"cert-manager.io/secret-transform":     "tls.pem",
+		"cert-manager.io/secret-copy-ca.crt":   "ca",
+		"cert-manager.io/secret-copy-tls.crt":  "",
+		"cert-manager.io/issuer-name":          "foo",
+		"secret-transform/secret-copy-tls.key": "key",
+	})
+	assert.Equal(t, []string{"cert-manager.io/secret-copy-ca.crt", "cert-manager.io/secret-transform"}, got)
+}
@@ -0,0 +1,100 @@
+package transform
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"sort"
+
+	"github.com/pavlo-v-chernykh/keystore-go/v4"
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// ParseCertificates parses the PEM-encoded certificates. Blocks that aren't
+// certificates are ignored. Returns an error if no certificate is found.
+func ParseCertificates(data []byte) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	for _, block := range pemBlocks(data, "CERTIFICATE") {
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("no PEM-encoded certificate found")
+	}
+	return certs, nil
+}
+
+// Fingerprint returns the hex-encoded SHA-256 fingerprint of the certificate.
+func Fingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// Bundle deduplicates the certificates by fingerprint and sorts them by
+// subject, then by fingerprint, so that the same set of certificates always
+// gives the same bundle.
+func Bundle(certs []*x509.Certificate) []*x509.Certificate {
+	seen := make(map[string]bool)
+	var bundle []*x509.Certificate
+	for _, cert := range certs {
+		if seen[Fingerprint(cert)] {
+			continue
+		}
+		seen[Fingerprint(cert)] = true
+		bundle = append(bundle, cert)
+	}
+
+	sort.Slice(bundle, func(i, j int) bool {
+		si, sj := bundle[i].Subject.String(), bundle[j].Subject.String()
+		if si != sj {
+			return si < sj
+		}
+		return Fingerprint(bundle[i]) < Fingerprint(bundle[j])
+	})
+	return bundle
+}
+
+// EncodePEMBundle returns the PEM encoding of the certificates.
+func EncodePEMBundle(certs []*x509.Certificate) []byte {
+	var buf bytes.Buffer
+	for _, cert := range certs {
+		_ = pem.Encode(&buf, &pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+	}
+	return buf.Bytes()
+}
+
+// EncodeJKSTrustStore returns a JKS truststore containing the certificates.
+// The aliases are derived from the fingerprints and the creation times from
+// the certificates, so that the same certificates always give the same
+// truststore.
+func EncodeJKSTrustStore(certs []*x509.Certificate, password string) ([]byte, error) {
+	ks := keystore.New(keystore.WithOrderedAliases())
+	for _, cert := range certs {
+		err := ks.SetTrustedCertificateEntry(Fingerprint(cert)[:16], keystore.TrustedCertificateEntry{
+			CreationTime: cert.NotBefore,
+			Certificate:  keystore.Certificate{Type: "X509", Content: cert.Raw},
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := ks.Store(&buf, []byte(password)); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// EncodePKCS12TrustStore returns a PKCS#12 truststore containing the
+// certificates. Unlike the JKS truststore, the output changes every time since
+// the encryption uses a random salt.
+func EncodePKCS12TrustStore(certs []*x509.Certificate, password string) ([]byte, error) {
+	return pkcs12.LegacyDES.EncodeTrustStore(certs, password)
+}
@@ -0,0 +1,70 @@
+package transform
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/pavlo-v-chernykh/keystore-go/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+func TestParseCertificates(t *testing.T) {
+	ca1, key := selfSigned(t, "ca-1")
+	ca2, _ := selfSigned(t, "ca-2")
+
+	certs, err := ParseCertificates(append(append(append([]byte{}, ca1...), key...), ca2...))
+	require.NoError(t, err)
+	require.Len(t, certs, 2)
+	assert.Equal(t, "ca-1", certs[0].Subject.CommonName)
+	assert.Equal(t, "ca-2", certs[1].Subject.CommonName)
+
+	_, err = ParseCertificates(key)
+	assert.EqualError(t, err, "no PEM-encoded certificate found")
+}
+
+func TestBundle(t *testing.T) {
+	ca1, _ := selfSigned(t, "ca-1")
+	ca2, _ := selfSigned(t, "ca-2")
+	certs, err := ParseCertificates(append(append(append([]byte{}, ca2...), ca1...), ca2...))
+	require.NoError(t, err)
+
+	bundle := Bundle(certs)
+	require.Len(t, bundle, 2, "the duplicates are removed")
+	assert.Equal(t, "ca-1", bundle[0].Subject.CommonName, "the certificates are sorted by subject")
+	assert.Equal(t, "ca-2", bundle[1].Subject.CommonName)
+	assert.Equal(t, append(append([]byte{}, ca1...), ca2...), EncodePEMBundle(bundle))
+}
+
+func TestEncodeJKSTrustStore(t *testing.T) {
+	ca1, _ := selfSigned(t, "ca-1")
+	ca2, _ := selfSigned(t, "ca-2")
+	certs, err := ParseCertificates(append(append([]byte{}, ca1...), ca2...))
+	require.NoError(t, err)
+
+	jks, err := EncodeJKSTrustStore(certs, "changeit")
+	require.NoError(t, err)
+
+	again, err := EncodeJKSTrustStore(certs, "changeit")
+	require.NoError(t, err)
+	assert.Equal(t, jks, again, "the same certificates must give the same truststore")
+
+	ks := keystore.New()
+	require.NoError(t, ks.Load(bytes.NewReader(jks), []byte("changeit")))
+	assert.ElementsMatch(t, []string{Fingerprint(certs[0])[:16], Fingerprint(certs[1])[:16]}, ks.Aliases())
+}
+
+func TestEncodePKCS12TrustStore(t *testing.T) {
+	ca1, _ := selfSigned(t, "ca-1")
+	certs, err := ParseCertificates(ca1)
+	require.NoError(t, err)
+
+	p12, err := EncodePKCS12TrustStore(certs, "changeit")
+	require.NoError(t, err)
+
+	decoded, err := pkcs12.DecodeTrustStore(p12, "changeit")
+	require.NoError(t, err)
+	require.Len(t, decoded, 1)
+	assert.Equal(t, certs[0].Raw, decoded[0].Raw)
+}
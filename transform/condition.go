@@ -0,0 +1,190 @@
+package transform
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/google/cel-go/cel"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/utils/lru"
+)
+
+// To only run the transforms when a condition is met, use the following
+// annotation on a Secret:
+//
+//	secret-transform/condition: 'cert.dnsNames.exists(n, n.endsWith(".internal"))'
+//
+// The value is a CEL expression that must evaluate to a boolean. Two variables
+// are available:
+//
+//	secret: name, namespace, type, labels, annotations, and dataKeys.
+//	cert:   the leaf found in tls.crt: commonName, subject, issuer,
+//	        serialNumber, dnsNames, ipAddresses, uris, emailAddresses, isCA,
+//	        notBefore, and notAfter. When tls.crt is missing or can't be
+//	        parsed, cert is an empty map; use has(cert.commonName) to check.
+//
+// Reading a missing label or annotation is an error; check that it exists
+// first, e.g., 'team' in secret.labels && secret.labels['team'] == 'payments'.
+//
+// When the expression evaluates to false, none of the transforms run.
+const SecretConditionAnnotKey = "secret-transform/condition"
+
+var (
+	celEnv     *cel.Env
+	celEnvErr  error
+	celEnvOnce sync.Once
+
+	// Compiling a CEL expression is much more expensive than evaluating it,
+	// and the same expression is evaluated on every reconciliation. The cache
+	// is bounded since each edit of an annotation gives a new expression.
+	celPrograms = lru.New(maxCELPrograms)
+)
+
+const (
+	maxCELPrograms = 1000
+
+	// The cost limit of a condition, the same as the per-expression limit of
+	// the Kubernetes validation rules. Evaluating a condition stops with an
+	// error when the cost exceeds it.
+	conditionCostLimit = 1_000_000
+)
+
+func conditionEnv() (*cel.Env, error) {
+	celEnvOnce.Do(func() {
+		celEnv, celEnvErr = cel.NewEnv(
+			cel.Variable("secret", cel.MapType(cel.StringType, cel.DynType)),
+			cel.Variable("cert", cel.MapType(cel.StringType, cel.DynType)),
+		)
+	})
+	return celEnv, celEnvErr
+}
+
+// compileCondition parses and type-checks the given CEL expression. The
+// expression must return a boolean. Since the fields of secret and cert are
+// dyn, an expression such as cert.isCA is dyn too and is only known to be a
+// boolean when evaluated.
+func compileCondition(expr string) (cel.Program, error) {
+	if prg, found := celPrograms.Get(expr); found {
+		return prg.(cel.Program), nil
+	}
+
+	env, err := conditionEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	ast, iss := env.Compile(expr)
+	if iss.Err() != nil {
+		return nil, iss.Err()
+	}
+	if t := ast.OutputType(); t != cel.BoolType && t != cel.DynType {
+		return nil, fmt.Errorf("the expression must return a bool, but returns %s", ast.OutputType())
+	}
+
+	prg, err := env.Program(ast, cel.CostLimit(conditionCostLimit))
+	if err != nil {
+		return nil, err
+	}
+
+	celPrograms.Add(expr, prg)
+	return prg, nil
+}
+
+// EvalCondition returns true when the Secret has no condition or when its
+// condition evaluates to true. An error is returned when the condition can't be
+// compiled or evaluated.
+func EvalCondition(secret *corev1.Secret) (bool, error) {
+	expr, found := secret.GetAnnotations()[SecretConditionAnnotKey]
+	if !found || expr == "" {
+		return true, nil
+	}
+
+	prg, err := compileCondition(expr)
+	if err != nil {
+		return false, err
+	}
+
+	out, _, err := prg.Eval(map[string]any{
+		"secret": conditionSecretVars(secret),
+		"cert":   conditionCertVars(secret.Data["tls.crt"]),
+	})
+	if err != nil {
+		return false, err
+	}
+
+	result, ok := out.Value().(bool)
+	if !ok {
+		return false, fmt.Errorf("the expression returned %v instead of a bool", out.Value())
+	}
+	return result, nil
+}
+
+func conditionSecretVars(secret *corev1.Secret) map[string]any {
+	dataKeys := make([]string, 0, len(secret.Data))
+	for k := range secret.Data {
+		dataKeys = append(dataKeys, k)
+	}
+	sort.Strings(dataKeys)
+
+	labels := secret.GetLabels()
+	if labels == nil {
+		labels = map[string]string{}
+	}
+	annots := secret.GetAnnotations()
+	if annots == nil {
+		annots = map[string]string{}
+	}
+
+	return map[string]any{
+		"name":        secret.Name,
+		"namespace":   secret.Namespace,
+		"type":        string(secret.Type),
+		"labels":      labels,
+		"annotations": annots,
+		"dataKeys":    dataKeys,
+	}
+}
+
+func conditionCertVars(crtPEM []byte) map[string]any {
+	block, _ := pem.Decode(crtPEM)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return map[string]any{}
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return map[string]any{}
+	}
+
+	var ips, uris []string
+	for _, ip := range cert.IPAddresses {
+		ips = append(ips, ip.String())
+	}
+	for _, uri := range cert.URIs {
+		uris = append(uris, uri.String())
+	}
+
+	return map[string]any{
+		"commonName":     cert.Subject.CommonName,
+		"subject":        cert.Subject.String(),
+		"issuer":         cert.Issuer.String(),
+		"serialNumber":   cert.SerialNumber.String(),
+		"dnsNames":       nonNil(cert.DNSNames),
+		"ipAddresses":    nonNil(ips),
+		"uris":           nonNil(uris),
+		"emailAddresses": nonNil(cert.EmailAddresses),
+		"isCA":           cert.IsCA,
+		"notBefore":      cert.NotBefore,
+		"notAfter":       cert.NotAfter,
+	}
+}
+
+// CEL treats a nil slice as null rather than as an empty list.
+func nonNil(s []string) []string {
+	if s == nil {
+		return []string{}
+	}
+	return s
+}
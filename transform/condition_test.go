@@ -0,0 +1,128 @@
+package transform
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestEvalCondition(t *testing.T) {
+	crt, _ := selfSigned(t, "api.internal")
+
+	t.Run("no condition means the transforms run", func(t *testing.T) {
+		ok, err := EvalCondition(secret(nil, nil))
+		require.NoError(t, err)
+		assert.True(t, ok)
+	})
+
+	t.Run("condition on the Secret type", func(t *testing.T) {
+		given := secret(map[string]string{
+			"secret-transform/condition": `secret.type == "kubernetes.io/tls"`,
+		}, nil)
+
+		ok, err := EvalCondition(given)
+		require.NoError(t, err)
+		assert.False(t, ok)
+
+		given.Type = corev1.SecretTypeTLS
+		ok, err = EvalCondition(given)
+		require.NoError(t, err)
+		assert.True(t, ok)
+	})
+
+	t.Run("condition on the leaf's SANs", func(t *testing.T) {
+		given := secret(map[string]string{
+			"secret-transform/condition": `cert.dnsNames.exists(n, n.endsWith(".internal"))`,
+		}, map[string][]byte{"tls.crt": crt})
+
+		ok, err := EvalCondition(given)
+		require.NoError(t, err)
+		assert.True(t, ok)
+	})
+
+	t.Run("a field can be used as the condition", func(t *testing.T) {
+		given := secret(map[string]string{
+			"secret-transform/condition": `cert.isCA`,
+		}, map[string][]byte{"tls.crt": crt})
+
+		ok, err := EvalCondition(given)
+		require.NoError(t, err)
+		assert.True(t, ok)
+
+		given.Annotations["secret-transform/condition"] = `secret.name`
+		_, err = EvalCondition(given)
+		assert.EqualError(t, err, "the expression returned test-secret instead of a bool")
+	})
+
+	t.Run("a missing label can be checked with 'in'", func(t *testing.T) {
+		given := secret(map[string]string{
+			"secret-transform/condition": `'team' in secret.labels && secret.labels['team'] == 'payments'`,
+		}, nil)
+
+		ok, err := EvalCondition(given)
+		require.NoError(t, err)
+		assert.False(t, ok)
+
+		given.Labels = map[string]string{"team": "payments"}
+		ok, err = EvalCondition(given)
+		require.NoError(t, err)
+		assert.True(t, ok)
+	})
+
+	t.Run("has() can be used when tls.crt is missing", func(t *testing.T) {
+		given := secret(map[string]string{
+			"secret-transform/condition": `has(cert.commonName) && cert.commonName == "api.internal"`,
+		}, nil)
+
+		ok, err := EvalCondition(given)
+		require.NoError(t, err)
+		assert.False(t, ok)
+	})
+
+	t.Run("syntax errors are returned", func(t *testing.T) {
+		given := secret(map[string]string{
+			"secret-transform/condition": `secret.name ==`,
+		}, nil)
+
+		_, err := EvalCondition(given)
+		assert.Error(t, err)
+	})
+
+	t.Run("non-boolean expressions are rejected", func(t *testing.T) {
+		given := secret(map[string]string{
+			"secret-transform/condition": `"foo"`,
+		}, nil)
+
+		_, err := EvalCondition(given)
+		assert.EqualError(t, err, "the expression must return a bool, but returns string")
+	})
+
+	t.Run("evaluation errors are returned", func(t *testing.T) {
+		given := secret(map[string]string{
+			"secret-transform/condition": `cert.commonName == "foo"`,
+		}, nil)
+
+		_, err := EvalCondition(given)
+		assert.Error(t, err)
+	})
+
+	t.Run("expensive expressions are stopped", func(t *testing.T) {
+		given := secret(map[string]string{
+			"secret-transform/condition": `[1,2,3,4,5,6,7,8,9,10].all(a, [1,2,3,4,5,6,7,8,9,10].all(b, [1,2,3,4,5,6,7,8,9,10].all(c, [1,2,3,4,5,6,7,8,9,10].all(d, [1,2,3,4,5,6,7,8,9,10].all(e, [1,2,3,4,5,6,7,8,9,10].all(f, true))))))`,
+		}, nil)
+
+		_, err := EvalCondition(given)
+		assert.ErrorContains(t, err, "actual cost limit exceeded")
+	})
+
+	t.Run("the compiled expressions are cached up to a limit", func(t *testing.T) {
+		for i := 0; i < maxCELPrograms+10; i++ {
+			_, err := compileCondition(fmt.Sprintf("secret.name == 'secret-%d'", i))
+			require.NoError(t, err)
+		}
+		assert.Equal(t, maxCELPrograms, celPrograms.Len())
+	})
+}
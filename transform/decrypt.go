@@ -0,0 +1,173 @@
+package transform
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// When tls.key is encrypted, give the Secret holding its passphrase with the
+// following annotations:
+//
+//	secret-transform/tls-key-passphrase-secret: "vault-key-passphrase"
+//	secret-transform/tls-key-passphrase-key: "passphrase"  # Optional.
+//
+// Both PBES2-encrypted PKCS#8 keys ("ENCRYPTED PRIVATE KEY") and the legacy
+// OpenSSL encryption ("Proc-Type: 4,ENCRYPTED") are supported. The
+// transformers see the decrypted key; tls.key itself is left encrypted.
+const (
+	TLSKeyPassphraseSecretAnnotKey = "secret-transform/tls-key-passphrase-secret"
+	TLSKeyPassphraseKeyAnnotKey    = "secret-transform/tls-key-passphrase-key"
+)
+
+// Decrypts tls.key before the transformers that read it run. It isn't one of
+// the registered transformers since it doesn't write any data key of its own,
+// but it is a SecretReferencer so that the Secret holding the passphrase is
+// watched like the ones referenced by the transformers.
+type tlsKeyDecrypter struct{}
+
+var keyDecrypter SecretReferencer = tlsKeyDecrypter{}
+
+func (tlsKeyDecrypter) Name() string { return "tls-key-decrypter" }
+
+func (tlsKeyDecrypter) Annotations() []string {
+	return []string{TLSKeyPassphraseSecretAnnotKey}
+}
+
+func (tlsKeyDecrypter) References(annots map[string]string) []string {
+	return []string{annots[TLSKeyPassphraseSecretAnnotKey]}
+}
+
+func (d tlsKeyDecrypter) Apply(secret *corev1.Secret) ([]Event, error) {
+	return d.ApplyWithSecrets(secret, nil)
+}
+
+// Replaces tls.key with its decrypted version when it is encrypted. Returns
+// errNoPassphrase when tls.key is encrypted and no passphrase was given.
+func (tlsKeyDecrypter) ApplyWithSecrets(secret *corev1.Secret, get SecretGetter) ([]Event, error) {
+	decrypted, events, err := decryptTLSKey(secret, get)
+	if err != nil || decrypted == nil {
+		return events, err
+	}
+	secret.Data[corev1.TLSPrivateKeyKey] = decrypted
+	return events, nil
+}
+
+// errNoPassphrase means that tls.key is encrypted and that the Secret doesn't
+// say where its passphrase is. The transformers reading tls.key are skipped,
+// the other ones run.
+var errNoPassphrase = errors.New("no passphrase for the encrypted tls.key")
+
+// DecryptedTLSKey returns tls.key decrypted with the passphrase read from the
+// Secret given in TLSKeyPassphraseSecretAnnotKey, or tls.key as is when it
+// isn't encrypted. It is meant for the readers of tls.key that aren't
+// transformers, such as the SDS server.
+func DecryptedTLSKey(secret *corev1.Secret, get SecretGetter) ([]byte, error) {
+	decrypted, _, err := decryptTLSKey(secret, get)
+	switch {
+	case err != nil:
+		return nil, err
+	case decrypted == nil:
+		return secret.Data[corev1.TLSPrivateKeyKey], nil
+	}
+	return decrypted, nil
+}
+
+// Returns true if one of the PEM blocks of the key is encrypted.
+func isEncryptedKey(data []byte) bool {
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return false
+		}
+		if block.Type == "ENCRYPTED PRIVATE KEY" || x509.IsEncryptedPEMBlock(block) {
+			return true
+		}
+	}
+}
+
+// Returns tls.key with its encrypted PEM blocks decrypted, or nil when tls.key
+// isn't encrypted. The other PEM blocks are kept as they are.
+func decryptTLSKey(secret *corev1.Secret, get SecretGetter) ([]byte, []Event, error) {
+	annots := secret.GetAnnotations()
+	fail := func(reason, format string, args ...any) ([]byte, []Event, error) {
+		err := fmt.Errorf(format, args...)
+		return nil, []Event{{corev1.EventTypeWarning, reason, err.Error()}}, err
+	}
+
+	if !isEncryptedKey(secret.Data[corev1.TLSPrivateKeyKey]) {
+		return nil, nil, nil
+	}
+	var blocks []*pem.Block
+	for rest := secret.Data[corev1.TLSPrivateKeyKey]; ; {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		blocks = append(blocks, block)
+	}
+
+	if annots[TLSKeyPassphraseSecretAnnotKey] == "" {
+		return nil, []Event{{corev1.EventTypeWarning, "EncryptedTLSKey", fmt.Sprintf("the key in 'tls.key' is encrypted, set the annotation '%s' to the Secret holding its passphrase; the transforms reading 'tls.key' are skipped", TLSKeyPassphraseSecretAnnotKey)}}, errNoPassphrase
+	}
+	passphrase, err := readPassphrase(annots, TLSKeyPassphraseSecretAnnotKey, TLSKeyPassphraseKeyAnnotKey, get)
+	if err != nil {
+		return fail("FailedDecryptingKey", "%v", err)
+	}
+
+	var decrypted bytes.Buffer
+	for _, block := range blocks {
+		switch {
+		case block.Type == "ENCRYPTED PRIVATE KEY":
+			der, _, err := decryptPKCS8(block.Bytes, passphrase)
+			if err == nil {
+				_, err = x509.ParsePKCS8PrivateKey(der)
+			}
+			switch {
+			case errors.Is(err, errIncorrectPassphrase):
+				return fail("IncorrectPassphrase", "the passphrase read from the Secret '%s' can't decrypt 'tls.key'", annots[TLSKeyPassphraseSecretAnnotKey])
+			case err != nil:
+				return fail("FailedDecryptingKey", "while decrypting 'tls.key': %v", err)
+			}
+			block = &pem.Block{Type: "PRIVATE KEY", Bytes: der}
+		case x509.IsEncryptedPEMBlock(block):
+			// DecryptPEMBlock is deprecated since the legacy encryption has
+			// no integrity check: a wrong passphrase is caught by the padding
+			// check most of the time, and otherwise when parsing the key.
+			der, err := x509.DecryptPEMBlock(block, passphrase)
+			if err == nil && !isPrivateKeyDER(block.Type, der) {
+				err = x509.IncorrectPasswordError
+			}
+			switch {
+			case errors.Is(err, x509.IncorrectPasswordError):
+				return fail("IncorrectPassphrase", "the passphrase read from the Secret '%s' can't decrypt 'tls.key'", annots[TLSKeyPassphraseSecretAnnotKey])
+			case err != nil:
+				return fail("FailedDecryptingKey", "while decrypting 'tls.key': %v", err)
+			}
+			block = &pem.Block{Type: block.Type, Bytes: der}
+		}
+		_ = pem.Encode(&decrypted, block)
+	}
+	return decrypted.Bytes(), nil, nil
+}
+
+// Returns true if the DER can be parsed as a private key of the given PEM
+// type.
+func isPrivateKeyDER(blockType string, der []byte) bool {
+	var err error
+	switch blockType {
+	case "RSA PRIVATE KEY":
+		_, err = x509.ParsePKCS1PrivateKey(der)
+	case "EC PRIVATE KEY":
+		_, err = x509.ParseECPrivateKey(der)
+	default:
+		_, err = x509.ParsePKCS8PrivateKey(der)
+	}
+	return err == nil
+}
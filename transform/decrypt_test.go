@@ -0,0 +1,104 @@
+package transform
+
+import (
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDecryptTLSKey(t *testing.T) {
+	crt, key := selfSigned(t, "haproxy")
+	block, _ := pem.Decode(key)
+	parsed, err := x509.ParseECPrivateKey(block.Bytes)
+	require.NoError(t, err)
+	pkcs8DER, err := x509.MarshalPKCS8PrivateKey(parsed)
+	require.NoError(t, err)
+
+	encryptedPKCS8, err := encryptPKCS8(pkcs8DER, []byte("s3cr3t"), "aes-256-cbc")
+	require.NoError(t, err)
+	legacy, err := x509.EncryptPEMBlock(rand.Reader, "EC PRIVATE KEY", block.Bytes, []byte("s3cr3t"), x509.PEMCipherAES256)
+	require.NoError(t, err)
+
+	annots := map[string]string{
+		"secret-transform/secret-transform":          "tls.pem",
+		"secret-transform/tls-key-passphrase-secret": "vault-passphrase",
+	}
+	secrets := map[string]map[string][]byte{"vault-passphrase": {"passphrase": []byte("s3cr3t")}}
+
+	for name, tc := range map[string]struct {
+		encrypted []byte
+		decrypted []byte
+	}{
+		"encrypted PKCS#8": {pem.EncodeToMemory(encryptedPKCS8), pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8DER})},
+		"legacy Proc-Type": {pem.EncodeToMemory(legacy), key},
+	} {
+		t.Run(name+": the transformers see the decrypted key", func(t *testing.T) {
+			given := secret(annots, map[string][]byte{"tls.crt": crt, "tls.key": tc.encrypted})
+			events, err := ApplyWithSecrets(given, secretGetter(secrets))
+			require.NoError(t, err)
+			assert.Len(t, events, 1)
+			assert.Equal(t, string(tc.decrypted)+string(crt), string(given.Data["tls.pem"]))
+			assert.Equal(t, tc.encrypted, given.Data["tls.key"], "tls.key must be left encrypted")
+		})
+
+		t.Run(name+": wrong passphrase", func(t *testing.T) {
+			given := secret(annots, map[string][]byte{"tls.crt": crt, "tls.key": tc.encrypted})
+			events, err := ApplyWithSecrets(given, secretGetter(map[string]map[string][]byte{"vault-passphrase": {"passphrase": []byte("wrong")}}))
+			assert.Error(t, err)
+			assert.Equal(t, []string{"Warning IncorrectPassphrase the passphrase read from the Secret 'vault-passphrase' can't decrypt 'tls.key'"}, eventStrings(events))
+			assert.NotContains(t, given.Data, "tls.pem")
+		})
+	}
+
+	t.Run("an encrypted key without passphrase is reported", func(t *testing.T) {
+		given := secret(map[string]string{"secret-transform/secret-transform": "tls.pem"}, map[string][]byte{"tls.crt": crt, "tls.key": pem.EncodeToMemory(encryptedPKCS8)})
+		events, err := ApplyWithSecrets(given, secretGetter(secrets))
+		require.NoError(t, err)
+		assert.Equal(t, []string{"Warning EncryptedTLSKey the key in 'tls.key' is encrypted, set the annotation 'secret-transform/tls-key-passphrase-secret' to the Secret holding its passphrase; the transforms reading 'tls.key' are skipped"}, eventStrings(events))
+		assert.NotContains(t, given.Data, "tls.pem")
+	})
+
+	t.Run("the transforms not reading the key run without passphrase", func(t *testing.T) {
+		given := secret(map[string]string{"secret-transform/secret-copy-ca.crt": "ca"}, map[string][]byte{"ca.crt": crt, "tls.key": pem.EncodeToMemory(encryptedPKCS8)})
+		events, err := ApplyWithSecrets(given, secretGetter(nil))
+		require.NoError(t, err)
+		assert.Equal(t, []string{"Normal CopiedKey Copied the contents of 'ca.crt' into key 'ca'"}, eventStrings(events))
+		assert.Equal(t, crt, given.Data["ca"])
+	})
+
+	t.Run("the passphrase isn't read when no transform reads the key", func(t *testing.T) {
+		annots := map[string]string{
+			"secret-transform/secret-copy-ca.crt":        "ca",
+			"secret-transform/tls-key-passphrase-secret": "vault-passphrase",
+		}
+		given := secret(annots, map[string][]byte{"ca.crt": crt, "tls.key": pem.EncodeToMemory(encryptedPKCS8)})
+		events, err := ApplyWithSecrets(given, secretGetter(nil))
+		require.NoError(t, err)
+		assert.Equal(t, []string{"Normal CopiedKey Copied the contents of 'ca.crt' into key 'ca'"}, eventStrings(events))
+		assert.Equal(t, crt, given.Data["ca"])
+		assert.Empty(t, References(annots))
+	})
+
+	t.Run("the passphrase Secret can't be read", func(t *testing.T) {
+		given := secret(annots, map[string][]byte{"tls.crt": crt, "tls.key": pem.EncodeToMemory(encryptedPKCS8)})
+		events, err := ApplyWithSecrets(given, secretGetter(nil))
+		assert.Error(t, err)
+		assert.Equal(t, []string{"Warning FailedDecryptingKey annot 'secret-transform/tls-key-passphrase-secret': while reading the passphrase: not found"}, eventStrings(events))
+	})
+
+	t.Run("an unencrypted key is used as is", func(t *testing.T) {
+		given := secret(annots, map[string][]byte{"tls.crt": crt, "tls.key": key})
+		_, err := ApplyWithSecrets(given, nil)
+		require.NoError(t, err)
+		assert.Equal(t, string(key)+string(crt), string(given.Data["tls.pem"]))
+	})
+
+	t.Run("the passphrase Secret is referenced", func(t *testing.T) {
+		assert.Equal(t, []string{"vault-passphrase"}, References(annots))
+		assert.Empty(t, References(map[string]string{"secret-transform/tls-key-passphrase-secret": "vault-passphrase"}), "the annotation alone doesn't trigger any transform")
+	})
+}
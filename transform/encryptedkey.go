@@ -0,0 +1,138 @@
+package transform
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// To write tls.key as an encrypted PKCS#8 private key, use the following
+// annotations on a Secret:
+//
+//	secret-transform/encrypted-key: "tls-encrypted.key"
+//	secret-transform/encrypted-key-passphrase-secret: "db-key-passphrase"
+//	secret-transform/encrypted-key-passphrase-key: "passphrase"  # Optional.
+//	secret-transform/encrypted-key-cipher: "aes-256-cbc"         # Optional.
+//
+// The passphrase is read from the given key of the given Secret, which must be
+// in the same namespace. The key is encrypted with PBES2, using PBKDF2 with
+// HMAC-SHA256 and AES-256-CBC unless another cipher is given.
+const (
+	EncryptedKeyAnnotKey                 = "secret-transform/encrypted-key"
+	EncryptedKeyPassphraseSecretAnnotKey = "secret-transform/encrypted-key-passphrase-secret"
+	EncryptedKeyPassphraseKeyAnnotKey    = "secret-transform/encrypted-key-passphrase-key"
+	EncryptedKeyCipherAnnotKey           = "secret-transform/encrypted-key-cipher"
+)
+
+// The key of the passphrase Secret used when none is given.
+const defaultPassphraseKey = "passphrase"
+
+// Handles the "secret-transform/encrypted-key*" annotations.
+type encryptedKeyTransformer struct{}
+
+var _ SecretReferencer = encryptedKeyTransformer{}
+
+func (encryptedKeyTransformer) Name() string { return "encrypted-key" }
+
+func (encryptedKeyTransformer) Annotations() []string {
+	return []string{EncryptedKeyAnnotKey, EncryptedKeyPassphraseSecretAnnotKey, EncryptedKeyPassphraseKeyAnnotKey, EncryptedKeyCipherAnnotKey}
+}
+
+func (encryptedKeyTransformer) ReadsTLSKey(map[string]string) bool { return true }
+
+func (encryptedKeyTransformer) References(annots map[string]string) []string {
+	return []string{annots[EncryptedKeyPassphraseSecretAnnotKey]}
+}
+
+func (t encryptedKeyTransformer) Apply(secret *corev1.Secret) ([]Event, error) {
+	return t.ApplyWithSecrets(secret, nil)
+}
+
+func (encryptedKeyTransformer) ApplyWithSecrets(secret *corev1.Secret, get SecretGetter) ([]Event, error) {
+	annots := secret.GetAnnotations()
+	fail := func(format string, args ...any) ([]Event, error) {
+		err := fmt.Errorf(format, args...)
+		return []Event{{corev1.EventTypeWarning, "FailedEncryptingKey", err.Error()}}, err
+	}
+
+	key := annots[EncryptedKeyAnnotKey]
+	if key == "" {
+		return fail("the annotation '%s' is required to encrypt the private key", EncryptedKeyAnnotKey)
+	}
+	cipherName := annots[EncryptedKeyCipherAnnotKey]
+	if cipherName == "" {
+		cipherName = defaultPBES2Cipher
+	}
+	if _, found := pbes2Ciphers[cipherName]; !found {
+		return fail("annot '%s': unsupported cipher '%s', use one of %s", EncryptedKeyCipherAnnotKey, cipherName, strings.Join(pbes2CipherNames(), ", "))
+	}
+	passphrase, err := readPassphrase(annots, EncryptedKeyPassphraseSecretAnnotKey, EncryptedKeyPassphraseKeyAnnotKey, get)
+	if err != nil {
+		return fail("%v", err)
+	}
+
+	tlsKey, found := secret.Data[corev1.TLSPrivateKeyKey]
+	if !found {
+		err := fmt.Errorf("Secret %s does not contain a 'tls.key' data key", secret.Name)
+		return []Event{{corev1.EventTypeWarning, "MissingTLSKey", err.Error()}}, err
+	}
+	parsed, err := parsePrivateKeyPEM(tlsKey)
+	if err != nil {
+		return fail("while parsing 'tls.key': %v", err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(parsed)
+	if err != nil {
+		return fail("while encoding 'tls.key' to PKCS#8: %v", err)
+	}
+
+	// The encryption uses a random salt and IV, so the existing key is only
+	// replaced when it no longer decrypts to the same key with the same
+	// passphrase and cipher.
+	if block, _ := pem.Decode(secret.Data[key]); block != nil && block.Type == "ENCRYPTED PRIVATE KEY" {
+		existing, existingCipher, err := decryptPKCS8(block.Bytes, passphrase)
+		if err == nil && existingCipher == cipherName && bytes.Equal(existing, der) {
+			return nil, nil
+		}
+	}
+
+	block, err := encryptPKCS8(der, passphrase, cipherName)
+	if err != nil {
+		return fail("while encrypting 'tls.key': %v", err)
+	}
+	secret.Data[key] = pem.EncodeToMemory(block)
+	return []Event{{corev1.EventTypeNormal, "EncryptedKey", fmt.Sprintf("Encrypted 'tls.key' with %s into '%s'", cipherName, key)}}, nil
+}
+
+// Reads the passphrase from the Secret referenced by the annotation
+// secretAnnot, at the key given by the annotation keyAnnot, which defaults to
+// "passphrase".
+func readPassphrase(annots map[string]string, secretAnnot, keyAnnot string, get SecretGetter) ([]byte, error) {
+	name := annots[secretAnnot]
+	if name == "" {
+		return nil, fmt.Errorf("the annotation '%s' is required to read the passphrase", secretAnnot)
+	}
+	key := annots[keyAnnot]
+	if key == "" {
+		key = defaultPassphraseKey
+	}
+	if get == nil {
+		return nil, fmt.Errorf("annot '%s': the Secret '%s' can't be read here", secretAnnot, name)
+	}
+
+	data, err := get(name)
+	if err != nil {
+		return nil, fmt.Errorf("annot '%s': while reading the passphrase: %w", secretAnnot, err)
+	}
+	passphrase, found := data[key]
+	if !found {
+		return nil, fmt.Errorf("annot '%s': the Secret '%s' has no key '%s'", secretAnnot, name, key)
+	}
+	if len(passphrase) == 0 {
+		return nil, fmt.Errorf("annot '%s': the key '%s' of the Secret '%s' is empty", secretAnnot, key, name)
+	}
+	return passphrase, nil
+}
@@ -0,0 +1,160 @@
+package transform
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Returns a SecretGetter reading from the given Secrets, keyed by name.
+func secretGetter(secrets map[string]map[string][]byte) SecretGetter {
+	return func(name string) (map[string][]byte, error) {
+		data, found := secrets[name]
+		if !found {
+			return nil, errors.New("not found")
+		}
+		return data, nil
+	}
+}
+
+func TestEncryptedKeyTransformer(t *testing.T) {
+	_, key := selfSigned(t, "db")
+	annots := map[string]string{
+		"secret-transform/encrypted-key":                   "tls-encrypted.key",
+		"secret-transform/encrypted-key-passphrase-secret": "db-passphrase",
+	}
+	secrets := map[string]map[string][]byte{"db-passphrase": {"passphrase": []byte("s3cr3t")}}
+
+	decrypt := func(t *testing.T, data []byte, passphrase string) any {
+		t.Helper()
+		block, _ := pem.Decode(data)
+		require.NotNil(t, block)
+		assert.Equal(t, "ENCRYPTED PRIVATE KEY", block.Type)
+		der, _, err := decryptPKCS8(block.Bytes, []byte(passphrase))
+		require.NoError(t, err)
+		parsed, err := x509.ParsePKCS8PrivateKey(der)
+		require.NoError(t, err)
+		return parsed
+	}
+	want, err := parsePrivateKeyPEM(key)
+	require.NoError(t, err)
+
+	t.Run("the key is encrypted once and re-encrypted when the passphrase changes", func(t *testing.T) {
+		given := secret(annots, map[string][]byte{"tls.key": key})
+		events, err := ApplyWithSecrets(given, secretGetter(secrets))
+		require.NoError(t, err)
+		assert.Equal(t, []string{"Normal EncryptedKey Encrypted 'tls.key' with aes-256-cbc into 'tls-encrypted.key'"}, eventStrings(events))
+		assert.Equal(t, want, decrypt(t, given.Data["tls-encrypted.key"], "s3cr3t"))
+
+		events, err = ApplyWithSecrets(given, secretGetter(secrets))
+		require.NoError(t, err)
+		assert.Empty(t, events, "the key must not be re-encrypted when neither the key nor the passphrase changed")
+
+		rotated := map[string]map[string][]byte{"db-passphrase": {"passphrase": []byte("n3w")}}
+		events, err = ApplyWithSecrets(given, secretGetter(rotated))
+		require.NoError(t, err)
+		assert.Len(t, events, 1)
+		assert.Equal(t, want, decrypt(t, given.Data["tls-encrypted.key"], "n3w"))
+	})
+
+	t.Run("the key is re-encrypted when tls.key changes", func(t *testing.T) {
+		given := secret(annots, map[string][]byte{"tls.key": key})
+		_, err := ApplyWithSecrets(given, secretGetter(secrets))
+		require.NoError(t, err)
+
+		_, newKey := selfSigned(t, "db")
+		given.Data["tls.key"] = newKey
+		events, err := ApplyWithSecrets(given, secretGetter(secrets))
+		require.NoError(t, err)
+		assert.Len(t, events, 1)
+		newWant, err := parsePrivateKeyPEM(newKey)
+		require.NoError(t, err)
+		assert.Equal(t, newWant, decrypt(t, given.Data["tls-encrypted.key"], "s3cr3t"))
+	})
+
+	t.Run("another cipher and passphrase key", func(t *testing.T) {
+		given := secret(map[string]string{
+			"secret-transform/encrypted-key":                   "tls-encrypted.key",
+			"secret-transform/encrypted-key-passphrase-secret": "db-passphrase",
+			"secret-transform/encrypted-key-passphrase-key":    "pass",
+			"secret-transform/encrypted-key-cipher":            "des-ede3-cbc",
+		}, map[string][]byte{"tls.key": key})
+		events, err := ApplyWithSecrets(given, secretGetter(map[string]map[string][]byte{"db-passphrase": {"pass": []byte("s3cr3t")}}))
+		require.NoError(t, err)
+		assert.Equal(t, []string{"Normal EncryptedKey Encrypted 'tls.key' with des-ede3-cbc into 'tls-encrypted.key'"}, eventStrings(events))
+		assert.Equal(t, want, decrypt(t, given.Data["tls-encrypted.key"], "s3cr3t"))
+
+		given.Annotations["secret-transform/encrypted-key-cipher"] = "aes-128-cbc"
+		events, err = ApplyWithSecrets(given, secretGetter(map[string]map[string][]byte{"db-passphrase": {"pass": []byte("s3cr3t")}}))
+		require.NoError(t, err)
+		assert.Len(t, events, 1, "the key must be re-encrypted when the cipher changes")
+	})
+
+	t.Run("invalid inputs", func(t *testing.T) {
+		tests := []struct {
+			annots  map[string]string
+			data    map[string][]byte
+			secrets map[string]map[string][]byte
+			want    string
+		}{
+			{annots, map[string][]byte{"tls.key": key}, nil,
+				"Warning FailedEncryptingKey annot 'secret-transform/encrypted-key-passphrase-secret': while reading the passphrase: not found"},
+			{annots, map[string][]byte{"tls.key": key}, map[string]map[string][]byte{"db-passphrase": {"other": []byte("s3cr3t")}},
+				"Warning FailedEncryptingKey annot 'secret-transform/encrypted-key-passphrase-secret': the Secret 'db-passphrase' has no key 'passphrase'"},
+			{annots, map[string][]byte{"tls.key": key}, map[string]map[string][]byte{"db-passphrase": {"passphrase": nil}},
+				"Warning FailedEncryptingKey annot 'secret-transform/encrypted-key-passphrase-secret': the key 'passphrase' of the Secret 'db-passphrase' is empty"},
+			{map[string]string{"secret-transform/encrypted-key": "tls-encrypted.key"}, map[string][]byte{"tls.key": key}, secrets,
+				"Warning FailedEncryptingKey the annotation 'secret-transform/encrypted-key-passphrase-secret' is required to read the passphrase"},
+			{map[string]string{"secret-transform/encrypted-key-passphrase-secret": "db-passphrase"}, map[string][]byte{"tls.key": key}, secrets,
+				"Warning FailedEncryptingKey the annotation 'secret-transform/encrypted-key' is required to encrypt the private key"},
+			{map[string]string{"secret-transform/encrypted-key": "tls-encrypted.key", "secret-transform/encrypted-key-passphrase-secret": "db-passphrase", "secret-transform/encrypted-key-cipher": "rc4"}, map[string][]byte{"tls.key": key}, secrets,
+				"Warning FailedEncryptingKey annot 'secret-transform/encrypted-key-cipher': unsupported cipher 'rc4', use one of aes-128-cbc, aes-192-cbc, aes-256-cbc, des-ede3-cbc"},
+			{annots, map[string][]byte{"tls.crt": []byte("crt")}, secrets,
+				"Warning MissingTLSKey Secret test-secret does not contain a 'tls.key' data key"},
+		}
+		for _, test := range tests {
+			given := secret(test.annots, test.data)
+			events, err := ApplyWithSecrets(given, secretGetter(test.secrets))
+			assert.Error(t, err)
+			assert.Equal(t, []string{test.want}, eventStrings(events))
+			assert.NotContains(t, given.Data, "tls-encrypted.key")
+		}
+	})
+
+	t.Run("the passphrase can't be read without a SecretGetter", func(t *testing.T) {
+		given := secret(annots, map[string][]byte{"tls.key": key})
+		events, err := Apply(given)
+		assert.Error(t, err)
+		assert.Equal(t, []string{"Warning FailedEncryptingKey annot 'secret-transform/encrypted-key-passphrase-secret': the Secret 'db-passphrase' can't be read here"}, eventStrings(events))
+	})
+}
+
+func TestDecryptPKCS8(t *testing.T) {
+	_, key := selfSigned(t, "db")
+	parsed, err := parsePrivateKeyPEM(key)
+	require.NoError(t, err)
+	der, err := x509.MarshalPKCS8PrivateKey(parsed)
+	require.NoError(t, err)
+
+	block, err := encryptPKCS8(der, []byte("s3cr3t"), "aes-256-cbc")
+	require.NoError(t, err)
+	_, _, err = decryptPKCS8(block.Bytes, []byte("wrong"))
+	assert.ErrorIs(t, err, errIncorrectPassphrase)
+
+	got, cipherName, err := decryptPKCS8(block.Bytes, []byte("s3cr3t"))
+	require.NoError(t, err)
+	assert.Equal(t, der, got)
+	assert.Equal(t, "aes-256-cbc", cipherName)
+}
+
+func TestReferences(t *testing.T) {
+	assert.Equal(t, []string{"db-passphrase"}, References(map[string]string{
+		"secret-transform/encrypted-key":                   "tls-encrypted.key",
+		"secret-transform/encrypted-key-passphrase-secret": "db-passphrase",
+	}))
+	assert.Empty(t, References(map[string]string{"secret-transform/secret-transform": "tls.pem"}))
+}
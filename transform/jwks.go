@@ -0,0 +1,218 @@
+package transform
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// To extract the public key of a Secret for the services verifying the tokens
+// signed with its private key, use the following annotations on a Secret:
+//
+//	secret-transform/public-key: "tls.pub"
+//	secret-transform/jwks: "jwks.json"
+//
+// The first annotation gives the data key in which the public key is written
+// as a PKIX PEM ("PUBLIC KEY"), and the second one the data key in which it is
+// written as a JWK Set. The public key is taken from tls.crt when present, and
+// from tls.key otherwise.
+const (
+	PublicKeyAnnotKey = "secret-transform/public-key"
+	JWKSAnnotKey      = "secret-transform/jwks"
+)
+
+// Handles the "secret-transform/public-key" and "secret-transform/jwks"
+// annotations.
+type publicKeyTransformer struct{}
+
+func (publicKeyTransformer) Name() string { return "public-key" }
+
+func (publicKeyTransformer) Annotations() []string {
+	return []string{PublicKeyAnnotKey, JWKSAnnotKey}
+}
+
+func (publicKeyTransformer) ReadsTLSKey(map[string]string) bool { return true }
+
+func (publicKeyTransformer) Apply(secret *corev1.Secret) ([]Event, error) {
+	annots := secret.GetAnnotations()
+	fail := func(format string, args ...any) ([]Event, error) {
+		err := fmt.Errorf(format, args...)
+		return []Event{{corev1.EventTypeWarning, "FailedPublicKey", err.Error()}}, err
+	}
+
+	pub, from, chain, err := secretPublicKey(secret)
+	if err != nil {
+		return fail("%v", err)
+	}
+
+	outputs := make(map[string][]byte)
+	if key := annots[PublicKeyAnnotKey]; key != "" {
+		der, err := x509.MarshalPKIXPublicKey(pub)
+		if err != nil {
+			return fail("while encoding the public key of '%s': %v", from, err)
+		}
+		outputs[key] = pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+	}
+	if key := annots[JWKSAnnotKey]; key != "" {
+		jwks, err := JWKS(pub, chain)
+		if err != nil {
+			return fail("while converting the public key of '%s' to a JWK Set: %v", from, err)
+		}
+		outputs[key] = jwks
+	}
+
+	var events []Event
+	for _, annot := range []string{PublicKeyAnnotKey, JWKSAnnotKey} {
+		key := annots[annot]
+		data, found := outputs[key]
+		if !found || bytes.Equal(secret.Data[key], data) {
+			continue
+		}
+		secret.Data[key] = data
+		format := "the public key"
+		if annot == JWKSAnnotKey {
+			format = "the JWK Set"
+		}
+		events = append(events, Event{corev1.EventTypeNormal, "GeneratedPublicKey", fmt.Sprintf("Wrote %s of '%s' into '%s'", format, from, key)})
+	}
+	return events, nil
+}
+
+// Returns the public key of the Secret along with the data key it was taken
+// from. When the public key comes from tls.crt, the DER-encoded certificates
+// of tls.crt are returned too. When both tls.crt and tls.key are present,
+// they must hold the same public key.
+func secretPublicKey(secret *corev1.Secret) (pub crypto.PublicKey, from string, chain [][]byte, err error) {
+	tlsCrt, tlsKey := secret.Data[corev1.TLSCertKey], secret.Data[corev1.TLSPrivateKeyKey]
+	if len(tlsCrt) == 0 && len(tlsKey) == 0 {
+		return nil, "", nil, fmt.Errorf("Secret %s must contain the data key 'tls.crt' or 'tls.key' to extract a public key", secret.Name)
+	}
+
+	var keyPub crypto.PublicKey
+	if len(tlsKey) > 0 {
+		key, err := parsePrivateKeyPEM(tlsKey)
+		if err != nil {
+			return nil, "", nil, fmt.Errorf("while parsing 'tls.key': %w", err)
+		}
+		keyPub = key.(crypto.Signer).Public()
+	}
+	if len(tlsCrt) == 0 {
+		return keyPub, corev1.TLSPrivateKeyKey, nil, nil
+	}
+
+	blocks := pemBlocks(tlsCrt, "CERTIFICATE")
+	if len(blocks) == 0 {
+		return nil, "", nil, fmt.Errorf("no certificate found in 'tls.crt'")
+	}
+	leaf, err := x509.ParseCertificate(blocks[0].Bytes)
+	if err != nil {
+		return nil, "", nil, fmt.Errorf("while parsing 'tls.crt': %w", err)
+	}
+	if keyPub != nil && !keyPub.(interface{ Equal(crypto.PublicKey) bool }).Equal(leaf.PublicKey) {
+		return nil, "", nil, fmt.Errorf("the public key of 'tls.crt' doesn't match 'tls.key'")
+	}
+	for _, block := range blocks {
+		chain = append(chain, block.Bytes)
+	}
+	return leaf.PublicKey, corev1.TLSCertKey, chain, nil
+}
+
+// JWK is a JSON Web Key (RFC 7517) holding a public key used to verify
+// signatures.
+type JWK struct {
+	KeyType string   `json:"kty"`
+	KeyID   string   `json:"kid"`
+	Use     string   `json:"use"`
+	Curve   string   `json:"crv,omitempty"`
+	N       string   `json:"n,omitempty"`
+	E       string   `json:"e,omitempty"`
+	X       string   `json:"x,omitempty"`
+	Y       string   `json:"y,omitempty"`
+	X5C     []string `json:"x5c,omitempty"`
+}
+
+// JWKS returns a JWK Set (RFC 7517) holding the public key. The "kid" is the
+// RFC 7638 thumbprint of the key, so that it only changes along with the key.
+// When chain isn't empty, it holds the DER-encoded certificates of the key,
+// leaf first, and is added as "x5c". RSA, ECDSA (P-256, P-384, and P-521), and
+// Ed25519 keys are supported.
+func JWKS(pub crypto.PublicKey, chain [][]byte) ([]byte, error) {
+	jwk, err := newJWK(pub)
+	if err != nil {
+		return nil, err
+	}
+	for _, der := range chain {
+		jwk.X5C = append(jwk.X5C, base64.StdEncoding.EncodeToString(der))
+	}
+
+	jwks, err := json.MarshalIndent(struct {
+		Keys []JWK `json:"keys"`
+	}{[]JWK{jwk}}, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(jwks, '\n'), nil
+}
+
+func newJWK(pub crypto.PublicKey) (JWK, error) {
+	b64 := base64.RawURLEncoding.EncodeToString
+
+	var jwk JWK
+	// The required members, in lexicographic order, as per RFC 7638.
+	var thumbprintInput any
+	switch k := pub.(type) {
+	case *rsa.PublicKey:
+		jwk = JWK{KeyType: "RSA", N: b64(k.N.Bytes()), E: b64(big.NewInt(int64(k.E)).Bytes())}
+		thumbprintInput = struct {
+			E   string `json:"e"`
+			Kty string `json:"kty"`
+			N   string `json:"n"`
+		}{jwk.E, jwk.KeyType, jwk.N}
+	case *ecdsa.PublicKey:
+		name := k.Curve.Params().Name
+		switch name {
+		case "P-256", "P-384", "P-521":
+		default:
+			return JWK{}, fmt.Errorf("%w: ECDSA with the curve %s", errUnsupportedKey, name)
+		}
+		// The coordinates are padded to the size of the curve, as per RFC
+		// 7518, section 6.2.1.2.
+		size := (k.Curve.Params().BitSize + 7) / 8
+		jwk = JWK{KeyType: "EC", Curve: name, X: b64(k.X.FillBytes(make([]byte, size))), Y: b64(k.Y.FillBytes(make([]byte, size)))}
+		thumbprintInput = struct {
+			Crv string `json:"crv"`
+			Kty string `json:"kty"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		}{jwk.Curve, jwk.KeyType, jwk.X, jwk.Y}
+	case ed25519.PublicKey:
+		jwk = JWK{KeyType: "OKP", Curve: "Ed25519", X: b64(k)}
+		thumbprintInput = struct {
+			Crv string `json:"crv"`
+			Kty string `json:"kty"`
+			X   string `json:"x"`
+		}{jwk.Curve, jwk.KeyType, jwk.X}
+	default:
+		return JWK{}, fmt.Errorf("%w %T", errUnsupportedKey, pub)
+	}
+
+	input, err := json.Marshal(thumbprintInput)
+	if err != nil {
+		return JWK{}, err
+	}
+	sum := sha256.Sum256(input)
+	jwk.KeyID = b64(sum[:])
+	jwk.Use = "sig"
+	return jwk, nil
+}
@@ -0,0 +1,140 @@
+package transform
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPublicKeyTransformer(t *testing.T) {
+	crt, key := selfSigned(t, "signer")
+	annots := map[string]string{
+		"secret-transform/public-key": "tls.pub",
+		"secret-transform/jwks":       "jwks.json",
+	}
+
+	t.Run("the public key is taken from tls.crt along with the chain", func(t *testing.T) {
+		given := secret(annots, map[string][]byte{"tls.crt": crt, "tls.key": key})
+		events, err := Apply(given)
+		require.NoError(t, err)
+		assert.Equal(t, []string{
+			"Normal GeneratedPublicKey Wrote the public key of 'tls.crt' into 'tls.pub'",
+			"Normal GeneratedPublicKey Wrote the JWK Set of 'tls.crt' into 'jwks.json'",
+		}, eventStrings(events))
+
+		block, _ := pem.Decode(given.Data["tls.pub"])
+		require.NotNil(t, block)
+		assert.Equal(t, "PUBLIC KEY", block.Type)
+		pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+		require.NoError(t, err)
+
+		var jwks struct{ Keys []JWK }
+		require.NoError(t, json.Unmarshal(given.Data["jwks.json"], &jwks))
+		require.Len(t, jwks.Keys, 1)
+		jwk := jwks.Keys[0]
+		assert.Equal(t, "EC", jwk.KeyType)
+		assert.Equal(t, "P-256", jwk.Curve)
+		assert.Equal(t, "sig", jwk.Use)
+		assert.NotEmpty(t, jwk.KeyID)
+		require.Len(t, jwk.X5C, 1)
+		der, err := base64.StdEncoding.DecodeString(jwk.X5C[0])
+		require.NoError(t, err)
+		cert, err := x509.ParseCertificate(der)
+		require.NoError(t, err)
+		assert.True(t, pub.(*ecdsa.PublicKey).Equal(cert.PublicKey))
+
+		events, err = Apply(given)
+		require.NoError(t, err)
+		assert.Empty(t, events, "the outputs must not change when the key doesn't")
+	})
+
+	t.Run("the outputs follow the rotation of the key", func(t *testing.T) {
+		given := secret(annots, map[string][]byte{"tls.key": key})
+		_, err := Apply(given)
+		require.NoError(t, err)
+		before := string(given.Data["jwks.json"])
+		assert.NotContains(t, before, "x5c", "there is no chain without tls.crt")
+
+		_, given.Data["tls.key"] = selfSigned(t, "signer")
+		events, err := Apply(given)
+		require.NoError(t, err)
+		assert.Equal(t, []string{
+			"Normal GeneratedPublicKey Wrote the public key of 'tls.key' into 'tls.pub'",
+			"Normal GeneratedPublicKey Wrote the JWK Set of 'tls.key' into 'jwks.json'",
+		}, eventStrings(events))
+		assert.NotEqual(t, before, string(given.Data["jwks.json"]))
+	})
+
+	t.Run("invalid inputs", func(t *testing.T) {
+		_, otherKey := selfSigned(t, "other")
+		p224, err := ecdsa.GenerateKey(elliptic.P224(), rand.Reader)
+		require.NoError(t, err)
+
+		tests := []struct {
+			annots map[string]string
+			data   map[string][]byte
+			want   string
+		}{
+			{annots, map[string][]byte{"ca.crt": crt},
+				"Warning FailedPublicKey Secret test-secret must contain the data key 'tls.crt' or 'tls.key' to extract a public key"},
+			{annots, map[string][]byte{"tls.crt": crt, "tls.key": otherKey},
+				"Warning FailedPublicKey the public key of 'tls.crt' doesn't match 'tls.key'"},
+			{annots, map[string][]byte{"tls.crt": []byte("garbage")},
+				"Warning FailedPublicKey no certificate found in 'tls.crt'"},
+			{annots, map[string][]byte{"tls.key": pkcs8PEM(t, p224)},
+				"Warning FailedPublicKey while converting the public key of 'tls.key' to a JWK Set: unsupported private key type: ECDSA with the curve P-224"},
+		}
+		for _, test := range tests {
+			given := secret(test.annots, test.data)
+			events, err := Apply(given)
+			assert.Error(t, err)
+			assert.Equal(t, []string{test.want}, eventStrings(events))
+			assert.NotContains(t, given.Data, "tls.pub")
+			assert.NotContains(t, given.Data, "jwks.json")
+		}
+	})
+}
+
+func TestNewJWK(t *testing.T) {
+	t.Run("the kid is the RFC 7638 thumbprint", func(t *testing.T) {
+		// The example of RFC 7638, section 3.1.
+		n, err := base64.RawURLEncoding.DecodeString("0vx7agoebGcQSuuPiLJXZptN9nndrQmbXEps2aiAFbWhM78LhWx4cbbfAAtVT86zwu1RK7aPFFxuhDR1L6tSoc_BJECPebWKRXjBZCiFV4n3oknjhMstn64tZ_2W-5JsGY4Hc5n9yBXArwl93lqt7_RN5w6Cf0h4QyQ5v-65YGjQR0_FDW2QvzqY368QQMicAtaSqzs8KJZgnYb9c7d0zgdAZHzu6qMQvRL5hajrn1n91CbOpbISD08qNLyrdkt-bFTWhAI4vMQFh6WeZu0fM4lFd2NcRwr3XPksINHaQ-G_xBniIqbw0Ls1jF44-csFCur-kEgU8awapJzKnqDKgw")
+		require.NoError(t, err)
+		jwk, err := newJWK(&rsa.PublicKey{N: new(big.Int).SetBytes(n), E: 65537})
+		require.NoError(t, err)
+		assert.Equal(t, "AQAB", jwk.E)
+		assert.Equal(t, "NzbLsXh8uDCcd-6MNwXF4W_7noWXFZAfHkxZsRGC9Xs", jwk.KeyID)
+	})
+
+	t.Run("the EC coordinates are padded to the size of the curve", func(t *testing.T) {
+		key, err := ecdsa.GenerateKey(elliptic.P521(), rand.Reader)
+		require.NoError(t, err)
+		key.X = big.NewInt(1)
+		jwk, err := newJWK(&key.PublicKey)
+		require.NoError(t, err)
+		x, err := base64.RawURLEncoding.DecodeString(jwk.X)
+		require.NoError(t, err)
+		assert.Len(t, x, 66)
+	})
+
+	t.Run("Ed25519", func(t *testing.T) {
+		pub, _, err := ed25519.GenerateKey(rand.Reader)
+		require.NoError(t, err)
+		jwk, err := newJWK(pub)
+		require.NoError(t, err)
+		assert.Equal(t, "OKP", jwk.KeyType)
+		assert.Equal(t, "Ed25519", jwk.Curve)
+		assert.Equal(t, base64.RawURLEncoding.EncodeToString(pub), jwk.X)
+	})
+}
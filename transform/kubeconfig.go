@@ -0,0 +1,131 @@
+package transform
+
+import (
+	"bytes"
+	"fmt"
+	"net/url"
+
+	corev1 "k8s.io/api/core/v1"
+	clientcmdv1 "k8s.io/client-go/tools/clientcmd/api/v1"
+	"sigs.k8s.io/yaml"
+)
+
+// To render a kubeconfig from a client certificate, use the following
+// annotations on a Secret:
+//
+//	secret-transform/kubeconfig: "kubeconfig"
+//	secret-transform/kubeconfig-server: "https://kube.example.com:6443"
+//	secret-transform/kubeconfig-cluster: "prod"        # Optional.
+//	secret-transform/kubeconfig-user: "ci-bot"         # Optional.
+//	secret-transform/kubeconfig-namespace: "ci"        # Optional.
+//
+// The kubeconfig is written into the data key given in the first annotation,
+// and embeds tls.crt, tls.key, and ca.crt (when present) inline. The cluster
+// name defaults to "default", and the user name to the common name of the
+// certificate.
+const (
+	KubeconfigAnnotKey          = "secret-transform/kubeconfig"
+	KubeconfigServerAnnotKey    = "secret-transform/kubeconfig-server"
+	KubeconfigClusterAnnotKey   = "secret-transform/kubeconfig-cluster"
+	KubeconfigUserAnnotKey      = "secret-transform/kubeconfig-user"
+	KubeconfigNamespaceAnnotKey = "secret-transform/kubeconfig-namespace"
+)
+
+// Kubeconfig returns a kubeconfig with a single cluster, user, and context,
+// which is also the current context. The certificates and the key are
+// embedded. caCrt may be empty, in which case the system roots are used to
+// verify the server. The output only depends on the inputs, so that the
+// kubeconfig is only rewritten when one of them changes.
+func Kubeconfig(server, cluster, user, namespace string, tlsCrt, tlsKey, caCrt []byte) ([]byte, error) {
+	context := user + "@" + cluster
+	cfg := clientcmdv1.Config{
+		APIVersion: "v1",
+		Kind:       "Config",
+		Clusters: []clientcmdv1.NamedCluster{{
+			Name: cluster,
+			Cluster: clientcmdv1.Cluster{
+				Server:                   server,
+				CertificateAuthorityData: caCrt,
+			},
+		}},
+		AuthInfos: []clientcmdv1.NamedAuthInfo{{
+			Name: user,
+			AuthInfo: clientcmdv1.AuthInfo{
+				ClientCertificateData: tlsCrt,
+				ClientKeyData:         tlsKey,
+			},
+		}},
+		Contexts: []clientcmdv1.NamedContext{{
+			Name: context,
+			Context: clientcmdv1.Context{
+				Cluster:   cluster,
+				AuthInfo:  user,
+				Namespace: namespace,
+			},
+		}},
+		CurrentContext: context,
+	}
+	return yaml.Marshal(cfg)
+}
+
+// Handles the "secret-transform/kubeconfig*" annotations.
+type kubeconfigTransformer struct{}
+
+func (kubeconfigTransformer) Name() string { return "kubeconfig" }
+
+func (kubeconfigTransformer) Annotations() []string {
+	return []string{KubeconfigAnnotKey, KubeconfigServerAnnotKey, KubeconfigClusterAnnotKey, KubeconfigUserAnnotKey, KubeconfigNamespaceAnnotKey}
+}
+
+func (kubeconfigTransformer) ReadsTLSKey(map[string]string) bool { return true }
+
+func (kubeconfigTransformer) Apply(secret *corev1.Secret) ([]Event, error) {
+	annots := secret.GetAnnotations()
+	fail := func(format string, args ...any) ([]Event, error) {
+		err := fmt.Errorf(format, args...)
+		return []Event{{corev1.EventTypeWarning, "FailedKubeconfig", err.Error()}}, err
+	}
+
+	key := annots[KubeconfigAnnotKey]
+	if key == "" {
+		return fail("the annotation '%s' is required to render a kubeconfig", KubeconfigAnnotKey)
+	}
+	server := annots[KubeconfigServerAnnotKey]
+	if server == "" {
+		return fail("the annotation '%s' is required to render a kubeconfig", KubeconfigServerAnnotKey)
+	}
+	if u, err := url.Parse(server); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return fail("annot '%s': '%s' isn't a valid URL, e.g., https://kube.example.com:6443", KubeconfigServerAnnotKey, server)
+	}
+
+	tlsCrt, tlsKey := secret.Data[corev1.TLSCertKey], secret.Data[corev1.TLSPrivateKeyKey]
+	if len(tlsCrt) == 0 || len(tlsKey) == 0 {
+		return fail("Secret %s must contain the data keys 'tls.crt' and 'tls.key' to render a kubeconfig", secret.Name)
+	}
+
+	user := annots[KubeconfigUserAnnotKey]
+	if user == "" {
+		commonName, err := certField("commonName", string(tlsCrt))
+		if err != nil || commonName == "" {
+			return fail("the certificate in 'tls.crt' has no common name, set the annotation '%s'", KubeconfigUserAnnotKey)
+		}
+		user = commonName
+	}
+	cluster := annots[KubeconfigClusterAnnotKey]
+	if cluster == "" {
+		cluster = "default"
+	}
+
+	kubeconfig, err := Kubeconfig(server, cluster, user, annots[KubeconfigNamespaceAnnotKey], tlsCrt, tlsKey, secret.Data["ca.crt"])
+	if err != nil {
+		return fail("while rendering the kubeconfig: %v", err)
+	}
+	if bytes.Equal(secret.Data[key], kubeconfig) {
+		return nil, nil
+	}
+	if secret.Data == nil {
+		secret.Data = make(map[string][]byte)
+	}
+	secret.Data[key] = kubeconfig
+	return []Event{{corev1.EventTypeNormal, "GeneratedKubeconfig", fmt.Sprintf("Rendered the kubeconfig of user '%s' into key '%s'", user, key)}}, nil
+}
@@ -0,0 +1,88 @@
+package transform
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+func TestKubeconfigTransformer(t *testing.T) {
+	crt, key := selfSigned(t, "ci-bot")
+	ca, _ := selfSigned(t, "ca")
+	annots := func(extra ...string) map[string]string {
+		m := map[string]string{
+			"secret-transform/kubeconfig":        "kubeconfig",
+			"secret-transform/kubeconfig-server": "https://kube.example.com:6443",
+		}
+		for i := 0; i < len(extra); i += 2 {
+			m[extra[i]] = extra[i+1]
+		}
+		return m
+	}
+
+	t.Run("the kubeconfig embeds the certificates and defaults to the common name", func(t *testing.T) {
+		given := secret(annots("secret-transform/kubeconfig-namespace", "ci"), map[string][]byte{"tls.crt": crt, "tls.key": key, "ca.crt": ca})
+		events, err := Apply(given)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"Normal GeneratedKubeconfig Rendered the kubeconfig of user 'ci-bot' into key 'kubeconfig'"}, eventStrings(events))
+
+		cfg, err := clientcmd.Load(given.Data["kubeconfig"])
+		require.NoError(t, err)
+		assert.Equal(t, "ci-bot@default", cfg.CurrentContext)
+		assert.Equal(t, "https://kube.example.com:6443", cfg.Clusters["default"].Server)
+		assert.Equal(t, ca, cfg.Clusters["default"].CertificateAuthorityData)
+		assert.Equal(t, crt, cfg.AuthInfos["ci-bot"].ClientCertificateData)
+		assert.Equal(t, key, cfg.AuthInfos["ci-bot"].ClientKeyData)
+		assert.Equal(t, "ci", cfg.Contexts["ci-bot@default"].Namespace)
+
+		events, err = Apply(given)
+		require.NoError(t, err)
+		assert.Empty(t, events, "the kubeconfig must not change when the certificate doesn't")
+	})
+
+	t.Run("the kubeconfig is regenerated when the certificate is renewed", func(t *testing.T) {
+		given := secret(annots("secret-transform/kubeconfig-cluster", "prod", "secret-transform/kubeconfig-user", "bot"), map[string][]byte{"tls.crt": crt, "tls.key": key})
+		_, err := Apply(given)
+		require.NoError(t, err)
+		before := string(given.Data["kubeconfig"])
+
+		given.Data["tls.crt"], given.Data["tls.key"] = selfSigned(t, "ci-bot")
+		events, err := Apply(given)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"Normal GeneratedKubeconfig Rendered the kubeconfig of user 'bot' into key 'kubeconfig'"}, eventStrings(events))
+		assert.NotEqual(t, before, string(given.Data["kubeconfig"]))
+
+		cfg, err := clientcmd.Load(given.Data["kubeconfig"])
+		require.NoError(t, err)
+		assert.Equal(t, "bot@prod", cfg.CurrentContext)
+		assert.Empty(t, cfg.Clusters["prod"].CertificateAuthorityData)
+	})
+
+	t.Run("invalid inputs", func(t *testing.T) {
+		tests := []struct {
+			annots map[string]string
+			data   map[string][]byte
+			want   string
+		}{
+			{map[string]string{"secret-transform/kubeconfig-server": "https://kube"}, map[string][]byte{"tls.crt": crt, "tls.key": key},
+				"Warning FailedKubeconfig the annotation 'secret-transform/kubeconfig' is required to render a kubeconfig"},
+			{map[string]string{"secret-transform/kubeconfig": "kubeconfig"}, map[string][]byte{"tls.crt": crt, "tls.key": key},
+				"Warning FailedKubeconfig the annotation 'secret-transform/kubeconfig-server' is required to render a kubeconfig"},
+			{annots("secret-transform/kubeconfig-server", "kube.example.com"), map[string][]byte{"tls.crt": crt, "tls.key": key},
+				"Warning FailedKubeconfig annot 'secret-transform/kubeconfig-server': 'kube.example.com' isn't a valid URL, e.g., https://kube.example.com:6443"},
+			{annots(), map[string][]byte{"tls.crt": crt},
+				"Warning FailedKubeconfig Secret test-secret must contain the data keys 'tls.crt' and 'tls.key' to render a kubeconfig"},
+			{annots(), map[string][]byte{"tls.crt": []byte("garbage"), "tls.key": key},
+				"Warning FailedKubeconfig the certificate in 'tls.crt' has no common name, set the annotation 'secret-transform/kubeconfig-user'"},
+		}
+		for _, test := range tests {
+			given := secret(test.annots, test.data)
+			events, err := Apply(given)
+			assert.Error(t, err)
+			assert.Equal(t, []string{test.want}, eventStrings(events))
+			assert.NotContains(t, given.Data, "kubeconfig")
+		}
+	})
+}
@@ -0,0 +1,226 @@
+package transform
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/des"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"hash"
+	"sort"
+)
+
+// The PBES2 encryption of PKCS#8 private keys (RFC 8018), as done by
+// "openssl pkcs8 -topk8 -v2 aes-256-cbc". The standard library doesn't
+// support it.
+
+var (
+	oidPBES2  = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 13}
+	oidPBKDF2 = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 12}
+
+	oidHMACWithSHA1   = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 7}
+	oidHMACWithSHA256 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 9}
+	oidHMACWithSHA384 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 10}
+	oidHMACWithSHA512 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 11}
+)
+
+// The number of PBKDF2 iterations used when encrypting.
+const pbkdf2Iterations = 100_000
+
+// The PBES2 encryption schemes, keyed by the name OpenSSL gives them.
+var pbes2Ciphers = map[string]pbes2Cipher{
+	"aes-128-cbc":  {asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 2}, 16, aes.NewCipher},
+	"aes-192-cbc":  {asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 22}, 24, aes.NewCipher},
+	"aes-256-cbc":  {asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}, 32, aes.NewCipher},
+	"des-ede3-cbc": {asn1.ObjectIdentifier{1, 2, 840, 113549, 3, 7}, 24, des.NewTripleDESCipher},
+}
+
+// The cipher used when none is given.
+const defaultPBES2Cipher = "aes-256-cbc"
+
+type pbes2Cipher struct {
+	oid     asn1.ObjectIdentifier
+	keySize int
+	new     func(key []byte) (cipher.Block, error)
+}
+
+// Returns the names of the supported ciphers, sorted.
+func pbes2CipherNames() []string {
+	var names []string
+	for name := range pbes2Ciphers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+type encryptedPrivateKeyInfo struct {
+	Algo          pkix.AlgorithmIdentifier
+	EncryptedData []byte
+}
+
+type pbes2Params struct {
+	KeyDerivationFunc pkix.AlgorithmIdentifier
+	EncryptionScheme  pkix.AlgorithmIdentifier
+}
+
+type pbkdf2Params struct {
+	Salt           []byte
+	IterationCount int
+	KeyLength      int                      `asn1:"optional"`
+	PRF            pkix.AlgorithmIdentifier `asn1:"optional"`
+}
+
+// Encrypts the DER-encoded PKCS#8 private key with PBES2, using PBKDF2 with
+// HMAC-SHA256 and the given cipher. Returns an "ENCRYPTED PRIVATE KEY" PEM
+// block. The salt and the IV are random, so the output changes every time.
+func encryptPKCS8(der, passphrase []byte, cipherName string) (*pem.Block, error) {
+	c, found := pbes2Ciphers[cipherName]
+	if !found {
+		return nil, fmt.Errorf("unsupported cipher '%s'", cipherName)
+	}
+
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	key, err := pbkdf2.Key(sha256.New, string(passphrase), salt, pbkdf2Iterations, c.keySize)
+	if err != nil {
+		return nil, err
+	}
+	block, err := c.new(key)
+	if err != nil {
+		return nil, err
+	}
+	iv := make([]byte, block.BlockSize())
+	if _, err := rand.Read(iv); err != nil {
+		return nil, err
+	}
+	padding := block.BlockSize() - len(der)%block.BlockSize()
+	encrypted := append(bytes.Clone(der), bytes.Repeat([]byte{byte(padding)}, padding)...)
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(encrypted, encrypted)
+
+	kdfParams, err := asn1.Marshal(pbkdf2Params{
+		Salt:           salt,
+		IterationCount: pbkdf2Iterations,
+		PRF:            pkix.AlgorithmIdentifier{Algorithm: oidHMACWithSHA256, Parameters: asn1.NullRawValue},
+	})
+	if err != nil {
+		return nil, err
+	}
+	ivParam, err := asn1.Marshal(iv)
+	if err != nil {
+		return nil, err
+	}
+	params, err := asn1.Marshal(pbes2Params{
+		KeyDerivationFunc: pkix.AlgorithmIdentifier{Algorithm: oidPBKDF2, Parameters: asn1.RawValue{FullBytes: kdfParams}},
+		EncryptionScheme:  pkix.AlgorithmIdentifier{Algorithm: c.oid, Parameters: asn1.RawValue{FullBytes: ivParam}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	info, err := asn1.Marshal(encryptedPrivateKeyInfo{
+		Algo:          pkix.AlgorithmIdentifier{Algorithm: oidPBES2, Parameters: asn1.RawValue{FullBytes: params}},
+		EncryptedData: encrypted,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &pem.Block{Type: "ENCRYPTED PRIVATE KEY", Bytes: info}, nil
+}
+
+// errIncorrectPassphrase is returned when a private key can't be decrypted
+// with the given passphrase.
+var errIncorrectPassphrase = errors.New("the passphrase is incorrect")
+
+// Decrypts a PBES2-encrypted PKCS#8 private key. Returns the DER-encoded
+// PKCS#8 private key along with the name of the cipher it was encrypted with.
+func decryptPKCS8(der, passphrase []byte) (_ []byte, cipherName string, _ error) {
+	var info encryptedPrivateKeyInfo
+	if rest, err := asn1.Unmarshal(der, &info); err != nil || len(rest) > 0 {
+		return nil, "", fmt.Errorf("invalid encrypted private key")
+	}
+	if !info.Algo.Algorithm.Equal(oidPBES2) {
+		return nil, "", fmt.Errorf("unsupported encryption %s, only PBES2 is supported", info.Algo.Algorithm)
+	}
+	var params pbes2Params
+	if _, err := asn1.Unmarshal(info.Algo.Parameters.FullBytes, &params); err != nil {
+		return nil, "", fmt.Errorf("invalid PBES2 parameters: %w", err)
+	}
+	if !params.KeyDerivationFunc.Algorithm.Equal(oidPBKDF2) {
+		return nil, "", fmt.Errorf("unsupported key derivation function %s, only PBKDF2 is supported", params.KeyDerivationFunc.Algorithm)
+	}
+	var kdf pbkdf2Params
+	if _, err := asn1.Unmarshal(params.KeyDerivationFunc.Parameters.FullBytes, &kdf); err != nil {
+		return nil, "", fmt.Errorf("invalid PBKDF2 parameters: %w", err)
+	}
+
+	// Keeps a crafted key from stalling the controller.
+	if kdf.IterationCount <= 0 || kdf.IterationCount > 10_000_000 {
+		return nil, "", fmt.Errorf("invalid PBKDF2 iteration count %d", kdf.IterationCount)
+	}
+
+	var h func() hash.Hash
+	switch prf := kdf.PRF.Algorithm; {
+	case len(prf) == 0 || prf.Equal(oidHMACWithSHA1):
+		h = sha1.New
+	case prf.Equal(oidHMACWithSHA256):
+		h = sha256.New
+	case prf.Equal(oidHMACWithSHA384):
+		h = sha512.New384
+	case prf.Equal(oidHMACWithSHA512):
+		h = sha512.New
+	default:
+		return nil, "", fmt.Errorf("unsupported PBKDF2 pseudorandom function %s", prf)
+	}
+
+	var c pbes2Cipher
+	for name, candidate := range pbes2Ciphers {
+		if candidate.oid.Equal(params.EncryptionScheme.Algorithm) {
+			c, cipherName = candidate, name
+		}
+	}
+	if cipherName == "" {
+		return nil, "", fmt.Errorf("unsupported cipher %s", params.EncryptionScheme.Algorithm)
+	}
+	var iv []byte
+	if _, err := asn1.Unmarshal(params.EncryptionScheme.Parameters.FullBytes, &iv); err != nil {
+		return nil, "", fmt.Errorf("invalid IV: %w", err)
+	}
+
+	key, err := pbkdf2.Key(h, string(passphrase), kdf.Salt, kdf.IterationCount, c.keySize)
+	if err != nil {
+		return nil, "", err
+	}
+	block, err := c.new(key)
+	if err != nil {
+		return nil, "", err
+	}
+	if len(iv) != block.BlockSize() || len(info.EncryptedData) == 0 || len(info.EncryptedData)%block.BlockSize() != 0 {
+		return nil, "", fmt.Errorf("invalid encrypted private key")
+	}
+	decrypted := make([]byte, len(info.EncryptedData))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(decrypted, info.EncryptedData)
+
+	// A wrong passphrase gives garbage, which is almost always caught by the
+	// padding check, and otherwise by the DER check.
+	padding := int(decrypted[len(decrypted)-1])
+	if padding == 0 || padding > block.BlockSize() || !bytes.Equal(decrypted[len(decrypted)-padding:], bytes.Repeat([]byte{byte(padding)}, padding)) {
+		return nil, "", errIncorrectPassphrase
+	}
+	decrypted = decrypted[:len(decrypted)-padding]
+	var raw asn1.RawValue
+	if rest, err := asn1.Unmarshal(decrypted, &raw); err != nil || len(rest) > 0 {
+		return nil, "", errIncorrectPassphrase
+	}
+	return decrypted, cipherName, nil
+}
@@ -0,0 +1,198 @@
+package transform
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// To convert tls.key into an SSH key pair, use the following annotations on a
+// Secret:
+//
+//	secret-transform/ssh-private-key: "id_ecdsa"
+//	secret-transform/ssh-authorized-key: "authorized_keys"
+//	secret-transform/ssh-comment: "git-mirror@example.com"  # Optional.
+//
+// The first annotation gives the data key in which the private key is written
+// in the OpenSSH format, and the second one the data key in which the public
+// key is written as an authorized_keys line. Each of them can be used on its
+// own. RSA, ECDSA (P-256, P-384, and P-521), and Ed25519 keys are supported.
+const (
+	SSHPrivateKeyAnnotKey    = "secret-transform/ssh-private-key"
+	SSHAuthorizedKeyAnnotKey = "secret-transform/ssh-authorized-key"
+	SSHCommentAnnotKey       = "secret-transform/ssh-comment"
+)
+
+// Handles the "secret-transform/ssh-*" annotations.
+type sshTransformer struct{}
+
+func (sshTransformer) Name() string { return "ssh" }
+
+func (sshTransformer) Annotations() []string {
+	return []string{SSHPrivateKeyAnnotKey, SSHAuthorizedKeyAnnotKey, SSHCommentAnnotKey}
+}
+
+func (sshTransformer) ReadsTLSKey(map[string]string) bool { return true }
+
+func (sshTransformer) Apply(secret *corev1.Secret) ([]Event, error) {
+	annots := secret.GetAnnotations()
+	privKey, authKey, comment := annots[SSHPrivateKeyAnnotKey], annots[SSHAuthorizedKeyAnnotKey], annots[SSHCommentAnnotKey]
+	if privKey == "" && authKey == "" {
+		err := fmt.Errorf("the annotation '%s' or '%s' is required along with '%s'", SSHPrivateKeyAnnotKey, SSHAuthorizedKeyAnnotKey, SSHCommentAnnotKey)
+		return []Event{{corev1.EventTypeWarning, "FailedSSHKey", err.Error()}}, err
+	}
+	if strings.ContainsAny(comment, "\r\n") {
+		err := fmt.Errorf("annot '%s': the comment must fit on a single line", SSHCommentAnnotKey)
+		return []Event{{corev1.EventTypeWarning, "FailedSSHKey", err.Error()}}, err
+	}
+
+	tlsKey, found := secret.Data[corev1.TLSPrivateKeyKey]
+	if !found {
+		err := fmt.Errorf("Secret %s does not contain a 'tls.key' data key", secret.Name)
+		return []Event{{corev1.EventTypeWarning, "MissingTLSKey", err.Error()}}, err
+	}
+	key, err := parseSSHKey(tlsKey)
+	switch {
+	case errors.Is(err, errUnsupportedKey):
+		err = fmt.Errorf("the key in 'tls.key' can't be used with SSH: %w", err)
+		return []Event{{corev1.EventTypeWarning, "UnsupportedSSHKey", err.Error()}}, err
+	case err != nil:
+		err = fmt.Errorf("while parsing 'tls.key': %w", err)
+		return []Event{{corev1.EventTypeWarning, "FailedSSHKey", err.Error()}}, err
+	}
+
+	outputs := make(map[string][]byte)
+	if privKey != "" {
+		block, err := ssh.MarshalPrivateKey(key, comment)
+		if err != nil {
+			err = fmt.Errorf("while converting 'tls.key' to the OpenSSH format: %w", err)
+			return []Event{{corev1.EventTypeWarning, "FailedSSHKey", err.Error()}}, err
+		}
+		// The private key embeds random check bytes, so it is only replaced
+		// when the key or the comment changed.
+		if data := pem.EncodeToMemory(block); !sameOpenSSHPrivateKey(secret.Data[privKey], data) {
+			outputs[privKey] = data
+		}
+	}
+	if authKey != "" {
+		pub, err := ssh.NewPublicKey(key.Public())
+		if err != nil {
+			err = fmt.Errorf("while converting the public key of 'tls.key': %w", err)
+			return []Event{{corev1.EventTypeWarning, "FailedSSHKey", err.Error()}}, err
+		}
+		line := bytes.TrimSuffix(ssh.MarshalAuthorizedKey(pub), []byte("\n"))
+		if comment != "" {
+			line = append(line, " "+comment...)
+		}
+		line = append(line, '\n')
+		if !bytes.Equal(secret.Data[authKey], line) {
+			outputs[authKey] = line
+		}
+	}
+
+	var events []Event
+	if data, found := outputs[privKey]; found {
+		secret.Data[privKey] = data
+		events = append(events, Event{corev1.EventTypeNormal, "GeneratedSSHKey", fmt.Sprintf("Converted 'tls.key' into the OpenSSH private key '%s'", privKey)})
+	}
+	if data, found := outputs[authKey]; found {
+		secret.Data[authKey] = data
+		events = append(events, Event{corev1.EventTypeNormal, "GeneratedSSHKey", fmt.Sprintf("Wrote the public key of 'tls.key' into the authorized_keys file '%s'", authKey)})
+	}
+	return events, nil
+}
+
+// Parses the private key and checks that it can be used with SSH. ECDSA keys
+// are limited to the curves supported by OpenSSH.
+func parseSSHKey(data []byte) (crypto.Signer, error) {
+	key, err := parsePrivateKeyPEM(data)
+	if err != nil {
+		return nil, err
+	}
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		return k, nil
+	case ed25519.PrivateKey:
+		return k, nil
+	case *ecdsa.PrivateKey:
+		switch name := k.Curve.Params().Name; name {
+		case "P-256", "P-384", "P-521":
+			return k, nil
+		default:
+			return nil, fmt.Errorf("%w: ECDSA with the curve %s", errUnsupportedKey, name)
+		}
+	default:
+		return nil, fmt.Errorf("%w %T", errUnsupportedKey, key)
+	}
+}
+
+// Returns true if both PEM-encoded OpenSSH private keys are the same once the
+// random check bytes are ignored. The unencrypted format is:
+//
+//	"openssh-key-v1\x00" ciphername kdfname kdfoptions uint32(n) pubkey private
+//
+// where each field but n is a length-prefixed string, and where private starts
+// with the two check uint32s.
+func sameOpenSSHPrivateKey(a, b []byte) bool {
+	aBlock, _ := pem.Decode(a)
+	bBlock, _ := pem.Decode(b)
+	if aBlock == nil || bBlock == nil || aBlock.Type != bBlock.Type {
+		return false
+	}
+	aPriv, aOK := openSSHPrivateSection(aBlock.Bytes)
+	bPriv, bOK := openSSHPrivateSection(bBlock.Bytes)
+	if !aOK || !bOK || len(aPriv) < 8 || len(bPriv) < 8 {
+		return false
+	}
+	aHeader := aBlock.Bytes[:len(aBlock.Bytes)-len(aPriv)]
+	bHeader := bBlock.Bytes[:len(bBlock.Bytes)-len(bPriv)]
+	return bytes.Equal(aHeader, bHeader) && bytes.Equal(aPriv[8:], bPriv[8:])
+}
+
+// Returns the private section of an OpenSSH private key.
+func openSSHPrivateSection(data []byte) ([]byte, bool) {
+	const magic = "openssh-key-v1\x00"
+	rest, found := bytes.CutPrefix(data, []byte(magic))
+	if !found {
+		return nil, false
+	}
+	readString := func() ([]byte, bool) {
+		if len(rest) < 4 {
+			return nil, false
+		}
+		n := binary.BigEndian.Uint32(rest)
+		if uint64(len(rest)-4) < uint64(n) {
+			return nil, false
+		}
+		s := rest[4 : 4+n]
+		rest = rest[4+n:]
+		return s, true
+	}
+	for range 3 { // ciphername, kdfname, kdfoptions.
+		if _, ok := readString(); !ok {
+			return nil, false
+		}
+	}
+	if len(rest) < 4 {
+		return nil, false
+	}
+	rest = rest[4:] // Number of keys.
+	if _, ok := readString(); !ok {
+		return nil, false
+	}
+	priv, ok := readString()
+	if !ok || len(rest) != 0 {
+		return nil, false
+	}
+	return priv, true
+}
@@ -0,0 +1,136 @@
+package transform
+
+import (
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+)
+
+func pkcs8PEM(t *testing.T, key any) []byte {
+	t.Helper()
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	require.NoError(t, err)
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+}
+
+func TestSSHTransformer(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	require.NoError(t, err)
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	annots := map[string]string{
+		"secret-transform/ssh-private-key":    "id_ssh",
+		"secret-transform/ssh-authorized-key": "authorized_keys",
+		"secret-transform/ssh-comment":        "git-mirror@example.com",
+	}
+	for name, key := range map[string]crypto.Signer{"rsa": rsaKey, "ecdsa": ecKey, "ed25519": edKey} {
+		t.Run(name, func(t *testing.T) {
+			given := secret(annots, map[string][]byte{"tls.key": pkcs8PEM(t, key)})
+			events, err := Apply(given)
+			require.NoError(t, err)
+			assert.Equal(t, []string{
+				"Normal GeneratedSSHKey Converted 'tls.key' into the OpenSSH private key 'id_ssh'",
+				"Normal GeneratedSSHKey Wrote the public key of 'tls.key' into the authorized_keys file 'authorized_keys'",
+			}, eventStrings(events))
+
+			signer, err := ssh.ParsePrivateKey(given.Data["id_ssh"])
+			require.NoError(t, err)
+			pub, comment, _, rest, err := ssh.ParseAuthorizedKey(given.Data["authorized_keys"])
+			require.NoError(t, err)
+			assert.Empty(t, rest)
+			assert.Equal(t, "git-mirror@example.com", comment)
+			assert.Equal(t, signer.PublicKey().Marshal(), pub.Marshal())
+
+			events, err = Apply(given)
+			require.NoError(t, err)
+			assert.Empty(t, events, "the outputs must not change when the key doesn't")
+		})
+	}
+
+	t.Run("the private key is rewritten when the comment changes", func(t *testing.T) {
+		given := secret(map[string]string{"secret-transform/ssh-private-key": "id_ssh"}, map[string][]byte{"tls.key": pkcs8PEM(t, edKey)})
+		_, err := Apply(given)
+		require.NoError(t, err)
+
+		given.Annotations["secret-transform/ssh-comment"] = "new"
+		events, err := Apply(given)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"Normal GeneratedSSHKey Converted 'tls.key' into the OpenSSH private key 'id_ssh'"}, eventStrings(events))
+	})
+
+	t.Run("the authorized_keys line has no comment by default", func(t *testing.T) {
+		given := secret(map[string]string{"secret-transform/ssh-authorized-key": "authorized_keys"}, map[string][]byte{"tls.key": pkcs8PEM(t, edKey)})
+		_, err := Apply(given)
+		require.NoError(t, err)
+		pub, err := ssh.NewPublicKey(edKey.Public())
+		require.NoError(t, err)
+		assert.Equal(t, string(ssh.MarshalAuthorizedKey(pub)), string(given.Data["authorized_keys"]))
+		assert.NotContains(t, given.Data, "id_ssh")
+	})
+
+	t.Run("invalid inputs", func(t *testing.T) {
+		p224, err := ecdsa.GenerateKey(elliptic.P224(), rand.Reader)
+		require.NoError(t, err)
+		p224DER, err := x509.MarshalECPrivateKey(p224)
+		require.NoError(t, err)
+		x25519, err := ecdh.X25519().GenerateKey(rand.Reader)
+		require.NoError(t, err)
+
+		tests := []struct {
+			annots map[string]string
+			data   map[string][]byte
+			want   string
+		}{
+			{annots, map[string][]byte{"tls.key": pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: p224DER})},
+				"Warning UnsupportedSSHKey the key in 'tls.key' can't be used with SSH: unsupported private key type: ECDSA with the curve P-224"},
+			{annots, map[string][]byte{"tls.key": pkcs8PEM(t, x25519)},
+				"Warning UnsupportedSSHKey the key in 'tls.key' can't be used with SSH: unsupported private key type *ecdh.PrivateKey"},
+			{annots, map[string][]byte{"tls.key": []byte("garbage")},
+				"Warning FailedSSHKey while parsing 'tls.key': no private key found"},
+			{annots, map[string][]byte{"tls.crt": []byte("crt")},
+				"Warning MissingTLSKey Secret test-secret does not contain a 'tls.key' data key"},
+			{map[string]string{"secret-transform/ssh-comment": "foo"}, map[string][]byte{"tls.key": pkcs8PEM(t, edKey)},
+				"Warning FailedSSHKey the annotation 'secret-transform/ssh-private-key' or 'secret-transform/ssh-authorized-key' is required along with 'secret-transform/ssh-comment'"},
+			{map[string]string{"secret-transform/ssh-authorized-key": "authorized_keys", "secret-transform/ssh-comment": "foo\nssh-rsa AAAA"}, map[string][]byte{"tls.key": pkcs8PEM(t, edKey)},
+				"Warning FailedSSHKey annot 'secret-transform/ssh-comment': the comment must fit on a single line"},
+		}
+		for _, test := range tests {
+			given := secret(test.annots, test.data)
+			events, err := Apply(given)
+			assert.Error(t, err)
+			assert.Equal(t, []string{test.want}, eventStrings(events))
+			assert.NotContains(t, given.Data, "id_ssh")
+			assert.NotContains(t, given.Data, "authorized_keys")
+		}
+	})
+}
+
+func TestSameOpenSSHPrivateKey(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	marshal := func(comment string) []byte {
+		block, err := ssh.MarshalPrivateKey(key, comment)
+		require.NoError(t, err)
+		return pem.EncodeToMemory(block)
+	}
+
+	a, b := marshal("foo"), marshal("foo")
+	assert.True(t, sameOpenSSHPrivateKey(a, b))
+	assert.False(t, sameOpenSSHPrivateKey(a, marshal("bar")))
+	assert.False(t, sameOpenSSHPrivateKey(a, nil))
+	assert.False(t, sameOpenSSHPrivateKey(a, pkcs8PEM(t, key)))
+}
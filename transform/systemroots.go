@@ -0,0 +1,146 @@
+package transform
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// To write ca.crt along with the root CAs of the operating system into a new
+// data key, use the following annotation on a Secret:
+//
+//	secret-transform/ca-bundle-with-system-roots: "ca-bundle.crt"
+//
+// The root store that was used is recorded in the annotation
+// "secret-transform/system-roots-version", which is set by the transformer.
+const (
+	CABundleWithSystemRootsAnnotKey = "secret-transform/ca-bundle-with-system-roots"
+	SystemRootsVersionAnnotKey      = "secret-transform/system-roots-version"
+)
+
+// DefaultSystemRootsFile is where Debian, Alpine, and the distroless and
+// Chainguard static images keep their root store. The controller image is
+// built on the Chainguard static image.
+const DefaultSystemRootsFile = "/etc/ssl/certs/ca-certificates.crt"
+
+// SystemRoots is a root store read from a PEM file.
+type SystemRoots struct {
+	Certs []*x509.Certificate
+
+	// Identifies the root store: the version given to SetSystemRootsFile, if
+	// any, followed by the SHA-256 digest of the PEM file, e.g.,
+	// "2024.2.69 (sha256:9c6d9b7e3f21)".
+	Version string
+}
+
+var systemRoots = systemRootsFile{path: DefaultSystemRootsFile}
+
+// SetSystemRootsFile changes the PEM file holding the root store appended to
+// the CA bundles. The version, which may be empty, is recorded along with the
+// digest of the file, e.g., the version of the ca-certificates package.
+func SetSystemRootsFile(path, version string) {
+	systemRoots.mu.Lock()
+	defer systemRoots.mu.Unlock()
+	systemRoots.path, systemRoots.version = path, version
+	systemRoots.cached = nil
+}
+
+// LoadSystemRoots returns the root store appended to the CA bundles. The file
+// is only parsed again when it changes, e.g., when the ConfigMap it is
+// mounted from is updated.
+func LoadSystemRoots() (*SystemRoots, error) {
+	return systemRoots.load()
+}
+
+type systemRootsFile struct {
+	mu      sync.Mutex
+	path    string
+	version string
+
+	cached  *SystemRoots
+	modTime time.Time
+	size    int64
+}
+
+func (f *systemRootsFile) load() (*SystemRoots, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return nil, err
+	}
+	if f.cached != nil && info.ModTime().Equal(f.modTime) && info.Size() == f.size {
+		return f.cached, nil
+	}
+
+	data, err := os.ReadFile(f.path)
+	if err != nil {
+		return nil, err
+	}
+	certs, err := ParseCertificates(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", f.path, err)
+	}
+	sum := sha256.Sum256(data)
+	version := "sha256:" + hex.EncodeToString(sum[:])[:12]
+	if f.version != "" {
+		version = f.version + " (" + version + ")"
+	}
+
+	f.cached = &SystemRoots{Certs: certs, Version: version}
+	f.modTime, f.size = info.ModTime(), info.Size()
+	return f.cached, nil
+}
+
+// Handles the "secret-transform/ca-bundle-with-system-roots" annotation.
+type systemRootsTransformer struct{}
+
+func (systemRootsTransformer) Name() string { return "system-roots" }
+
+func (systemRootsTransformer) Annotations() []string {
+	return []string{CABundleWithSystemRootsAnnotKey}
+}
+
+func (systemRootsTransformer) ReadsTLSKey(map[string]string) bool { return false }
+
+func (systemRootsTransformer) Apply(secret *corev1.Secret) ([]Event, error) {
+	fail := func(format string, args ...any) ([]Event, error) {
+		err := fmt.Errorf(format, args...)
+		return []Event{{corev1.EventTypeWarning, "FailedSystemRoots", err.Error()}}, err
+	}
+	key := secret.GetAnnotations()[CABundleWithSystemRootsAnnotKey]
+
+	// An empty or missing ca.crt, as with the certificates issued by ACME,
+	// gives a bundle of the system roots only.
+	var caCerts []*x509.Certificate
+	if caCrt := secret.Data["ca.crt"]; len(bytes.TrimSpace(caCrt)) > 0 {
+		var err error
+		caCerts, err = ParseCertificates(caCrt)
+		if err != nil {
+			return fail("while parsing 'ca.crt': %v", err)
+		}
+	}
+	roots, err := LoadSystemRoots()
+	if err != nil {
+		return fail("while loading the system roots: %v", err)
+	}
+
+	bundle := EncodePEMBundle(Bundle(append(append([]*x509.Certificate(nil), caCerts...), roots.Certs...)))
+	if bytes.Equal(secret.Data[key], bundle) && secret.Annotations[SystemRootsVersionAnnotKey] == roots.Version {
+		return nil, nil
+	}
+	if secret.Data == nil {
+		secret.Data = make(map[string][]byte)
+	}
+	secret.Data[key] = bundle
+	secret.Annotations[SystemRootsVersionAnnotKey] = roots.Version
+	return []Event{{corev1.EventTypeNormal, "AddedSystemRoots", fmt.Sprintf("Wrote the %d certificates of 'ca.crt' and the %d system roots, version %s, into '%s'", len(caCerts), len(roots.Certs), roots.Version, key)}}, nil
+}
@@ -0,0 +1,103 @@
+package transform
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Points the system roots to a file holding the given certificates, and
+// restores the default once the test is done.
+func withSystemRoots(t *testing.T, version string, certs ...[]byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "ca-certificates.crt")
+	writeSystemRoots(t, path, certs...)
+	SetSystemRootsFile(path, version)
+	t.Cleanup(func() { SetSystemRootsFile(DefaultSystemRootsFile, "") })
+	return path
+}
+
+func writeSystemRoots(t *testing.T, path string, certs ...[]byte) {
+	t.Helper()
+	var data []byte
+	for _, crt := range certs {
+		data = append(data, crt...)
+	}
+	require.NoError(t, os.WriteFile(path, data, 0o644))
+}
+
+func TestSystemRootsTransformer(t *testing.T) {
+	ca, _ := selfSigned(t, "my-ca")
+	root1, _ := selfSigned(t, "root-1")
+	root2, _ := selfSigned(t, "root-2")
+
+	t.Run("ca.crt and the system roots are written once", func(t *testing.T) {
+		withSystemRoots(t, "2024.2.69", root1, root2)
+		given := secret(map[string]string{
+			"secret-transform/ca-bundle-with-system-roots": "ca-bundle.crt",
+		}, map[string][]byte{"ca.crt": ca})
+
+		events, err := Apply(given)
+		require.NoError(t, err)
+		version := given.Annotations["secret-transform/system-roots-version"]
+		assert.Regexp(t, `^2024\.2\.69 \(sha256:[0-9a-f]{12}\)$`, version)
+		assert.Equal(t, []string{"Normal AddedSystemRoots Wrote the 1 certificates of 'ca.crt' and the 2 system roots, version " + version + ", into 'ca-bundle.crt'"}, eventStrings(events))
+		certs, err := ParseCertificates(given.Data["ca-bundle.crt"])
+		require.NoError(t, err)
+		assert.Len(t, certs, 3)
+
+		events, err = Apply(given)
+		require.NoError(t, err)
+		assert.Empty(t, events)
+	})
+
+	t.Run("the bundle and the version are updated when the root store changes", func(t *testing.T) {
+		path := withSystemRoots(t, "", root1)
+		given := secret(map[string]string{
+			"secret-transform/ca-bundle-with-system-roots": "ca-bundle.crt",
+		}, map[string][]byte{"ca.crt": ca})
+		_, err := Apply(given)
+		require.NoError(t, err)
+		before := given.Annotations["secret-transform/system-roots-version"]
+		assert.True(t, strings.HasPrefix(before, "sha256:"), before)
+
+		writeSystemRoots(t, path, root1, root2)
+		events, err := Apply(given)
+		require.NoError(t, err)
+		assert.Len(t, events, 1)
+		assert.NotEqual(t, before, given.Annotations["secret-transform/system-roots-version"])
+		certs, err := ParseCertificates(given.Data["ca-bundle.crt"])
+		require.NoError(t, err)
+		assert.Len(t, certs, 3)
+	})
+
+	t.Run("an empty ca.crt gives the system roots only", func(t *testing.T) {
+		withSystemRoots(t, "", root1, root2)
+		given := secret(map[string]string{
+			"secret-transform/ca-bundle-with-system-roots": "ca-bundle.crt",
+		}, map[string][]byte{"ca.crt": {}})
+		events, err := Apply(given)
+		require.NoError(t, err)
+		assert.Len(t, events, 1)
+		certs, err := ParseCertificates(given.Data["ca-bundle.crt"])
+		require.NoError(t, err)
+		assert.Len(t, certs, 2)
+	})
+
+	t.Run("a missing root store is reported", func(t *testing.T) {
+		SetSystemRootsFile(filepath.Join(t.TempDir(), "missing.crt"), "")
+		t.Cleanup(func() { SetSystemRootsFile(DefaultSystemRootsFile, "") })
+		given := secret(map[string]string{
+			"secret-transform/ca-bundle-with-system-roots": "ca-bundle.crt",
+		}, map[string][]byte{"ca.crt": ca})
+		events, err := Apply(given)
+		require.Error(t, err)
+		require.Len(t, events, 1)
+		assert.Equal(t, "FailedSystemRoots", events[0].Reason)
+		assert.NotContains(t, given.Data, "ca-bundle.crt")
+	})
+}
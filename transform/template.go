@@ -0,0 +1,573 @@
+package transform
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"text/template"
+	"text/template/parse"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// To render an arbitrary data key from the Secret's contents, use an
+// annotation of the following form on a Secret:
+//
+//	secret-transform/secret-template-envoy.yaml: |
+//	  certificate_chain: {inline_string: {{ index .Data "tls.crt" | pemChain | quote }}}
+//
+// The part after the prefix is the name of the data key that will be created.
+// The value is a Go text/template. The template only has access to the
+// Secret's data, name, namespace, labels, and annotations, and to the
+// functions listed in templateFuncs; it can't read other Secrets or files.
+const SecretTemplateAnnotPrefix = "secret-transform/secret-template-"
+
+// templateData is what a template sees as its dot.
+type templateData struct {
+	Name        string
+	Namespace   string
+	Labels      map[string]string
+	Annotations map[string]string
+	Data        map[string]string
+}
+
+// The functions that can be used in a template. Keep this list small: every
+// function added here is a function that users can call on any Secret.
+var templateFuncs = template.FuncMap{
+	"pemLeaf":   pemLeaf,
+	"pemChain":  pemChain,
+	"keyPKCS8":  keyPKCS8,
+	"certField": certField,
+	"base64":    func(s string) string { return base64.StdEncoding.EncodeToString([]byte(s)) },
+	"sha256":    func(s string) string { h := sha256.Sum256([]byte(s)); return hex.EncodeToString(h[:]) },
+	"indent":    indent,
+	"trim":      strings.TrimSpace,
+	"quote":     func(s string) string { return fmt.Sprintf("%q", s) },
+}
+
+// Returns the data keys that should be rendered along with the template they
+// should be rendered from, sorted by data key so that the events are shown in
+// a stable order.
+func templateAnnots(annots map[string]string) (keys []string, tmpls map[string]string) {
+	tmpls = make(map[string]string)
+	for annot, tmpl := range annots {
+		if !strings.HasPrefix(annot, SecretTemplateAnnotPrefix) {
+			continue
+		}
+		key := strings.TrimPrefix(annot, SecretTemplateAnnotPrefix)
+		if key == "" || tmpl == "" {
+			continue
+		}
+		keys = append(keys, key)
+		tmpls[key] = tmpl
+	}
+	sort.Strings(keys)
+	return keys, tmpls
+}
+
+// Handles the "secret-transform/secret-template-*" annotations. Each template
+// is rendered against the Secret's data as it was before any of the templates
+// ran, which means that a template can't use the output of another template.
+// Mutates the Secret's data. Returns the data keys that have been changed.
+func renderTemplates(secret *corev1.Secret) ([]string, []Event) {
+	keys, texts := templateAnnots(secret.GetAnnotations())
+	if len(keys) == 0 {
+		return nil, nil
+	}
+
+	data := templateData{
+		Name:        secret.Name,
+		Namespace:   secret.Namespace,
+		Labels:      secret.Labels,
+		Annotations: secret.Annotations,
+		Data:        make(map[string]string, len(secret.Data)),
+	}
+	for k, v := range secret.Data {
+		data.Data[k] = string(v)
+	}
+
+	var changed []string
+	var events []Event
+	invalid := func(key string, err error) {
+		events = append(events, Event{corev1.EventTypeWarning, "InvalidTemplate", fmt.Sprintf("annot '%s': %v", SecretTemplateAnnotPrefix+key, err)})
+	}
+
+	// All the templates are parsed first since a key can't be written when
+	// any of the templates reads it.
+	tmpls := make(map[string]*template.Template, len(keys))
+	reads := make(map[string]dataReads, len(keys))
+	for _, key := range keys {
+		tmpl, err := parseTemplate(texts[key])
+		if err != nil {
+			invalid(key, err)
+			continue
+		}
+		tmpls[key] = tmpl
+		reads[key] = templateReads(tmpl)
+	}
+
+	for _, key := range keys {
+		tmpl, ok := tmpls[key]
+		if !ok {
+			continue
+		}
+		if err := checkTemplateOutput(key, keys, reads); err != nil {
+			invalid(key, err)
+			continue
+		}
+		out, err := executeTemplate(tmpl, data)
+		if err != nil {
+			invalid(key, err)
+			continue
+		}
+
+		if old, exists := secret.Data[key]; exists && bytes.Equal(old, out) {
+			continue
+		}
+		if secret.Data == nil {
+			secret.Data = make(map[string][]byte)
+		}
+		secret.Data[key] = out
+		changed = append(changed, key)
+	}
+
+	return changed, events
+}
+
+// The data keys holding what the other outputs are made from. Writing them
+// from a template would loop since the template would then read its own
+// output.
+var templateSourceKeys = []string{corev1.TLSCertKey, corev1.TLSPrivateKeyKey, "ca.crt"}
+
+// A template must not write a key that a template reads, otherwise each
+// update of the Secret would render a different output, which would update
+// the Secret again, forever.
+func checkTemplateOutput(key string, keys []string, reads map[string]dataReads) error {
+	for _, src := range templateSourceKeys {
+		if key == src {
+			return fmt.Errorf("the key '%s' can't be written by a template since it holds source material", key)
+		}
+	}
+	for _, other := range keys {
+		r, ok := reads[other]
+		if !ok {
+			continue
+		}
+		if r.all {
+			return fmt.Errorf("the key '%s' can't be written since the template of '%s' reads all the data keys; use 'index .Data \"<key>\"' instead", key, other)
+		}
+		if r.keys[key] {
+			return fmt.Errorf("the key '%s' can't be written since it is read by the template of '%s'", key, other)
+		}
+	}
+	return nil
+}
+
+type templateTransformer struct{}
+
+func (templateTransformer) Name() string { return "template" }
+
+func (templateTransformer) Annotations() []string {
+	return []string{SecretTemplateAnnotPrefix + "*"}
+}
+
+// Only the templates that read tls.key need it decrypted. A template that
+// can't be parsed doesn't read anything.
+func (templateTransformer) ReadsTLSKey(annots map[string]string) bool {
+	keys, texts := templateAnnots(annots)
+	for _, key := range keys {
+		tmpl, err := parseTemplate(texts[key])
+		if err != nil {
+			continue
+		}
+		if r := templateReads(tmpl); r.all || r.keys[corev1.TLSPrivateKeyKey] {
+			return true
+		}
+	}
+	return false
+}
+
+func (templateTransformer) Apply(secret *corev1.Secret) ([]Event, error) {
+	changed, events := renderTemplates(secret)
+	for _, key := range changed {
+		events = append(events, Event{corev1.EventTypeNormal, "Templated", fmt.Sprintf("Rendered the template into key '%s'", key)})
+	}
+	return events, nil
+}
+
+// Parses the template and adds a step at the start of each range iteration
+// and of each defined template, so that executeTemplate can stop a template
+// that loops or recurses for too long.
+func parseTemplate(text string) (*template.Template, error) {
+	tmpl, err := template.New("").Option("missingkey=error").Funcs(templateFuncs).Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range tmpl.Templates() {
+		if t.Tree == nil || t.Tree.Root == nil {
+			continue
+		}
+		if err := addSteps(t.Tree.Root); err != nil {
+			return nil, err
+		}
+		t.Tree.Root.Nodes = append([]parse.Node{stepNode}, t.Tree.Root.Nodes...)
+	}
+	return tmpl, nil
+}
+
+// maxTemplateSteps is the number of range iterations and template calls a
+// template can go through. The templates that transform a Secret's data go
+// through a few hundreds at most.
+const maxTemplateSteps = 1_000_000
+
+var errTemplateTooLong = fmt.Errorf("the template runs for more than %d iterations", maxTemplateSteps)
+
+// The function counting the steps. It isn't in templateFuncs so that it can't
+// be called from the templates.
+const stepFunc = "secretTransformStep"
+
+// The action added by parseTemplate, parsed once and shared by all the
+// templates since the nodes aren't modified when executing.
+var stepNode = func() parse.Node {
+	trees, err := parse.Parse("step", "{{ "+stepFunc+" }}", "", "", map[string]any{stepFunc: func() string { return "" }})
+	if err != nil {
+		panic(err)
+	}
+	return trees["step"].Root.Nodes[0]
+}()
+
+// Adds a step at the start of the body of each range. Ranging over an integer
+// literal is rejected since it is only useful to loop.
+func addSteps(node parse.Node) error {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return nil
+		}
+		for _, child := range n.Nodes {
+			if err := addSteps(child); err != nil {
+				return err
+			}
+		}
+	case *parse.IfNode:
+		return addBranchSteps(&n.BranchNode)
+	case *parse.WithNode:
+		return addBranchSteps(&n.BranchNode)
+	case *parse.RangeNode:
+		if cmds := n.Pipe.Cmds; len(cmds) == 1 && len(cmds[0].Args) == 1 {
+			if _, ok := cmds[0].Args[0].(*parse.NumberNode); ok {
+				return fmt.Errorf("ranging over an integer isn't allowed")
+			}
+		}
+		if err := addBranchSteps(&n.BranchNode); err != nil {
+			return err
+		}
+		n.List.Nodes = append([]parse.Node{stepNode}, n.List.Nodes...)
+	}
+	return nil
+}
+
+func addBranchSteps(n *parse.BranchNode) error {
+	if err := addSteps(n.List); err != nil {
+		return err
+	}
+	return addSteps(n.ElseList)
+}
+
+// maxTemplateOutput is the maximum size of a rendered template. A Secret can't
+// be larger than 1 MiB anyway.
+const maxTemplateOutput = 1 << 20
+
+var errTemplateTooLarge = fmt.Errorf("the output is larger than %d bytes", maxTemplateOutput)
+
+func executeTemplate(tmpl *template.Template, data templateData) ([]byte, error) {
+	steps := 0
+	tmpl.Funcs(template.FuncMap{stepFunc: func() (string, error) {
+		steps++
+		if steps > maxTemplateSteps {
+			return "", errTemplateTooLong
+		}
+		return "", nil
+	}})
+
+	w := &limitedBuffer{max: maxTemplateOutput}
+	if err := tmpl.Execute(w, data); err != nil {
+		switch {
+		case errors.Is(err, errTemplateTooLarge):
+			return nil, errTemplateTooLarge
+		case errors.Is(err, errTemplateTooLong):
+			return nil, errTemplateTooLong
+		}
+		return nil, err
+	}
+	return w.buf.Bytes(), nil
+}
+
+// limitedBuffer fails the writes that would make it larger than max, which
+// stops the execution of the template.
+type limitedBuffer struct {
+	buf bytes.Buffer
+	max int
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if b.buf.Len()+len(p) > b.max {
+		return 0, errTemplateTooLarge
+	}
+	return b.buf.Write(p)
+}
+
+// dataReads are the data keys a template reads.
+type dataReads struct {
+	keys map[string]bool
+	// True when .Data is used in a way other than 'index .Data "<key>"' or
+	// '.Data.<key>', such as 'range .Data', in which case any key may be
+	// read.
+	all bool
+}
+
+// Returns the data keys read by the template and by the templates it defines.
+func templateReads(tmpl *template.Template) dataReads {
+	r := dataReads{keys: make(map[string]bool)}
+	for _, t := range tmpl.Templates() {
+		if t.Tree != nil {
+			r.walk(t.Tree.Root)
+		}
+	}
+	return r
+}
+
+func (r *dataReads) walk(node parse.Node) {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return
+		}
+		for _, child := range n.Nodes {
+			r.walk(child)
+		}
+	case *parse.ActionNode:
+		r.walk(n.Pipe)
+	case *parse.IfNode:
+		r.walkBranch(&n.BranchNode)
+	case *parse.RangeNode:
+		r.walkBranch(&n.BranchNode)
+	case *parse.WithNode:
+		r.walkBranch(&n.BranchNode)
+	case *parse.TemplateNode:
+		r.walk(n.Pipe)
+	case *parse.PipeNode:
+		if n == nil {
+			return
+		}
+		for _, cmd := range n.Cmds {
+			r.walk(cmd)
+		}
+	case *parse.CommandNode:
+		// index .Data "<key>"
+		if len(n.Args) == 3 && isIdentifier(n.Args[0], "index") && dataField(n.Args[1]) == "" && isDataNode(n.Args[1]) {
+			if key, ok := n.Args[2].(*parse.StringNode); ok {
+				r.keys[key.Text] = true
+				return
+			}
+		}
+		for _, arg := range n.Args {
+			r.walk(arg)
+		}
+	case *parse.ChainNode:
+		r.walk(n.Node)
+	case *parse.FieldNode, *parse.VariableNode:
+		if !isDataNode(n) {
+			return
+		}
+		if key := dataField(n); key != "" {
+			r.keys[key] = true
+		} else {
+			r.all = true
+		}
+	}
+}
+
+func (r *dataReads) walkBranch(n *parse.BranchNode) {
+	r.walk(n.Pipe)
+	r.walk(n.List)
+	r.walk(n.ElseList)
+}
+
+// Returns the identifiers of a field or variable node without the leading
+// "$", e.g., ["Data", "key"] for both ".Data.key" and "$.Data.key".
+func fieldIdents(node parse.Node) []string {
+	switch n := node.(type) {
+	case *parse.FieldNode:
+		return n.Ident
+	case *parse.VariableNode:
+		if len(n.Ident) > 0 && n.Ident[0] == "$" {
+			return n.Ident[1:]
+		}
+	}
+	return nil
+}
+
+func isDataNode(node parse.Node) bool {
+	idents := fieldIdents(node)
+	return len(idents) > 0 && idents[0] == "Data"
+}
+
+// Returns "key" for ".Data.key", and "" for ".Data".
+func dataField(node parse.Node) string {
+	idents := fieldIdents(node)
+	if len(idents) < 2 {
+		return ""
+	}
+	return idents[1]
+}
+
+func isIdentifier(node parse.Node, name string) bool {
+	id, ok := node.(*parse.IdentifierNode)
+	return ok && id.Ident == name
+}
+
+// Returns the first certificate found in the given PEM, PEM-encoded.
+func pemLeaf(pemData string) (string, error) {
+	certs := pemBlocks([]byte(pemData), "CERTIFICATE")
+	if len(certs) == 0 {
+		return "", fmt.Errorf("pemLeaf: no certificate found")
+	}
+	return string(pem.EncodeToMemory(certs[0])), nil
+}
+
+// Returns all the certificates found in the given PEM, PEM-encoded. Anything
+// that isn't a certificate (private keys, comments) is left out.
+func pemChain(pemData string) (string, error) {
+	certs := pemBlocks([]byte(pemData), "CERTIFICATE")
+	if len(certs) == 0 {
+		return "", fmt.Errorf("pemChain: no certificate found")
+	}
+	var buf bytes.Buffer
+	for _, cert := range certs {
+		_ = pem.Encode(&buf, cert)
+	}
+	return buf.String(), nil
+}
+
+// Converts a PKCS#1, SEC 1, or PKCS#8 PEM-encoded private key into a PKCS#8
+// PEM-encoded private key.
+func keyPKCS8(pemData string) (string, error) {
+	key, err := parsePrivateKeyPEM([]byte(pemData))
+	if err != nil {
+		return "", fmt.Errorf("keyPKCS8: %w", err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return "", fmt.Errorf("keyPKCS8: %w", err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})), nil
+}
+
+// Returns a field of the first certificate found in the given PEM. The
+// supported fields are: commonName, subject, issuer, serialNumber, notBefore,
+// notAfter, dnsNames, and sha256Fingerprint.
+func certField(field, pemData string) (string, error) {
+	leaf, err := pemLeaf(pemData)
+	if err != nil {
+		return "", fmt.Errorf("certField: no certificate found")
+	}
+	block, _ := pem.Decode([]byte(leaf))
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return "", fmt.Errorf("certField: %w", err)
+	}
+
+	switch field {
+	case "commonName":
+		return cert.Subject.CommonName, nil
+	case "subject":
+		return cert.Subject.String(), nil
+	case "issuer":
+		return cert.Issuer.String(), nil
+	case "serialNumber":
+		return cert.SerialNumber.String(), nil
+	case "notBefore":
+		return cert.NotBefore.UTC().Format("2006-01-02T15:04:05Z"), nil
+	case "notAfter":
+		return cert.NotAfter.UTC().Format("2006-01-02T15:04:05Z"), nil
+	case "dnsNames":
+		return strings.Join(cert.DNSNames, ","), nil
+	case "sha256Fingerprint":
+		h := sha256.Sum256(cert.Raw)
+		return hex.EncodeToString(h[:]), nil
+	default:
+		return "", fmt.Errorf("certField: unknown field %q", field)
+	}
+}
+
+// Prefixes every non-empty line of s with the given number of spaces.
+func indent(spaces int, s string) string {
+	pad := strings.Repeat(" ", spaces)
+	lines := strings.Split(s, "\n")
+	for i, line := range lines {
+		if line != "" {
+			lines[i] = pad + line
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Returns the PEM blocks of the given type, in order.
+func pemBlocks(data []byte, blockType string) []*pem.Block {
+	var blocks []*pem.Block
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return blocks
+		}
+		if block.Type == blockType {
+			blocks = append(blocks, block)
+		}
+	}
+}
+
+// errUnsupportedKey is returned for private keys other than RSA, ECDSA, and
+// Ed25519.
+var errUnsupportedKey = errors.New("unsupported private key type")
+
+// Parses the first private key found in the given PEM. PKCS#1 ("RSA PRIVATE
+// KEY"), SEC 1 ("EC PRIVATE KEY"), and PKCS#8 ("PRIVATE KEY") are supported.
+func parsePrivateKeyPEM(data []byte) (any, error) {
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("no private key found")
+		}
+
+		switch block.Type {
+		case "RSA PRIVATE KEY":
+			return x509.ParsePKCS1PrivateKey(block.Bytes)
+		case "EC PRIVATE KEY":
+			return x509.ParseECPrivateKey(block.Bytes)
+		case "PRIVATE KEY":
+			key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+			if err != nil {
+				return nil, err
+			}
+			switch key.(type) {
+			case *rsa.PrivateKey, *ecdsa.PrivateKey, ed25519.PrivateKey:
+				return key, nil
+			default:
+				return nil, fmt.Errorf("%w %T", errUnsupportedKey, key)
+			}
+		}
+	}
+}
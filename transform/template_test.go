@@ -0,0 +1,200 @@
+package transform
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRenderTemplates(t *testing.T) {
+	crt, key := selfSigned(t, "example.com")
+
+	t.Run("renders the template into the data key", func(t *testing.T) {
+		given := secret(map[string]string{
+			"secret-transform/secret-template-out.txt": `cn={{ index .Data "tls.crt" | certField "commonName" }} name={{ .Name }}`,
+		}, map[string][]byte{
+			"tls.crt": crt,
+		})
+		got, events := renderTemplates(given)
+
+		assert.Equal(t, []string{"out.txt"}, got)
+		assert.Equal(t, "cn=example.com name=test-secret", string(given.Data["out.txt"]))
+		assert.Empty(t, events)
+	})
+
+	t.Run("keyPKCS8 converts a SEC 1 key", func(t *testing.T) {
+		given := secret(map[string]string{
+			"secret-transform/secret-template-key.pk8": `{{ index .Data "tls.key" | keyPKCS8 }}`,
+		}, map[string][]byte{
+			"tls.key": key,
+		})
+		_, events := renderTemplates(given)
+
+		block, _ := pem.Decode(given.Data["key.pk8"])
+		require.NotNil(t, block)
+		assert.Equal(t, "PRIVATE KEY", block.Type)
+		_, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		assert.NoError(t, err)
+		assert.Empty(t, events)
+	})
+
+	t.Run("pemLeaf and pemChain leave out the private key", func(t *testing.T) {
+		given := secret(map[string]string{
+			"secret-transform/secret-template-leaf":  `{{ index .Data "tls.pem" | pemLeaf }}`,
+			"secret-transform/secret-template-chain": `{{ index .Data "tls.pem" | pemChain }}`,
+		}, map[string][]byte{
+			"tls.pem": append(append([]byte{}, key...), crt...),
+		})
+		_, events := renderTemplates(given)
+
+		assert.Equal(t, string(crt), string(given.Data["leaf"]))
+		assert.Equal(t, string(crt), string(given.Data["chain"]))
+		assert.Empty(t, events)
+	})
+
+	t.Run("show an event when the template is invalid", func(t *testing.T) {
+		given := secret(map[string]string{
+			"secret-transform/secret-template-out.txt": `{{ .Data`,
+		}, map[string][]byte{})
+		got, events := renderTemplates(given)
+
+		assert.Empty(t, got)
+		assert.NotContains(t, given.Data, "out.txt")
+		assert.Equal(t, []string{"Warning InvalidTemplate annot 'secret-transform/secret-template-out.txt': template: :1: unclosed action"}, eventStrings(events))
+	})
+
+	t.Run("show an event when a function fails", func(t *testing.T) {
+		given := secret(map[string]string{
+			"secret-transform/secret-template-out.txt": `{{ index .Data "tls.crt" | pemLeaf }}`,
+		}, map[string][]byte{
+			"tls.crt": []byte("not a pem"),
+		})
+		_, events := renderTemplates(given)
+
+		assert.NotContains(t, given.Data, "out.txt")
+		assert.Equal(t, []string{`Warning InvalidTemplate annot 'secret-transform/secret-template-out.txt': template: :1:27: executing "" at <pemLeaf>: error calling pemLeaf: pemLeaf: no certificate found`}, eventStrings(events))
+	})
+
+	t.Run("unknown functions can't be called", func(t *testing.T) {
+		given := secret(map[string]string{
+			"secret-transform/secret-template-out.txt": `{{ env "HOME" }}`,
+		}, map[string][]byte{})
+		_, events := renderTemplates(given)
+
+		assert.NotContains(t, given.Data, "out.txt")
+		assert.Equal(t, []string{`Warning InvalidTemplate annot 'secret-transform/secret-template-out.txt': template: :1: function "env" not defined`}, eventStrings(events))
+	})
+
+	t.Run("the source keys can't be written", func(t *testing.T) {
+		given := secret(map[string]string{
+			"secret-transform/secret-template-tls.crt": `{{ index .Data "tls.crt" }}x`,
+		}, map[string][]byte{
+			"tls.crt": []byte("c"),
+		})
+		got, events := renderTemplates(given)
+
+		assert.Empty(t, got)
+		assert.Equal(t, "c", string(given.Data["tls.crt"]))
+		assert.Equal(t, []string{`Warning InvalidTemplate annot 'secret-transform/secret-template-tls.crt': the key 'tls.crt' can't be written by a template since it holds source material`}, eventStrings(events))
+	})
+
+	t.Run("a key read by a template can't be written", func(t *testing.T) {
+		given := secret(map[string]string{
+			"secret-transform/secret-template-a": `{{ index .Data "b" }}x`,
+			"secret-transform/secret-template-b": `{{ .Data.a }}y`,
+			"secret-transform/secret-template-c": `{{ index $.Data "tls.crt" }}`,
+		}, map[string][]byte{
+			"tls.crt": []byte("c"),
+		})
+		got, events := renderTemplates(given)
+
+		assert.Equal(t, []string{"c"}, got)
+		assert.Equal(t, []string{
+			`Warning InvalidTemplate annot 'secret-transform/secret-template-a': the key 'a' can't be written since it is read by the template of 'b'`,
+			`Warning InvalidTemplate annot 'secret-transform/secret-template-b': the key 'b' can't be written since it is read by the template of 'a'`,
+		}, eventStrings(events))
+	})
+
+	t.Run("no key can be written when a template reads all the keys", func(t *testing.T) {
+		given := secret(map[string]string{
+			"secret-transform/secret-template-all": `{{ range $k, $v := .Data }}{{ $k }}{{ end }}`,
+		}, map[string][]byte{
+			"tls.crt": []byte("c"),
+		})
+		got, events := renderTemplates(given)
+
+		assert.Empty(t, got)
+		assert.Equal(t, []string{`Warning InvalidTemplate annot 'secret-transform/secret-template-all': the key 'all' can't be written since the template of 'all' reads all the data keys; use 'index .Data "<key>"' instead`}, eventStrings(events))
+	})
+
+	t.Run("the output is limited to 1 MiB", func(t *testing.T) {
+		given := secret(map[string]string{
+			"secret-transform/secret-template-out.txt": `{{ $n := 300000 }}{{ range $n }}0123456789{{ end }}`,
+		}, map[string][]byte{})
+		got, events := renderTemplates(given)
+
+		assert.Empty(t, got)
+		assert.NotContains(t, given.Data, "out.txt")
+		assert.Equal(t, []string{`Warning InvalidTemplate annot 'secret-transform/secret-template-out.txt': the output is larger than 1048576 bytes`}, eventStrings(events))
+	})
+
+	t.Run("ranging over an integer literal isn't allowed", func(t *testing.T) {
+		given := secret(map[string]string{
+			"secret-transform/secret-template-out.txt": `{{ range 300000000 }}{{ end }}`,
+		}, map[string][]byte{})
+		got, events := renderTemplates(given)
+
+		assert.Empty(t, got)
+		assert.Equal(t, []string{`Warning InvalidTemplate annot 'secret-transform/secret-template-out.txt': ranging over an integer isn't allowed`}, eventStrings(events))
+	})
+
+	t.Run("the number of iterations is limited", func(t *testing.T) {
+		given := secret(map[string]string{
+			"secret-transform/secret-template-loop.txt":   `{{ $n := 300000000 }}{{ range $n }}{{ end }}`,
+			"secret-transform/secret-template-nested.txt": `{{ $n := 2000 }}{{ range $n }}{{ range $n }}{{ end }}{{ end }}`,
+		}, map[string][]byte{})
+		got, events := renderTemplates(given)
+
+		assert.Empty(t, got)
+		assert.Equal(t, []string{
+			`Warning InvalidTemplate annot 'secret-transform/secret-template-loop.txt': the template runs for more than 1000000 iterations`,
+			`Warning InvalidTemplate annot 'secret-transform/secret-template-nested.txt': the template runs for more than 1000000 iterations`,
+		}, eventStrings(events))
+	})
+}
+
+// selfSigned returns a PEM-encoded self-signed certificate and its PEM-encoded
+// SEC 1 private key.
+func selfSigned(t *testing.T, commonName string) (crtPEM, keyPEM []byte) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: commonName},
+		DNSNames:              []string{commonName},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
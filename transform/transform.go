@@ -0,0 +1,156 @@
+// Package transform contains the transforms that secret-transform applies to
+// annotated Secrets. It doesn't talk to the Kubernetes API; the controller
+// package takes care of fetching and updating Secrets.
+package transform
+
+import (
+	"bytes"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+
+	// To combine `tls.crt` and `tls.key` into a single PEM, use the following
+	// annotation on a Secret:
+	//
+	//  secret-transform/secret-transform: "tls.pem"
+	//
+	// The contents of `tls.key` and `tls.crt` will be merged into a new key
+	// `tls.pem`. This key name isn't configurable.
+	SecretAnnotKey    = "secret-transform/secret-transform" // Values: "tls.pem"
+	OldSecretAnnotKey = "cert-manager.io/secret-transform"  // Values: "tls.pem"
+
+	TLSPEMDataKey = "tls.pem"
+
+	// To copy an existing key to a new key, use one of the annotations below on
+	// a Secret:
+	//
+	//  secret-transform/secret-copy-ca.crt: "ca"
+	//  secret-transform/secret-copy-tls.crt: "cert"
+	//  secret-transform/secret-copy-tls.key: "key"
+	//  secret-transform/secret-copy-keystore.jks: "keystore"
+	//  secret-transform/secret-copy-truststore.jks: "truststore"
+	//  secret-transform/secret-copy-keystore.p12: "keystore"
+	//  secret-transform/secret-copy-truststore.p12: "truststore"
+	//
+	// In the first example, the contents of the `ca.crt` key will be copied to
+	// a new key `ca`, even when the Secret's `ca.crt` is updated. Each of the
+	// annotation values are configurable.
+	SecretSyncCACRTAnnotKey         = "secret-transform/secret-copy-ca.crt"
+	SecretSyncTLSCrtAnnotKey        = "secret-transform/secret-copy-tls.crt"
+	SecretSyncTLSKeyAnnotKey        = "secret-transform/secret-copy-tls.key"
+	SecretSyncKeystoreJKSAnnotKey   = "secret-transform/secret-copy-keystore.jks"
+	SecretSyncTruststoreJKSAnnotKey = "secret-transform/secret-copy-truststore.jks"
+	SecretSyncKeystoreP12AnnotKey   = "secret-transform/secret-copy-keystore.p12"
+	SecretSyncTruststoreP12AnnotKey = "secret-transform/secret-copy-truststore.p12"
+
+	// Initially, the project started with annotations starting with
+	// cert-manager.io/*, which caused issues. These annotations are kept for
+	// backwards compatibility.
+	// https://github.com/maelvls/secret-transform/issues/11
+	OldSecretSyncCACRTAnnotKey         = "cert-manager.io/secret-copy-ca.crt"
+	OldSecretSyncTLSCrtAnnotKey        = "cert-manager.io/secret-copy-tls.crt"
+	OldSecretSyncTLSKeyAnnotKey        = "cert-manager.io/secret-copy-tls.key"
+	OldSecretSyncKeystoreJKSAnnotKey   = "cert-manager.io/secret-copy-keystore.jks"
+	OldSecretSyncTruststoreJKSAnnotKey = "cert-manager.io/secret-copy-truststore.jks"
+	OldSecretSyncKeystoreP12AnnotKey   = "cert-manager.io/secret-copy-keystore.p12"
+	OldSecretSyncTruststoreP12AnnotKey = "cert-manager.io/secret-copy-truststore.p12"
+)
+
+// MergeCombinedPEM handles the "secret-transform/secret-transform" annotation
+// and its legacy counterpart "cert-manager.io/secret-transform". Mutates the
+// Secret's data. Returns true if the Secret's data was changed.
+func MergeCombinedPEM(secret *corev1.Secret) (bool, []Event) {
+	annot, transformTo := GetOneOf(secret.GetAnnotations(), SecretAnnotKey, OldSecretAnnotKey)
+	if transformTo != TLSPEMDataKey {
+		return false, []Event{{corev1.EventTypeWarning, "InvalidSecretTransform", fmt.Sprintf("Value '%s' is invalid for annotation '%s'. The only valid value is '%s'", transformTo, annot, TLSPEMDataKey)}}
+	}
+
+	tlsKey, exists := secret.Data["tls.key"]
+	if !exists {
+		return false, []Event{{corev1.EventTypeWarning, "MissingTLSKey", fmt.Sprintf("Secret %s does not contain a 'tls.key' data key", secret.Name)}}
+	}
+
+	tlsCrt, exists := secret.Data["tls.crt"]
+	if !exists {
+		return false, []Event{{corev1.EventTypeWarning, "MissingTLSCrt", fmt.Sprintf("Secret %s does not contain a 'tls.crt' data key", secret.Name)}}
+	}
+
+	tlsPEMNew := []byte(fmt.Sprintf("%s%s", tlsKey, tlsCrt))
+
+	if tlsPEMOld, exists := secret.Data[TLSPEMDataKey]; exists && bytes.Equal(tlsPEMOld, tlsPEMNew) {
+		return false, nil
+	}
+
+	secret.Data[TLSPEMDataKey] = tlsPEMNew
+	return true, nil
+}
+
+type combinedPEMTransformer struct{}
+
+func (combinedPEMTransformer) Name() string { return "combined-pem" }
+
+func (combinedPEMTransformer) Annotations() []string {
+	return []string{SecretAnnotKey, OldSecretAnnotKey}
+}
+
+func (combinedPEMTransformer) ReadsTLSKey(map[string]string) bool { return true }
+
+func (combinedPEMTransformer) Apply(secret *corev1.Secret) ([]Event, error) {
+	changed, events := MergeCombinedPEM(secret)
+	if changed {
+		events = append(events, Event{corev1.EventTypeNormal, "Transformed", fmt.Sprintf("Added key %s", TLSPEMDataKey)})
+	}
+	return events, nil
+}
+
+// CopyKey copies the contents of keyFrom into keyTo. The Secret is mutated
+// when the destination differs from the source. Returns an error if the source
+// key does not exist.
+func CopyKey(secret corev1.Secret, keyFrom string, keyTo string) error {
+	caCrtOriginal, exists := secret.Data[keyFrom]
+	if !exists {
+		return fmt.Errorf("the key %q does not exist", keyFrom)
+	}
+
+	caCrtCopy := secret.Data[keyTo]
+	if bytes.Equal(caCrtOriginal, caCrtCopy) {
+		return nil
+	}
+
+	secret.Data[keyTo] = secret.Data[keyFrom]
+	return nil
+}
+
+// Handles the "secret-transform/secret-copy-*" annotations and their legacy
+// "cert-manager.io/secret-copy-*" counterparts. The value of the annotation
+// is the key to copy the contents of the key `from` into.
+type copyTransformer struct {
+	from   string
+	annots []string
+}
+
+func (t copyTransformer) Name() string { return "copy-" + t.from }
+
+func (t copyTransformer) Annotations() []string { return t.annots }
+
+func (t copyTransformer) ReadsTLSKey(map[string]string) bool {
+	return t.from == corev1.TLSPrivateKeyKey
+}
+
+func (t copyTransformer) Apply(secret *corev1.Secret) ([]Event, error) {
+	annot, to := GetOneOf(secret.GetAnnotations(), t.annots...)
+	before := secret.Data[to]
+
+	err := CopyKey(*secret, t.from, to)
+	if err != nil {
+		return []Event{{corev1.EventTypeWarning, "FailedCopying", fmt.Sprintf("annot '%s': %v", annot, err)}}, err
+	}
+
+	if bytes.Equal(before, secret.Data[to]) {
+		return nil, nil
+	}
+	return []Event{{corev1.EventTypeNormal, "CopiedKey", fmt.Sprintf("Copied the contents of '%s' into key '%s'", t.from, to)}}, nil
+}
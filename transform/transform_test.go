@@ -0,0 +1,116 @@
+package transform
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Tests for the two annotations:
+//
+//	secret-transform/secret-transform
+//	cert-manager.io/secret-transform
+func TestMergeCombinedPEM(t *testing.T) {
+	t.Run("secret-transform annot: happy case", func(t *testing.T) {
+		given := secret(map[string]string{
+			"cert-manager.io/secret-transform": "tls.pem",
+		}, map[string][]byte{
+			// Both keys are present.
+			"tls.key": []byte("fakeKey"),
+			"tls.crt": []byte("fakeCrt"),
+		})
+
+		changed, events := MergeCombinedPEM(given)
+
+		assert.True(t, changed)
+		assert.Equal(t, []byte("fakeKeyfakeCrt"), given.Data[TLSPEMDataKey])
+		assert.Empty(t, events)
+	})
+
+	t.Run("secret-transform annot: invalid annotation value", func(t *testing.T) {
+		given := secret(map[string]string{
+			"cert-manager.io/secret-transform": "invalid-value",
+		}, map[string][]byte{
+			// Both keys are present, but the annotation value is invalid.
+			"tls.key": []byte("fakeKey"),
+			"tls.crt": []byte("fakeCrt"),
+		})
+
+		got := given.DeepCopy()
+		_, events := MergeCombinedPEM(got)
+		assert.Equal(t, given, got)
+		assert.Equal(t, []string{"Warning InvalidSecretTransform Value 'invalid-value' is invalid for annotation 'cert-manager.io/secret-transform'. The only valid value is 'tls.pem'"}, eventStrings(events))
+	})
+
+	t.Run("secret-transform annot: show an event when tls.key is missing", func(t *testing.T) {
+		given := secret(map[string]string{
+			"cert-manager.io/secret-transform": "tls.pem",
+		}, map[string][]byte{
+			// Missing tls.key
+			"tls.crt": []byte("fakeCrt"),
+		})
+		got := given.DeepCopy()
+		_, events := MergeCombinedPEM(got)
+		assert.Equal(t, given, got)
+		assert.Equal(t, []string{"Warning MissingTLSKey Secret test-secret does not contain a 'tls.key' data key"}, eventStrings(events))
+	})
+
+	t.Run("secret-transform annot: show an event when tls.crt is missing", func(t *testing.T) {
+		given := secret(map[string]string{
+			"cert-manager.io/secret-transform": "tls.pem",
+		}, map[string][]byte{
+			// Missing tls.crt.
+			"tls.key": []byte("fakeKey"),
+		})
+
+		got := given.DeepCopy()
+		_, events := MergeCombinedPEM(got)
+
+		assert.Equal(t, given, got)
+		assert.Equal(t, []string{"Warning MissingTLSCrt Secret test-secret does not contain a 'tls.crt' data key"}, eventStrings(events))
+	})
+}
+
+func TestCopyKey(t *testing.T) {
+	t.Run("happy case", func(t *testing.T) {
+
+		secret := corev1.Secret{
+			Data: map[string][]byte{
+				"sourceKey": []byte("someData"),
+			},
+		}
+
+		err := CopyKey(secret, "sourceKey", "destKey")
+		require.NoError(t, err)
+		assert.Equal(t, secret.Data["destKey"], []byte("someData"))
+		assert.Equal(t, secret.Data["sourceKey"], secret.Data["destKey"])
+	})
+	t.Run("show an error when missing source key", func(t *testing.T) {
+		secret := corev1.Secret{Data: map[string][]byte{}}
+		err := CopyKey(secret, "nonexistent", "destKey")
+		require.EqualError(t, err, "the key \"nonexistent\" does not exist")
+	})
+}
+
+// eventStrings formats the events the same way record.FakeRecorder does.
+func eventStrings(events []Event) []string {
+	var strs []string
+	for _, e := range events {
+		strs = append(strs, e.Type+" "+e.Reason+" "+e.Message)
+	}
+	return strs
+}
+
+func secret(annotations map[string]string, data map[string][]byte) *corev1.Secret {
+	return &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "test-secret",
+			Namespace:   "default",
+			Annotations: annotations,
+		},
+		Data: data,
+	}
+}
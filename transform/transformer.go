@@ -0,0 +1,276 @@
+package transform
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// A Transformer is a self-contained transform of a Secret's data, triggered by
+// one or more annotations.
+type Transformer interface {
+	// Name is used in logs to tell which transformer did what.
+	Name() string
+
+	// Annotations returns the annotation keys that trigger this transformer.
+	// A key ending with "*" matches any annotation starting with the part
+	// before the "*", as long as something comes after it. The optional
+	// annotations, such as a passphrase or a comment, are listed too, so that
+	// the transformer can report that they are given without the annotation
+	// they go with.
+	Annotations() []string
+
+	// Apply mutates the Secret's data. It is only called when the Secret has
+	// at least one of the annotations returned by Annotations. It may also set
+	// annotations recording what it did, such as a version.
+	//
+	// Warning events are shown right away. Normal events are only shown once
+	// the Secret has been updated, and should only be returned when the
+	// transformer changed the Secret's data. A non-nil error means that the
+	// Secret must not be updated; the transformer is expected to also return
+	// a Warning event explaining why.
+	Apply(secret *corev1.Secret) ([]Event, error)
+}
+
+// A SecretReferencer is a Transformer that reads the data of other Secrets of
+// the namespace, for example to get a passphrase.
+type SecretReferencer interface {
+	Transformer
+
+	// References returns the names of the Secrets read by the transformer
+	// given the annotations of the transformed Secret.
+	References(annots map[string]string) []string
+
+	// ApplyWithSecrets is like Apply, except that the referenced Secrets are
+	// read with get. When get is nil, the referenced Secrets can't be read
+	// and the transformer is expected to return a Warning event.
+	ApplyWithSecrets(secret *corev1.Secret, get SecretGetter) ([]Event, error)
+}
+
+// A TLSKeyReader is a Transformer that tells whether it reads tls.key. When
+// tls.key is encrypted, it is only decrypted when one of the triggered
+// transformers reads it. The transformers that don't implement TLSKeyReader
+// are assumed to read tls.key.
+type TLSKeyReader interface {
+	Transformer
+
+	// ReadsTLSKey returns true if the transformer reads tls.key given the
+	// annotations of the transformed Secret.
+	ReadsTLSKey(annots map[string]string) bool
+}
+
+// Returns true if the transformer reads tls.key.
+func readsTLSKey(t Transformer, annots map[string]string) bool {
+	r, ok := t.(TLSKeyReader)
+	return !ok || r.ReadsTLSKey(annots)
+}
+
+// SecretGetter returns the data of the given Secret, which is in the same
+// namespace as the transformed Secret.
+type SecretGetter func(name string) (map[string][]byte, error)
+
+// Event is a Kubernetes event to be shown on the transformed Secret.
+type Event struct {
+	Type    string // corev1.EventTypeNormal or corev1.EventTypeWarning.
+	Reason  string
+	Message string
+}
+
+// The transformers, in the order in which they are applied.
+var transformers = []Transformer{
+	combinedPEMTransformer{},
+	copyTransformer{from: "ca.crt", annots: []string{SecretSyncCACRTAnnotKey, OldSecretSyncCACRTAnnotKey}},
+	copyTransformer{from: "tls.crt", annots: []string{SecretSyncTLSCrtAnnotKey, OldSecretSyncTLSCrtAnnotKey}},
+	copyTransformer{from: "tls.key", annots: []string{SecretSyncTLSKeyAnnotKey, OldSecretSyncTLSKeyAnnotKey}},
+	copyTransformer{from: "keystore.jks", annots: []string{SecretSyncKeystoreJKSAnnotKey, OldSecretSyncKeystoreJKSAnnotKey}},
+	copyTransformer{from: "truststore.jks", annots: []string{SecretSyncTruststoreJKSAnnotKey, OldSecretSyncTruststoreJKSAnnotKey}},
+	copyTransformer{from: "keystore.p12", annots: []string{SecretSyncKeystoreP12AnnotKey, OldSecretSyncKeystoreP12AnnotKey}},
+	copyTransformer{from: "truststore.p12", annots: []string{SecretSyncTruststoreP12AnnotKey, OldSecretSyncTruststoreP12AnnotKey}},
+	templateTransformer{},
+	kubeconfigTransformer{},
+	sshTransformer{},
+	publicKeyTransformer{},
+	encryptedKeyTransformer{},
+	systemRootsTransformer{},
+}
+
+// Register adds a transformer after the ones already registered. It must be
+// called before the controller is set up. The returned function restores the
+// registry as it was before the call, which is mostly useful in tests.
+func Register(t Transformer) (restore func()) {
+	before := transformers[:len(transformers):len(transformers)]
+	transformers = append(before, t)
+	return func() { transformers = before }
+}
+
+// Transformers returns the registered transformers, in the order in which they
+// are applied.
+func Transformers() []Transformer {
+	return append([]Transformer(nil), transformers...)
+}
+
+// Consumes returns true if the transformer is triggered by one of the given
+// annotations. Annotations with an empty value are ignored.
+func Consumes(t Transformer, annots map[string]string) bool {
+	return len(ConsumedAnnotations(t, annots)) > 0
+}
+
+// ConsumedAnnotations returns the keys of the given annotations that trigger
+// the transformer, sorted. Annotations with an empty value are ignored.
+func ConsumedAnnotations(t Transformer, annots map[string]string) []string {
+	var found []string
+	for _, key := range t.Annotations() {
+		prefix, isPrefix := strings.CutSuffix(key, "*")
+		if !isPrefix {
+			if annots[key] != "" {
+				found = append(found, key)
+			}
+			continue
+		}
+
+		for annot, value := range annots {
+			if len(annot) > len(prefix) && strings.HasPrefix(annot, prefix) && value != "" {
+				found = append(found, annot)
+			}
+		}
+	}
+	sort.Strings(found)
+	return found
+}
+
+// References returns the names of the Secrets read by the registered
+// transformers triggered by the given annotations, as well as the Secret
+// holding the passphrase of tls.key when one of them reads tls.key, sorted and
+// deduplicated.
+func References(annots map[string]string) []string {
+	var referencers []SecretReferencer
+	readsKey := false
+	for _, t := range transformers {
+		if !Consumes(t, annots) {
+			continue
+		}
+		readsKey = readsKey || readsTLSKey(t, annots)
+		if r, ok := t.(SecretReferencer); ok {
+			referencers = append(referencers, r)
+		}
+	}
+	if readsKey && Consumes(keyDecrypter, annots) {
+		referencers = append(referencers, keyDecrypter)
+	}
+
+	seen := make(map[string]bool)
+	var names []string
+	for _, r := range referencers {
+		for _, name := range r.References(annots) {
+			if name != "" && !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Matches returns true if at least one of the registered transformers is
+// triggered by the given annotations.
+func Matches(annots map[string]string) bool {
+	for _, t := range transformers {
+		if Consumes(t, annots) {
+			return true
+		}
+	}
+	return false
+}
+
+// Apply evaluates the Secret's condition and then runs the registered
+// transformers that are triggered by the Secret's annotations, mutating its
+// data. Each transformer sees the changes made by the ones before it.
+//
+// When a non-nil error is returned, the Secret must not be updated, and the
+// returned events contain a Warning explaining why. Normal events describe the
+// changes that were made and should only be shown once the Secret has been
+// updated.
+func Apply(secret *corev1.Secret) ([]Event, error) {
+	return ApplyWithSecrets(secret, nil)
+}
+
+// ApplyWithSecrets is like Apply, except that the transformers implementing
+// SecretReferencer read the Secrets they reference with get. When tls.key is
+// encrypted, it is decrypted with the passphrase read from the Secret given
+// in TLSKeyPassphraseSecretAnnotKey before the first transformer reading
+// tls.key runs; tls.key itself is left encrypted. When no passphrase is given,
+// the transformers reading tls.key are skipped with a Warning event, and the
+// other ones run.
+func ApplyWithSecrets(secret *corev1.Secret, get SecretGetter) ([]Event, error) {
+	ok, err := EvalCondition(secret)
+	if err != nil {
+		return []Event{{corev1.EventTypeWarning, "InvalidCondition", fmt.Sprintf("annot '%s': %v", SecretConditionAnnotKey, err)}}, err
+	}
+	if !ok {
+		return nil, nil
+	}
+
+	if !Matches(secret.GetAnnotations()) {
+		return nil, nil
+	}
+
+	// The transformers reading tls.key see it decrypted, while it is left
+	// encrypted in the Secret.
+	var all []Event
+	target := secret
+	var decrypted []byte
+	encrypted := isEncryptedKey(secret.Data[corev1.TLSPrivateKeyKey])
+	skipKeyReaders := false
+
+	for _, t := range transformers {
+		if !Consumes(t, target.GetAnnotations()) {
+			continue
+		}
+
+		if encrypted && readsTLSKey(t, target.GetAnnotations()) {
+			if decrypted == nil && !skipKeyReaders {
+				copied := target.DeepCopy()
+				events, err := keyDecrypter.ApplyWithSecrets(copied, get)
+				all = append(all, events...)
+				switch {
+				case errors.Is(err, errNoPassphrase):
+					skipKeyReaders = true
+				case err != nil:
+					return all, fmt.Errorf("decrypting tls.key: %w", err)
+				default:
+					target, decrypted = copied, copied.Data[corev1.TLSPrivateKeyKey]
+				}
+			}
+			if skipKeyReaders {
+				continue
+			}
+		}
+
+		var events []Event
+		if r, ok := t.(SecretReferencer); ok {
+			events, err = r.ApplyWithSecrets(target, get)
+		} else {
+			events, err = t.Apply(target)
+		}
+		all = append(all, events...)
+		if err != nil {
+			return all, fmt.Errorf("%s: %w", t.Name(), err)
+		}
+	}
+
+	if target != secret {
+		for key, value := range target.Data {
+			if key == corev1.TLSPrivateKeyKey && bytes.Equal(value, decrypted) {
+				continue
+			}
+			secret.Data[key] = value
+		}
+		secret.Annotations = target.Annotations
+	}
+	return all, nil
+}
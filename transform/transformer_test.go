@@ -0,0 +1,86 @@
+package transform
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+)
+
+type upperTransformer struct{}
+
+func (upperTransformer) Name() string          { return "upper" }
+func (upperTransformer) Annotations() []string { return []string{"example.com/upper"} }
+func (upperTransformer) Apply(secret *corev1.Secret) ([]Event, error) {
+	secret.Data["upper"] = []byte("UPPER")
+	return []Event{{corev1.EventTypeNormal, "Upper", "Added key upper"}}, nil
+}
+
+func TestRegister(t *testing.T) {
+	before := Transformers()
+	restore := Register(upperTransformer{})
+
+	assert.True(t, Matches(map[string]string{"example.com/upper": "true"}))
+
+	given := secret(map[string]string{"example.com/upper": "true"}, map[string][]byte{})
+	events, err := Apply(given)
+	require.NoError(t, err)
+	assert.Equal(t, "UPPER", string(given.Data["upper"]))
+	assert.Equal(t, []string{"Normal Upper Added key upper"}, eventStrings(events))
+
+	restore()
+	assert.Equal(t, before, Transformers())
+	assert.False(t, Matches(map[string]string{"example.com/upper": "true"}))
+}
+
+func TestApply(t *testing.T) {
+	t.Run("runs the transformers in order", func(t *testing.T) {
+		given := secret(map[string]string{
+			"secret-transform/secret-transform":    "tls.pem",
+			"secret-transform/secret-copy-tls.crt": "cert",
+		}, map[string][]byte{"tls.key": []byte("fakeKey"), "tls.crt": []byte("fakeCrt")})
+
+		events, err := Apply(given)
+		require.NoError(t, err)
+		assert.Equal(t, "fakeKeyfakeCrt", string(given.Data["tls.pem"]))
+		assert.Equal(t, "fakeCrt", string(given.Data["cert"]))
+		assert.Equal(t, []string{
+			"Normal Transformed Added key tls.pem",
+			"Normal CopiedKey Copied the contents of 'tls.crt' into key 'cert'",
+		}, eventStrings(events))
+	})
+
+	t.Run("nothing happens when the condition is false", func(t *testing.T) {
+		given := secret(map[string]string{
+			"secret-transform/secret-copy-tls.crt": "cert",
+			"secret-transform/condition":           "false",
+		}, map[string][]byte{"tls.crt": []byte("fakeCrt")})
+
+		events, err := Apply(given)
+		require.NoError(t, err)
+		assert.NotContains(t, given.Data, "cert")
+		assert.Empty(t, events)
+	})
+
+	t.Run("a failed copy returns an error and a Warning", func(t *testing.T) {
+		given := secret(map[string]string{
+			"secret-transform/secret-copy-ca.crt": "ca",
+		}, map[string][]byte{})
+
+		events, err := Apply(given)
+		assert.EqualError(t, err, `copy-ca.crt: the key "ca.crt" does not exist`)
+		assert.Equal(t, []string{`Warning FailedCopying annot 'secret-transform/secret-copy-ca.crt': the key "ca.crt" does not exist`}, eventStrings(events))
+	})
+}
+
+func TestConsumes(t *testing.T) {
+	tr := copyTransformer{from: "ca.crt", annots: []string{"a/exact", "a/prefix-*"}}
+
+	assert.True(t, Consumes(tr, map[string]string{"a/exact": "v"}))
+	assert.True(t, Consumes(tr, map[string]string{"a/prefix-foo": "v"}))
+	assert.False(t, Consumes(tr, map[string]string{"a/exact": ""}), "empty values are ignored")
+	assert.False(t, Consumes(tr, map[string]string{"a/prefix-": "v"}), "the prefix alone doesn't match")
+	assert.False(t, Consumes(tr, map[string]string{"a/exact-foo": "v"}), "exact keys aren't prefixes")
+	assert.False(t, Consumes(tr, nil))
+}